@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// adminConfigured 是否配置了 admin_ips 或 admin_token，都未配置时管理接口全部拒绝访问
+func (app *App) adminConfigured() bool {
+	return len(app.Cfg.Security.AdminIPs) > 0 || app.Cfg.Security.AdminToken != ""
+}
+
+// isAdmin 判断请求是否可以访问管理接口：携带正确的令牌，或来自 admin_ips 中的地址。
+// 按直连地址判断，不信任 X-Forwarded-For；同机反向代理转发的请求都来自本机，不默认放行本机地址
+func (app *App) isAdmin(c *gin.Context) bool {
+	if token := app.Cfg.Security.AdminToken; token != "" {
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	for _, entry := range app.Cfg.Security.AdminIPs {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOnly 限制管理接口的访问。管理接口的查询参数可能含有访客 IP 等个人数据，不写入访问日志
+func (app *App) adminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(redactQueryKey, true)
+		if !app.isAdmin(c) {
+			app.log(c).Warn("拒绝访问管理接口",
+				zap.String("ip", app.privacy.anonymize(c.Request.Context(), c.RemoteIP(), time.Now())),
+				zap.String("path", c.Request.URL.Path))
+			app.respondError(c, http.StatusForbidden, apierror.New(apierror.Forbidden))
+			c.Abort()
+			return
+		}
+		c.Set(userKey, "admin")
+		c.Next()
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	amapStaticMapURL = "https://restapi.amap.com/v3/staticmap"
+	// amapCacheTTL 静态图缓存时间，相同参数的静态图内容不变
+	amapCacheTTL = time.Hour
+	// maxAmapCacheEntries 缓存的静态图数量上限，超过时清空重建
+	maxAmapCacheEntries = 256
+	// maxAmapCacheBytes 单张可缓存静态图的最大字节数
+	maxAmapCacheBytes = 2 << 20
+)
+
+// amapClient 请求高德地图API使用的客户端，避免上游无响应时长时间占用连接
+var amapClient = &http.Client{Timeout: 10 * time.Second}
+
+// cachedStaticMap 缓存的静态图响应
+type cachedStaticMap struct {
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// amapCache 高德静态图代理的缓存，只缓存成功的响应
+type amapCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedStaticMap
+}
+
+func (ac *amapCache) get(key string) *cachedStaticMap {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	entry := ac.entries[key]
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+func (ac *amapCache) put(key string, entry *cachedStaticMap) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.entries == nil || len(ac.entries) >= maxAmapCacheEntries {
+		ac.entries = make(map[string]*cachedStaticMap)
+	}
+	ac.entries[key] = entry
+}
+
+// staticMapQuery 转发给高德的查询参数，不包含客户端传入的 key
+func staticMapQuery(params url.Values) url.Values {
+	query := make(url.Values, len(params))
+	for name, values := range params {
+		if name != "key" {
+			query[name] = values
+		}
+	}
+	return query
+}
+
+// staticMapURL 高德静态图API的完整地址，参数经过转义并加上服务器配置的 key
+func (app *App) staticMapURL(query url.Values) string {
+	params := make(url.Values, len(query)+1)
+	for name, values := range query {
+		params[name] = values
+	}
+	params.Set("key", app.Cfg.Map.APIKey)
+	return amapStaticMapURL + "?" + params.Encode()
+}
+
+// amapError 去掉 *url.Error 中的请求地址，避免在日志、链路追踪和响应中泄露服务器的 key
+func amapError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s amap staticmap: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// amapStatusOK 上游响应是否成功
+func amapStatusOK(status int) bool {
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// AmapStaticMap 高德地图静态图API代理，使用服务器配置的 key，成功的响应缓存 amapCacheTTL
+func (app *App) AmapStaticMap(c *gin.Context) {
+	query := staticMapQuery(c.Request.URL.Query())
+	// Encode 按参数名排序，作为缓存键
+	cacheKey := query.Encode()
+	// 设置CORS头，允许任何来源访问
+	c.Header("Access-Control-Allow-Origin", "*")
+
+	entry := app.amap.get(cacheKey)
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.Bool("amap.cache_hit", entry != nil))
+	if entry != nil {
+		app.metrics.amapCacheHits.Inc()
+		c.Data(http.StatusOK, entry.contentType, entry.body)
+		return
+	}
+	app.metrics.amapCacheMisses.Inc()
+
+	// span 中不记录完整 URL，避免泄露服务器的 key
+	ctx, span := tracer.Start(c.Request.Context(), "GET amap staticmap",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(http.MethodGet), semconv.ServerAddress("restapi.amap.com")))
+	defer span.End()
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, app.staticMapURL(query), nil)
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid request")
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "query"))
+		return
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := amapClient.Do(req)
+	app.metrics.amapDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		err = amapError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.metrics.amapErrors.Inc()
+		app.log(c).Error("请求高德地图API失败", zap.Error(err), zap.String("query", cacheKey))
+		app.respondError(c, http.StatusBadGateway, apierror.New(apierror.UpstreamFailed))
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAmapCacheBytes+1))
+	if err != nil {
+		err = amapError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		app.metrics.amapErrors.Inc()
+		app.log(c).Error("读取高德地图API响应失败", zap.Error(err), zap.String("query", cacheKey))
+		app.respondError(c, http.StatusBadGateway, apierror.New(apierror.UpstreamFailed))
+		return
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode), attribute.Int("http.response.body.size", len(body)))
+	if !amapStatusOK(resp.StatusCode) {
+		span.SetStatus(codes.Error, resp.Status)
+		app.metrics.amapErrors.Inc()
+	} else if len(body) <= maxAmapCacheBytes && strings.HasPrefix(contentType, "image/") {
+		// 高德在参数错误时也可能返回 200 和 JSON 错误信息，只缓存图片
+		app.amap.put(cacheKey, &cachedStaticMap{contentType: contentType, body: body, expires: time.Now().Add(amapCacheTTL)})
+	}
+
+	if len(body) > maxAmapCacheBytes {
+		// 超出缓存上限的响应继续转发剩余部分
+		c.DataFromReader(resp.StatusCode, resp.ContentLength, contentType, io.MultiReader(bytes.NewReader(body), resp.Body), nil)
+		return
+	}
+	c.Data(resp.StatusCode, contentType, body)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/useragent"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultAnalyticsDays 统计接口未指定 after 时统计的天数
+	defaultAnalyticsDays = 7
+	// maxDailyBuckets、maxHourlyBuckets 按天和按小时统计时的最大区间
+	maxDailyBuckets  = 366
+	maxHourlyBuckets = 31 * 24
+	// defaultTopLimit、maxTopLimit 排行榜默认和最多返回的条数
+	defaultTopLimit = 10
+	maxTopLimit     = 100
+)
+
+// analyticsRange 统计的时间区间 [from, to)，按 loc 划分日期和小时。includeBots 为 false 时不统计爬虫
+type analyticsRange struct {
+	from        time.Time
+	to          time.Time
+	loc         *time.Location
+	includeBots bool
+}
+
+// cond 返回 timeColumn 在区间内的筛选条件，参数为 args()
+func (r analyticsRange) cond(timeColumn string) string {
+	cond := timeColumn + " >= ? AND " + timeColumn + " < ?"
+	if !r.includeBots {
+		cond += " AND is_bot = 0"
+	}
+	return cond
+}
+
+// args 返回区间在库中的 UTC 时间格式
+func (r analyticsRange) args() []interface{} {
+	return []interface{}{r.from.UTC().Format(sqliteTimeLayout), r.to.UTC().Format(sqliteTimeLayout)}
+}
+
+// offsetModifier 返回把库中 UTC 时间转换到 loc 的 SQLite 时间修饰符
+func (r analyticsRange) offsetModifier() string {
+	_, offset := r.to.In(r.loc).Zone()
+	return fmt.Sprintf("%+d seconds", offset)
+}
+
+// rollupDays 返回完全落在区间内的 UTC 日期 [first, end)。按天汇总表（超过保留期后汇总的数据）按 UTC 日期统计，
+// 无法拆分到其他时区或不足一天的区间，只计入这些日期
+func (r analyticsRange) rollupDays() (first, end time.Time) {
+	from, to := r.from.UTC(), r.to.UTC()
+	first = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	if first.Before(from) {
+		first = first.AddDate(0, 0, 1)
+	}
+	end = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return first, end
+}
+
+// dayCond 返回按天汇总表中 rollupDays() 的筛选条件，参数为 dayArgs()
+func (r analyticsRange) dayCond() string {
+	cond := "day >= ? AND day < ?"
+	if !r.includeBots {
+		cond += " AND is_bot = 0"
+	}
+	return cond
+}
+
+func (r analyticsRange) dayArgs() []interface{} {
+	first, end := r.rollupDays()
+	return []interface{}{first.Format("2006-01-02"), end.Format("2006-01-02")}
+}
+
+// parseAnalyticsTime 解析 RFC3339 或 YYYY-MM-DD，日期按 loc 的零点解释
+func parseAnalyticsTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, loc)
+}
+
+// parseAnalyticsRange 解析 tz、after、before、include_bots 参数。tz 为 IANA 时区名，默认为服务器时区；
+// 未指定 before 时截止到当前时间，未指定 after 时统计此前 defaultAnalyticsDays 天；默认不统计爬虫
+func parseAnalyticsRange(params url.Values) (*analyticsRange, error) {
+	loc := time.Local
+	if tz := params.Get("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, apierror.New(apierror.InvalidParam, "tz")
+		}
+		loc = l
+	}
+	// 按区间结束时的 UTC 偏移统一换算，与 SQLite 中使用的固定偏移保持一致
+	r := &analyticsRange{to: time.Now()}
+	if v := params.Get("before"); v != "" {
+		t, err := parseAnalyticsTime(v, loc)
+		if err != nil {
+			return nil, apierror.New(apierror.InvalidParam, "before")
+		}
+		r.to = t
+	}
+	name, offset := r.to.In(loc).Zone()
+	r.loc = time.FixedZone(name, offset)
+	r.from = r.to.AddDate(0, 0, -defaultAnalyticsDays)
+	if v := params.Get("after"); v != "" {
+		t, err := parseAnalyticsTime(v, r.loc)
+		if err != nil {
+			return nil, apierror.New(apierror.InvalidParam, "after")
+		}
+		r.from = t
+	}
+	if !r.from.Before(r.to) {
+		return nil, apierror.New(apierror.InvalidParam, "after")
+	}
+	if v := params.Get("include_bots"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, apierror.New(apierror.InvalidParam, "include_bots")
+		}
+		r.includeBots = include
+	}
+	return r, nil
+}
+
+// parseTopLimit 解析排行榜的 limit 参数
+func parseTopLimit(params url.Values) (int, error) {
+	v := params.Get("limit")
+	if v == "" {
+		return defaultTopLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, apierror.New(apierror.InvalidParam, "limit")
+	}
+	if limit > maxTopLimit {
+		limit = maxTopLimit
+	}
+	return limit, nil
+}
+
+// TrafficPoint 一个时间段的访问量。RollupUTCDay 不为空时，该点包含这一 UTC 日期的按天汇总数据
+// （时区不是 UTC 时与 Time 所指的本地日期并不完全重合）
+type TrafficPoint struct {
+	Time           string `json:"time"`
+	PageViews      int    `json:"page_views"`
+	UniqueVisitors int    `json:"unique_visitors"`
+	Sessions       int    `json:"sessions"`
+	RollupUTCDay   string `json:"rollup_utc_day,omitempty"`
+}
+
+// AnalyticsSummary 区间内的访问概况。会话时长为会话内第一次和最后一次访问的间隔，只访问一次的会话为 0。
+// 超过保留期已汇总的数据只计入访问量和操作数，RollupUTCFrom、RollupUTCTo 为计入的汇总数据的首末 UTC 日期
+type AnalyticsSummary struct {
+	From               string  `json:"from"`
+	To                 string  `json:"to"`
+	PageViews          int     `json:"page_views"`
+	UniqueVisitors     int     `json:"unique_visitors"`
+	UniqueIPs          int     `json:"unique_ips"`
+	UniquePaths        int     `json:"unique_paths"`
+	Sessions           int     `json:"sessions"`
+	AvgSessionSeconds  float64 `json:"avg_session_seconds"`
+	SingleViewSessions int     `json:"single_view_sessions"`
+	Actions            int     `json:"actions"`
+	RollupUTCFrom      string  `json:"rollup_utc_from,omitempty"`
+	RollupUTCTo        string  `json:"rollup_utc_to,omitempty"`
+}
+
+// RankedItem 排行榜中的一项
+type RankedItem struct {
+	Name           string `json:"name"`
+	Count          int    `json:"count"`
+	UniqueVisitors int    `json:"unique_visitors"`
+}
+
+// concatArgs 按顺序拼接多组 SQL 参数
+func concatArgs(groups ...[]interface{}) []interface{} {
+	var args []interface{}
+	for _, g := range groups {
+		args = append(args, g...)
+	}
+	return args
+}
+
+// visitorKey 区分访客的 SQL 表达式：IP 和 User-Agent 的组合
+const visitorKey = "COALESCE(ip, '') || '|' || COALESCE(user_agent, '')"
+
+// GetAnalyticsSummary 返回区间内的访问量、访客数和操作数
+func (app *App) GetAnalyticsSummary(c *gin.Context) {
+	r, err := parseAnalyticsRange(c.Request.URL.Query())
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), "analytics_summary")
+	defer done()
+	args, dayArgs := r.args(), r.dayArgs()
+	summary := AnalyticsSummary{From: r.from.In(r.loc).Format(time.RFC3339), To: r.to.In(r.loc).Format(time.RFC3339)}
+	var rollupViews, rollupActions int
+	err = app.dbContext(ctx).QueryRow(`
+		SELECT
+			COUNT(*),
+			COUNT(DISTINCT `+visitorKey+`),
+			COUNT(DISTINCT ip),
+			COUNT(DISTINCT path),
+			(SELECT COUNT(*) FROM user_actions WHERE `+r.cond("action_time")+`),
+			(SELECT COALESCE(SUM(page_views), 0) FROM visit_daily_stats WHERE `+r.dayCond()+`),
+			(SELECT COALESCE(SUM(actions), 0) FROM action_daily_stats WHERE `+r.dayCond()+`)
+		FROM visits
+		WHERE `+r.cond("visit_time")+`
+	`, concatArgs(args, dayArgs, dayArgs, args)...).Scan(&summary.PageViews, &summary.UniqueVisitors, &summary.UniqueIPs, &summary.UniquePaths,
+		&summary.Actions, &rollupViews, &rollupActions)
+	summary.PageViews += rollupViews
+	summary.Actions += rollupActions
+	if err == nil {
+		var rollupFrom, rollupTo sql.NullString
+		err = app.dbContext(ctx).QueryRow(`
+			SELECT MIN(day), MAX(day)
+			FROM (
+				SELECT day FROM visit_daily_stats WHERE `+r.dayCond()+`
+				UNION ALL
+				SELECT day FROM action_daily_stats WHERE `+r.dayCond()+`
+			)
+		`, concatArgs(dayArgs, dayArgs)...).Scan(&rollupFrom, &rollupTo)
+		summary.RollupUTCFrom, summary.RollupUTCTo = rollupFrom.String, rollupTo.String
+	}
+	if err == nil {
+		err = app.dbContext(ctx).QueryRow(`
+			SELECT COUNT(*), COALESCE(AVG(seconds), 0), COALESCE(SUM(views = 1), 0)
+			FROM (
+				SELECT (julianday(MAX(visit_time)) - julianday(MIN(visit_time))) * 86400 AS seconds, COUNT(*) AS views
+				FROM visits
+				WHERE `+r.cond("visit_time")+` AND session_id IS NOT NULL
+				GROUP BY session_id
+			)
+		`, args...).Scan(&summary.Sessions, &summary.AvgSessionSeconds, &summary.SingleViewSessions)
+	}
+	if err != nil {
+		app.internalError(c, "统计访问概况失败", zap.Error(err))
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// GetAnalyticsTraffic 按天（interval=day，默认）或小时（interval=hour）返回访问量、访客数和会话数，
+// 没有访问的时间段补零，便于直接绘制图表
+func (app *App) GetAnalyticsTraffic(c *gin.Context) {
+	params := c.Request.URL.Query()
+	r, err := parseAnalyticsRange(params)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var sqlFormat, goFormat string
+	var start time.Time
+	var step func(time.Time) time.Time
+	var maxBuckets int
+	local := r.from.In(r.loc)
+	switch interval := params.Get("interval"); interval {
+	case "", "day":
+		sqlFormat, goFormat = "%Y-%m-%d", "2006-01-02"
+		start = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, r.loc)
+		step = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+		maxBuckets = maxDailyBuckets
+	case "hour":
+		sqlFormat, goFormat = "%Y-%m-%d %H:00", "2006-01-02 15:00"
+		start = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, r.loc)
+		step = func(t time.Time) time.Time { return t.Add(time.Hour) }
+		maxBuckets = maxHourlyBuckets
+	default:
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "interval"))
+		return
+	}
+
+	var series []TrafficPoint
+	index := make(map[string]int)
+	for t := start; t.Before(r.to); t = step(t) {
+		if len(series) == maxBuckets {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "after"))
+			return
+		}
+		key := t.Format(goFormat)
+		index[key] = len(series)
+		series = append(series, TrafficPoint{Time: key})
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), "analytics_traffic")
+	defer done()
+	rows, err := app.dbContext(ctx).Query(`
+		SELECT strftime(?, visit_time, ?) AS bucket, COUNT(*), COUNT(DISTINCT `+visitorKey+`), COUNT(DISTINCT session_id)
+		FROM visits
+		WHERE `+r.cond("visit_time")+`
+		GROUP BY bucket
+	`, append([]interface{}{sqlFormat, r.offsetModifier()}, r.args()...)...)
+	if err != nil {
+		app.internalError(c, "统计访问量失败", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p TrafficPoint
+		if err := rows.Scan(&p.Time, &p.PageViews, &p.UniqueVisitors, &p.Sessions); err != nil {
+			app.internalError(c, "统计访问量失败", zap.Error(err))
+			return
+		}
+		if i, ok := index[p.Time]; ok {
+			series[i] = p
+		}
+	}
+	if err := rows.Err(); err != nil {
+		app.internalError(c, "统计访问量失败", zap.Error(err))
+		return
+	}
+	if goFormat == "2006-01-02" {
+		if err := app.addDailyRollups(ctx, r, series, index); err != nil {
+			app.internalError(c, "统计访问量失败", zap.Error(err))
+			return
+		}
+	}
+	c.JSON(http.StatusOK, series)
+}
+
+// addDailyRollups 把按天汇总表中的访问量加到同一日期的点上并标记 RollupUTCDay。汇总表按 UTC 日期统计，
+// 保留期的分界为 UTC 零点，汇总数据与未汇总的访问记录不重叠
+func (app *App) addDailyRollups(ctx context.Context, r *analyticsRange, series []TrafficPoint, index map[string]int) error {
+	rows, err := app.dbContext(ctx).Query(`
+		SELECT day, SUM(page_views), SUM(unique_visitors), SUM(sessions)
+		FROM visit_daily_stats
+		WHERE `+r.dayCond()+`
+		GROUP BY day
+	`, r.dayArgs()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p TrafficPoint
+		if err := rows.Scan(&p.Time, &p.PageViews, &p.UniqueVisitors, &p.Sessions); err != nil {
+			return err
+		}
+		if i, ok := index[p.Time]; ok {
+			series[i].PageViews += p.PageViews
+			series[i].UniqueVisitors += p.UniqueVisitors
+			series[i].Sessions += p.Sessions
+			series[i].RollupUTCDay = p.Time
+		}
+	}
+	return rows.Err()
+}
+
+// topItems 按 column 分组统计区间内的访问量，返回访问量最多的 limit 项。
+// rollupTable 不为空时同时统计该按天汇总表的访问量；汇总表只有每天的访客数，不能跨天去重，访客数只统计未汇总的访问记录
+func (app *App) topItems(ctx context.Context, column, rollupTable string, r *analyticsRange, limit int) ([]RankedItem, error) {
+	query := fmt.Sprintf(`
+		SELECT %s AS name, COUNT(*) AS views, COUNT(DISTINCT %s) AS visitors
+		FROM visits
+		WHERE %s AND COALESCE(%s, '') <> ''
+		GROUP BY name`, column, visitorKey, r.cond("visit_time"), column)
+	args := r.args()
+	if rollupTable != "" {
+		query += fmt.Sprintf(`
+		UNION ALL
+		SELECT %s, SUM(page_views), 0
+		FROM %s
+		WHERE %s AND %s <> ''
+		GROUP BY %s`, column, rollupTable, r.dayCond(), column, column)
+		args = append(args, r.dayArgs()...)
+	}
+	rows, err := app.dbContext(ctx).Query(fmt.Sprintf(`
+		SELECT name, SUM(views) AS views, SUM(visitors)
+		FROM (%s)
+		GROUP BY name
+		ORDER BY views DESC, name
+		LIMIT %d
+	`, query, limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []RankedItem{}
+	for rows.Next() {
+		var item RankedItem
+		if err := rows.Scan(&item.Name, &item.Count, &item.UniqueVisitors); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// GetAnalyticsTopPaths 返回访问量最多的路径
+func (app *App) GetAnalyticsTopPaths(c *gin.Context) {
+	app.respondTopItems(c, "path", "path_daily_stats", "analytics_top_paths")
+}
+
+// GetAnalyticsTopReferers 返回带来访问最多的来源页面，不包含没有来源的直接访问
+func (app *App) GetAnalyticsTopReferers(c *gin.Context) {
+	app.respondTopItems(c, "referer", "", "analytics_top_referers")
+}
+
+func (app *App) respondTopItems(c *gin.Context, column, rollupTable, queryName string) {
+	params := c.Request.URL.Query()
+	r, err := parseAnalyticsRange(params)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := parseTopLimit(params)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), queryName)
+	defer done()
+	items, err := app.topItems(ctx, column, rollupTable, r, limit)
+	if err != nil {
+		app.internalError(c, "统计排行失败", zap.Error(err), zap.String("column", column))
+		return
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// GetAnalyticsDevices 按 User-Agent 识别的设备类型、浏览器和操作系统统计访问量和访客数
+func (app *App) GetAnalyticsDevices(c *gin.Context) {
+	r, err := parseAnalyticsRange(c.Request.URL.Query())
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), "analytics_devices")
+	defer done()
+	// 按访客汇总后在 Go 中识别 User-Agent，每个访客的 User-Agent 只识别一次
+	rows, err := app.dbContext(ctx).Query(`
+		SELECT COALESCE(user_agent, ''), COUNT(*)
+		FROM visits
+		WHERE `+r.cond("visit_time")+`
+		GROUP BY COALESCE(ip, ''), COALESCE(user_agent, '')
+	`, r.args()...)
+	if err != nil {
+		app.internalError(c, "统计设备失败", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	devices := make(map[string]*RankedItem)
+	browsers := make(map[string]*RankedItem)
+	systems := make(map[string]*RankedItem)
+	parsed := make(map[string]useragent.Info)
+	count := func(m map[string]*RankedItem, name string, views int) {
+		item := m[name]
+		if item == nil {
+			item = &RankedItem{Name: name}
+			m[name] = item
+		}
+		item.Count += views
+		item.UniqueVisitors++
+	}
+	for rows.Next() {
+		var ua string
+		var views int
+		if err := rows.Scan(&ua, &views); err != nil {
+			app.internalError(c, "统计设备失败", zap.Error(err))
+			return
+		}
+		info, ok := parsed[ua]
+		if !ok {
+			info = useragent.Parse(ua)
+			parsed[ua] = info
+		}
+		count(devices, info.Device, views)
+		count(browsers, info.Browser, views)
+		count(systems, info.OS, views)
+	}
+	if err := rows.Err(); err != nil {
+		app.internalError(c, "统计设备失败", zap.Error(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"devices":  rankItems(devices),
+		"browsers": rankItems(browsers),
+		"os":       rankItems(systems),
+	})
+}
+
+// rankItems 按数量从多到少排序
+func rankItems(m map[string]*RankedItem) []RankedItem {
+	items := make([]RankedItem, 0, len(m))
+	for _, item := range m {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items
+}
+
+// GetAnalyticsActions 按操作类型统计区间内的操作次数，unique_visitors 为执行过该操作的访客数（只统计未汇总的记录）
+func (app *App) GetAnalyticsActions(c *gin.Context) {
+	r, err := parseAnalyticsRange(c.Request.URL.Query())
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), "analytics_actions")
+	defer done()
+	rows, err := app.dbContext(ctx).Query(`
+		SELECT name, SUM(n) AS n, SUM(visitors)
+		FROM (
+			SELECT COALESCE(action_type, '') AS name, COUNT(*) AS n, COUNT(DISTINCT `+visitorKey+`) AS visitors
+			FROM user_actions
+			WHERE `+r.cond("action_time")+`
+			GROUP BY name
+			UNION ALL
+			SELECT action_type, SUM(actions), 0
+			FROM action_daily_stats
+			WHERE `+r.dayCond()+`
+			GROUP BY action_type
+		)
+		GROUP BY name
+		ORDER BY n DESC, name
+	`, concatArgs(r.args(), r.dayArgs())...)
+	if err != nil {
+		app.internalError(c, "统计用户操作失败", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+	items := []RankedItem{}
+	for rows.Next() {
+		var item RankedItem
+		if err := rows.Scan(&item.Name, &item.Count, &item.UniqueVisitors); err != nil {
+			app.internalError(c, "统计用户操作失败", zap.Error(err))
+			return
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		app.internalError(c, "统计用户操作失败", zap.Error(err))
+		return
+	}
+	c.JSON(http.StatusOK, items)
+}
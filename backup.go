@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/backup"
+	"mapproject/pkg/config"
+	"mapproject/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// createBackup 在备份目录生成新备份并按保留数量清理旧备份
+func (app *App) createBackup(ctx context.Context) (string, *backup.Manifest, error) {
+	name := backup.FileName(time.Now())
+	manifest, err := backup.Create(ctx, app.DB, app.Cfg.Server.UploadDir, filepath.Join(app.Cfg.Backup.Dir, name))
+	if err != nil {
+		return "", nil, err
+	}
+	app.Logger.Info("备份完成", zap.String("name", name), zap.Int("files", len(manifest.Files)))
+
+	removed, err := backup.Prune(app.Cfg.Backup.Dir, app.Cfg.Backup.Retention)
+	if err != nil {
+		app.Logger.Error("清理旧备份失败", zap.Error(err))
+	}
+	if len(removed) > 0 {
+		app.Logger.Info("清理旧备份", zap.Strings("removed", removed))
+	}
+	return name, manifest, nil
+}
+
+// scheduleBackups 按配置的间隔定时备份，ctx 取消时退出
+func (app *App) scheduleBackups(ctx context.Context) {
+	if app.Cfg.Backup.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(app.Cfg.Backup.Interval) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, _, err := app.createBackup(ctx); err != nil {
+				app.Logger.Error("定时备份失败", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (app *App) CreateBackup(c *gin.Context) {
+	name, manifest, err := app.createBackup(c.Request.Context())
+	if err != nil {
+		app.internalError(c, "备份失败", zap.Error(err))
+		return
+	}
+
+	app.recordUserAction(c, "create_backup", fmt.Sprintf("创建备份 %s", name), name)
+
+	c.JSON(http.StatusOK, gin.H{"name": name, "manifest": manifest})
+}
+
+func (app *App) ListBackups(c *gin.Context) {
+	backups, err := backup.List(app.Cfg.Backup.Dir)
+	if err != nil {
+		app.internalError(c, "查询备份失败", zap.Error(err))
+		return
+	}
+	c.JSON(http.StatusOK, backups)
+}
+
+func (app *App) DownloadBackup(c *gin.Context) {
+	name := c.Param("name")
+	if !backup.IsBackupFile(name) {
+		app.respondError(c, http.StatusNotFound, apierror.New(apierror.BackupNotFound))
+		return
+	}
+
+	app.recordUserAction(c, "download_backup", fmt.Sprintf("下载备份 %s", name), name)
+
+	c.FileAttachment(filepath.Join(app.Cfg.Backup.Dir, name), name)
+}
+
+// runCommand 执行命令行子命令（backup、verify、restore），返回进程退出码
+func runCommand(cfg *config.Config, args []string) int {
+	switch args[0] {
+	case "backup":
+		fs := flag.NewFlagSet("backup", flag.ExitOnError)
+		output := fs.String("o", "", "备份文件路径，默认写入配置的备份目录")
+		fs.Parse(args[1:])
+
+		db := initDB(cfg.Database.Path)
+		defer db.Close()
+		app := &App{DB: db, Cfg: cfg, Logger: logger.Log}
+
+		if *output != "" {
+			if _, err := backup.Create(context.Background(), db, cfg.Server.UploadDir, *output); err != nil {
+				logger.Log.Error("备份失败", zap.Error(err))
+				return 1
+			}
+			fmt.Println(*output)
+			return 0
+		}
+		name, _, err := app.createBackup(context.Background())
+		if err != nil {
+			logger.Log.Error("备份失败", zap.Error(err))
+			return 1
+		}
+		fmt.Println(filepath.Join(cfg.Backup.Dir, name))
+		return 0
+
+	case "verify":
+		if len(args) < 2 {
+			fmt.Println("用法: verify <备份文件>")
+			return 2
+		}
+		manifest, err := backup.Verify(args[1])
+		if err != nil {
+			logger.Log.Error("备份校验失败", zap.Error(err), zap.String("archive", args[1]))
+			return 1
+		}
+		fmt.Printf("校验通过: %d 个文件, 创建于 %s\n", len(manifest.Files), manifest.CreatedAt.Format(time.RFC3339))
+		return 0
+
+	case "restore":
+		if len(args) < 2 {
+			fmt.Println("用法: restore <备份文件>（需先停止服务）")
+			return 2
+		}
+		oldDB, oldUploads, err := backup.Restore(args[1], cfg.Database.Path, cfg.Server.UploadDir)
+		if err != nil {
+			logger.Log.Error("恢复失败", zap.Error(err), zap.String("archive", args[1]))
+			return 1
+		}
+		logger.Log.Info("恢复完成",
+			zap.String("archive", args[1]),
+			zap.String("previous_database", oldDB),
+			zap.String("previous_uploads", oldUploads))
+		return 0
+	}
+
+	fmt.Printf("未知命令: %s（可用: backup, verify, restore）\n", args[0])
+	return 2
+}
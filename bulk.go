@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxBulkOperations 单次批量请求最多包含的操作数
+	maxBulkOperations = 1000
+	// maxTileInvalidatePoints 受影响的点超过该数量时整体清空瓦片缓存
+	maxTileInvalidatePoints = 100
+	// maxAuditIDs 批量操作日志中最多列出的标记点 ID 数
+	maxAuditIDs = 50
+)
+
+// bulkSettableFields 按条件批量修改时允许设置的字段
+var bulkSettableFields = map[string]bool{
+	"value":              true,
+	"required_value":     true,
+	"description":        true,
+	"sufficient_color":   true,
+	"insufficient_color": true,
+}
+
+// bulkOperation 批量请求中的一项操作：
+//   - create: 使用 marker 新建标记点
+//   - update: 按 JSON Merge Patch 修改 id 对应的标记点，version 为修改所基于的版本
+//   - delete: 删除 id 对应的标记点，version 为删除所基于的版本
+//   - update_where: 对满足 filter（与 GET /api/markers 的筛选参数相同）的标记点设置 set 中的字段
+type bulkOperation struct {
+	Op      string                     `json:"op"`
+	ID      int                        `json:"id,omitempty"`
+	Version int                        `json:"version,omitempty"`
+	Marker  *Marker                    `json:"marker,omitempty"`
+	Patch   map[string]json.RawMessage `json:"patch,omitempty"`
+	Filter  map[string]string          `json:"filter,omitempty"`
+	Set     map[string]json.RawMessage `json:"set,omitempty"`
+}
+
+type bulkRequest struct {
+	Operations []bulkOperation `json:"operations"`
+	CRS        string          `json:"crs"`
+	// Atomic 默认为 true：任一操作失败时回滚全部操作
+	Atomic *bool `json:"atomic"`
+}
+
+// bulkResult 单项操作的结果，status 与对应单条接口的 HTTP 状态码一致
+type bulkResult struct {
+	Index   int          `json:"index"`
+	Op      string       `json:"op"`
+	Status  int          `json:"status"`
+	ID      int          `json:"id,omitempty"`
+	Version int          `json:"version,omitempty"`
+	Count   int          `json:"count,omitempty"`
+	Code    string       `json:"code,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// bulkOutcome 批量操作累计的影响，用于提交后清除缓存、删除文件和记录日志
+type bulkOutcome struct {
+	created, updated, deleted []int
+	points                    []geo.Point
+	filenames                 []string
+}
+
+func (o *bulkOutcome) ids() []string {
+	var ids []string
+	for _, group := range [][]int{o.created, o.updated, o.deleted} {
+		for _, id := range group {
+			ids = append(ids, strconv.Itoa(id))
+		}
+	}
+	return ids
+}
+
+// bulkError 单项操作失败，status 为对应的 HTTP 状态码
+type bulkError struct {
+	status int
+	err    error
+}
+
+func (e *bulkError) Error() string { return e.err.Error() }
+
+func (e *bulkError) Unwrap() error { return e.err }
+
+func bulkFailed(status int, code apierror.Code, args ...interface{}) *bulkError {
+	return &bulkError{status: status, err: apierror.New(code, args...)}
+}
+
+// bulkStatus 将单条接口使用的错误转换为状态码，未知错误视为服务器错误
+func bulkStatus(err error) int {
+	var be *bulkError
+	var invalid invalidPatchError
+	var verr *validationError
+	switch {
+	case errors.As(err, &be):
+		return be.status
+	case errors.As(err, &verr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errMarkerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errVersionConflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errExternalKeyTaken):
+		return http.StatusConflict
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// runBulkOperation 在事务中执行一项操作并填写结果，失败时返回错误，由调用方回滚该操作
+func runBulkOperation(tx queryExecer, op *bulkOperation, crs geo.CRS, res *bulkResult, out *bulkOutcome) error {
+	switch op.Op {
+	case "create":
+		if op.Marker == nil {
+			return bulkFailed(http.StatusBadRequest, apierror.MissingParam, "marker")
+		}
+		marker := *op.Marker
+		markerCRS := crs
+		if marker.CRS != "" {
+			var err error
+			if markerCRS, err = parseCRS(marker.CRS); err != nil {
+				return &bulkError{status: http.StatusBadRequest, err: err}
+			}
+		}
+		marker.CRS = string(markerCRS)
+		if err := validateStruct(&marker); err != nil {
+			return err
+		}
+		if err := insertMarker(tx, &marker); err != nil {
+			return err
+		}
+		res.Status, res.ID, res.Version = http.StatusCreated, marker.ID, marker.Version
+		out.created = append(out.created, marker.ID)
+		out.points = append(out.points, geo.Convert(geo.Point{Lat: marker.Latitude, Lng: marker.Longitude}, markerCRS, storageCRS))
+
+	case "update":
+		if op.ID <= 0 || op.Version <= 0 {
+			return bulkFailed(http.StatusPreconditionRequired, apierror.MissingParam, "id, version")
+		}
+		if op.Patch == nil {
+			return bulkFailed(http.StatusBadRequest, apierror.MissingParam, "patch")
+		}
+		res.ID = op.ID
+		change, err := patchMarker(tx, strconv.Itoa(op.ID), op.Version, op.Patch, crs)
+		if err != nil {
+			return err
+		}
+		res.Status, res.Version = http.StatusOK, change.version
+		if len(change.fields) > 0 {
+			out.updated = append(out.updated, op.ID)
+			out.points = append(out.points, change.old, change.new)
+		}
+
+	case "delete":
+		if op.ID <= 0 || op.Version <= 0 {
+			return bulkFailed(http.StatusPreconditionRequired, apierror.MissingParam, "id, version")
+		}
+		res.ID = op.ID
+		pos, filenames, err := deleteMarker(tx, strconv.Itoa(op.ID), op.Version)
+		if err != nil {
+			return err
+		}
+		res.Status = http.StatusOK
+		out.deleted = append(out.deleted, op.ID)
+		out.points = append(out.points, pos)
+		out.filenames = append(out.filenames, filenames...)
+
+	case "update_where":
+		ids, points, err := updateMarkersWhere(tx, op.Filter, op.Set, crs)
+		if err != nil {
+			return err
+		}
+		res.Status, res.Count = http.StatusOK, len(ids)
+		out.updated = append(out.updated, ids...)
+		out.points = append(out.points, points...)
+
+	default:
+		return bulkFailed(http.StatusBadRequest, apierror.UnsupportedOperation, op.Op)
+	}
+	return nil
+}
+
+// updateMarkersWhere 对满足筛选条件的标记点设置字段，返回受影响的 ID 和位置（存储坐标系）
+func updateMarkersWhere(tx queryExecer, filter map[string]string, set map[string]json.RawMessage, crs geo.CRS) ([]int, []geo.Point, error) {
+	if len(set) == 0 {
+		return nil, nil, bulkFailed(http.StatusBadRequest, apierror.MissingParam, "set")
+	}
+	for field := range set {
+		if !bulkSettableFields[field] {
+			return nil, nil, bulkFailed(http.StatusBadRequest, apierror.UnsupportedField, field)
+		}
+	}
+	// 借助 applyMarkerPatch 校验取值并得到 null 对应的默认值
+	var values Marker
+	fields, err := applyMarkerPatch(&values, set)
+	if err != nil {
+		return nil, nil, &bulkError{status: http.StatusBadRequest, err: err}
+	}
+	if err := validateStruct(&values, fields...); err != nil {
+		return nil, nil, err
+	}
+
+	params := url.Values{}
+	for k, v := range filter {
+		params.Set(k, v)
+	}
+	q, err := parseMarkerQuery(params, crs)
+	if err != nil {
+		return nil, nil, &bulkError{status: http.StatusBadRequest, err: err}
+	}
+	if q.near != nil || q.cursor != nil || q.limit > 0 {
+		return nil, nil, bulkFailed(http.StatusBadRequest, apierror.UnsupportedParam, "near, cursor, limit")
+	}
+	where, whereArgs := q.whereClause(false)
+	if where == "" {
+		return nil, nil, bulkFailed(http.StatusBadRequest, apierror.MissingParam, "filter")
+	}
+
+	sets := make([]string, 0, len(fields)+1)
+	args := make([]interface{}, 0, len(fields)+len(whereArgs))
+	for _, field := range fields {
+		sets = append(sets, field+" = ?")
+		switch field {
+		case "value":
+			args = append(args, values.Value)
+		case "required_value":
+			args = append(args, values.RequiredValue)
+		case "description":
+			args = append(args, values.Description)
+		case "sufficient_color":
+			args = append(args, values.SufficientColor)
+		case "insufficient_color":
+			args = append(args, values.InsufficientColor)
+		}
+	}
+	sets = append(sets, "version = version + 1")
+	args = append(args, whereArgs...)
+
+	rows, err := tx.Query("UPDATE markers AS m SET "+strings.Join(sets, ", ")+" "+where+
+		" RETURNING id, latitude, longitude", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	var points []geo.Point
+	for rows.Next() {
+		var id int
+		var p geo.Point
+		if err := rows.Scan(&id, &p.Lat, &p.Lng); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		points = append(points, p)
+	}
+	return ids, points, rows.Err()
+}
+
+// BulkMarkers 在一个事务中批量新建、修改和删除标记点，返回每项操作的结果，并只记录一条操作日志。
+// 默认任一操作失败即全部回滚（返回 422）；atomic 为 false 时只跳过失败的操作
+func (app *App) BulkMarkers(c *gin.Context) {
+	var req bulkRequest
+	if !app.bindJSON(c, &req) {
+		return
+	}
+	if len(req.Operations) == 0 {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.MissingParam, "operations"))
+		return
+	}
+	if len(req.Operations) > maxBulkOperations {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.TooManyOperations, maxBulkOperations))
+		return
+	}
+	atomic := req.Atomic == nil || *req.Atomic
+	lang := requestLang(c)
+
+	crs, err := resolveCRS(c, req.CRS, storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := app.DB.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		app.internalError(c, "开始事务失败", zap.Error(err))
+		return
+	}
+	defer tx.Rollback()
+	db := app.tx(c, tx)
+
+	results := make([]bulkResult, len(req.Operations))
+	var out bulkOutcome
+	failed := 0
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		res := &results[i]
+		res.Index, res.Op = i, op.Op
+
+		// 每项操作使用一个保存点，失败时只撤销该操作已写入的部分
+		if _, err := db.Exec("SAVEPOINT bulk_op"); err != nil {
+			app.internalError(c, "批量操作标记点失败", zap.Error(err))
+			return
+		}
+		snapshot := out
+		err := runBulkOperation(db, op, crs, res, &out)
+		if err != nil {
+			failed++
+			out = snapshot
+			res.Status = bulkStatus(err)
+			if res.Status == http.StatusInternalServerError {
+				// 不返回服务器错误的细节，日志中按请求 ID 定位
+				id := requestID(c)
+				app.log(c).Error("批量操作标记点失败", zap.Error(err), zap.Int("index", i), zap.String("op", op.Op),
+					zap.String("code", string(apierror.Internal)))
+				res.Code, res.Error = string(apierror.Internal), apierror.Message(apierror.Internal, lang, id)
+			} else {
+				res.Code, res.Error = string(errorCode(err)), localizeError(err, lang)
+			}
+			var verr *validationError
+			if errors.As(err, &verr) {
+				res.Fields = verr.localizeFields(lang)
+			}
+			_, err = db.Exec("ROLLBACK TO bulk_op")
+		}
+		if err == nil {
+			_, err = db.Exec("RELEASE bulk_op")
+		}
+		if err != nil {
+			app.internalError(c, "批量操作标记点失败", zap.Error(err))
+			return
+		}
+	}
+
+	if atomic && failed > 0 {
+		app.respondError(c, http.StatusUnprocessableEntity, apierror.New(apierror.BulkFailed), gin.H{"results": results})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		app.internalError(c, "提交事务失败", zap.Error(err))
+		return
+	}
+	app.removeUploadFiles(out.filenames)
+	if len(out.points) > maxTileInvalidatePoints {
+		app.tiles.invalidateAll()
+	} else if len(out.points) > 0 {
+		app.tiles.invalidatePoints(out.points...)
+	}
+
+	ids := out.ids()
+	if len(ids) > 0 {
+		detail := fmt.Sprintf("批量操作标记点: 新增 %d, 修改 %d, 删除 %d, 失败 %d",
+			len(out.created), len(out.updated), len(out.deleted), failed)
+		if len(ids) > maxAuditIDs {
+			detail += fmt.Sprintf(" (#%s 等 %d 个)", strings.Join(ids[:maxAuditIDs], ", #"), len(ids))
+		} else {
+			detail += fmt.Sprintf(" (#%s)", strings.Join(ids, ", #"))
+		}
+		app.recordUserAction(c, "bulk_markers", detail, "")
+	}
+
+	app.log(c).Info("批量操作标记点",
+		zap.Int("operations", len(req.Operations)),
+		zap.Int("created", len(out.created)),
+		zap.Int("updated", len(out.updated)),
+		zap.Int("deleted", len(out.deleted)),
+		zap.Int("failed", failed))
+
+	c.JSON(http.StatusOK, gin.H{
+		"created": len(out.created),
+		"updated": len(out.updated),
+		"deleted": len(out.deleted),
+		"failed":  failed,
+		"results": results,
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// clusterGridSize 聚合网格边长（像素）
+	clusterGridSize = 60
+	// clusterMaxZoom 达到该缩放级别后不再聚合，直接返回单个标记点
+	clusterMaxZoom = 18
+	// maxZoom 允许请求的最大缩放级别
+	maxZoom = 22
+	// defaultClusterMinPoints 网格内少于该数量的标记点单独返回
+	defaultClusterMinPoints = 2
+	// maxClusterCacheEntries 聚合缓存的最大条目数，超过后整体清空
+	maxClusterCacheEntries = 256
+)
+
+// MarkerCluster 聚合后的标记点组，坐标为组内标记点的平均位置
+type MarkerCluster struct {
+	Latitude         float64    `json:"latitude"`
+	Longitude        float64    `json:"longitude"`
+	Count            int        `json:"count"`
+	Sufficient       int        `json:"sufficient"`
+	Insufficient     int        `json:"insufficient"`
+	ValueSum         float64    `json:"value_sum"`
+	RequiredValueSum float64    `json:"required_value_sum"`
+	BBox             [4]float64 `json:"bbox"` // minLng,minLat,maxLng,maxLat
+	ExpansionZoom    int        `json:"expansion_zoom"`
+	sw, ne           geo.Point  // 存储坐标系下的外接矩形
+}
+
+// clusterResult 某缩放级别下的聚合结果
+type clusterResult struct {
+	Zoom     int             `json:"zoom"`
+	Clusters []MarkerCluster `json:"clusters"`
+	Markers  []Marker        `json:"markers"`
+}
+
+// clusterCache 按查询参数缓存聚合结果，标记点数据版本变化后整体失效
+type clusterCache struct {
+	mu      sync.Mutex
+	version int64
+	entries map[string]*clusterResult
+}
+
+func (cc *clusterCache) get(version int64, key string) *clusterResult {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.version != version {
+		return nil
+	}
+	return cc.entries[key]
+}
+
+func (cc *clusterCache) put(version int64, key string, result *clusterResult) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.version != version || cc.entries == nil || len(cc.entries) >= maxClusterCacheEntries {
+		cc.version = version
+		cc.entries = make(map[string]*clusterResult)
+	}
+	cc.entries[key] = result
+}
+
+// clusterMarkers 将标记点按 Web 墨卡托像素网格分组，网格对齐全局像素坐标，平移地图时结果保持稳定
+func clusterMarkers(markers []Marker, zoom, minPoints int) ([]MarkerCluster, []Marker) {
+	if zoom >= clusterMaxZoom {
+		return []MarkerCluster{}, markers
+	}
+
+	type cell struct{ x, y int64 }
+	index := make(map[cell]int)
+	groups := make([][]int, 0)
+	for i, m := range markers {
+		x, y := geo.MercatorPixel(geo.Point{Lat: m.Latitude, Lng: m.Longitude}, zoom)
+		key := cell{int64(math.Floor(x / clusterGridSize)), int64(math.Floor(y / clusterGridSize))}
+		g, ok := index[key]
+		if !ok {
+			g = len(groups)
+			index[key] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	clusters := make([]MarkerCluster, 0)
+	singles := make([]Marker, 0)
+	for _, group := range groups {
+		if len(group) < minPoints {
+			for _, i := range group {
+				singles = append(singles, markers[i])
+			}
+			continue
+		}
+
+		cl := MarkerCluster{Count: len(group)}
+		var sumLat, sumLng float64
+		for n, i := range group {
+			m := &markers[i]
+			p := geo.Point{Lat: m.Latitude, Lng: m.Longitude}
+			if n == 0 {
+				cl.sw, cl.ne = p, p
+			}
+			cl.sw.Lat, cl.sw.Lng = math.Min(cl.sw.Lat, p.Lat), math.Min(cl.sw.Lng, p.Lng)
+			cl.ne.Lat, cl.ne.Lng = math.Max(cl.ne.Lat, p.Lat), math.Max(cl.ne.Lng, p.Lng)
+			sumLat += p.Lat
+			sumLng += p.Lng
+			cl.ValueSum += m.Value
+			cl.RequiredValueSum += m.RequiredValue
+			if m.Sufficient() {
+				cl.Sufficient++
+			} else {
+				cl.Insufficient++
+			}
+		}
+		cl.Latitude = sumLat / float64(cl.Count)
+		cl.Longitude = sumLng / float64(cl.Count)
+		cl.ExpansionZoom = expansionZoom(cl.sw, cl.ne, zoom)
+		clusters = append(clusters, cl)
+	}
+	return clusters, singles
+}
+
+// expansionZoom 返回组内标记点开始分散到不同网格的缩放级别，供前端点击聚合点时缩放
+func expansionZoom(sw, ne geo.Point, zoom int) int {
+	for z := zoom + 1; z < clusterMaxZoom; z++ {
+		x1, y1 := geo.MercatorPixel(sw, z)
+		x2, y2 := geo.MercatorPixel(ne, z)
+		if math.Floor(x1/clusterGridSize) != math.Floor(x2/clusterGridSize) ||
+			math.Floor(y1/clusterGridSize) != math.Floor(y2/clusterGridSize) {
+			return z
+		}
+	}
+	return clusterMaxZoom
+}
+
+// toCRS 将聚合结果转换为指定坐标系，聚合结果可能被缓存共享，返回副本
+func (r *clusterResult) toCRS(to geo.CRS) *clusterResult {
+	out := &clusterResult{
+		Zoom:     r.Zoom,
+		Clusters: append(make([]MarkerCluster, 0, len(r.Clusters)), r.Clusters...),
+		Markers:  append(make([]Marker, 0, len(r.Markers)), r.Markers...),
+	}
+	for i := range out.Clusters {
+		cl := &out.Clusters[i]
+		cl.Latitude, cl.Longitude = convertLatLng(cl.Latitude, cl.Longitude, storageCRS, to)
+		sw := geo.Convert(cl.sw, storageCRS, to)
+		ne := geo.Convert(cl.ne, storageCRS, to)
+		cl.BBox = [4]float64{sw.Lng, sw.Lat, ne.Lng, ne.Lat}
+	}
+	for i := range out.Markers {
+		out.Markers[i].toCRS(to)
+	}
+	return out
+}
+
+// GetMarkerClusters 按 bbox 和 zoom 返回聚合结果，支持与 GET /api/markers 相同的筛选参数
+func (app *App) GetMarkerClusters(c *gin.Context) {
+	crs, err := resolveCRS(c, "", storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	params := c.Request.URL.Query()
+	zoom, err := strconv.Atoi(params.Get("zoom"))
+	if err != nil || zoom < 0 || zoom > maxZoom {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "zoom"))
+		return
+	}
+	minPoints := defaultClusterMinPoints
+	if v := params.Get("min_points"); v != "" {
+		minPoints, err = strconv.Atoi(v)
+		if err != nil || minPoints < 1 {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "min_points"))
+			return
+		}
+	}
+
+	q, err := parseMarkerQuery(params, crs)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if q.near != nil || q.cursor != nil || q.limit > 0 {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.UnsupportedParam, "near, cursor, limit"))
+		return
+	}
+
+	// 先读取版本号再查询数据，保证缓存的结果不会比版本号旧
+	version, err := app.dataVersion(c.Request.Context(), "markers")
+	if err != nil {
+		app.internalError(c, "查询数据版本失败", zap.Error(err))
+		return
+	}
+	key := fmt.Sprintf("%s|%s", crs, params.Encode())
+
+	result := app.clusters.get(version, key)
+	if result == nil {
+		where, args := q.whereClause(false)
+		markers, err := app.selectMarkers(c.Request.Context(), where, args, "ORDER BY m.id")
+		if err != nil {
+			app.internalError(c, "查询标记点失败", zap.Error(err))
+			return
+		}
+
+		clusters, singles := clusterMarkers(markers, zoom, minPoints)
+		if err := app.attachImages(c.Request.Context(), singles); err != nil {
+			app.internalError(c, "查询标记点图片失败", zap.Error(err))
+			return
+		}
+		result = &clusterResult{Zoom: zoom, Clusters: clusters, Markers: singles}
+		app.clusters.put(version, key, result)
+	}
+
+	c.JSON(http.StatusOK, result.toCRS(crs))
+}
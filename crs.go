@@ -0,0 +1,63 @@
+package main
+
+import (
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storageCRS 数据库中坐标统一使用的坐标系，与前端高德地图一致
+const storageCRS = geo.GCJ02
+
+// resolveCRS 依次读取 crs 查询参数、表单字段和请求体中的值，都未提供时返回 def
+func resolveCRS(c *gin.Context, bodyCRS string, def geo.CRS) (geo.CRS, error) {
+	v := c.Query("crs")
+	if v == "" {
+		v = c.PostForm("crs")
+	}
+	if v == "" {
+		v = bodyCRS
+	}
+	if v == "" {
+		return def, nil
+	}
+	return parseCRS(v)
+}
+
+// parseCRS 解析坐标系名称，不支持时返回 unsupported_crs 错误
+func parseCRS(v string) (geo.CRS, error) {
+	crs, err := geo.ParseCRS(v)
+	if err != nil {
+		return "", apierror.New(apierror.UnsupportedCRS, v)
+	}
+	return crs, nil
+}
+
+func convertLatLng(lat, lng float64, from, to geo.CRS) (float64, float64) {
+	p := geo.Convert(geo.Point{Lat: lat, Lng: lng}, from, to)
+	return p.Lat, p.Lng
+}
+
+// crsOrStorage 坐标当前所属的坐标系，未标明时视为存储坐标系
+func crsOrStorage(crs string) geo.CRS {
+	if crs == "" {
+		return storageCRS
+	}
+	return geo.CRS(crs)
+}
+
+// toCRS 将标记点坐标转换到目标坐标系
+func (m *Marker) toCRS(to geo.CRS) {
+	m.Latitude, m.Longitude = convertLatLng(m.Latitude, m.Longitude, crsOrStorage(m.CRS), to)
+	m.CRS = string(to)
+}
+
+// toCRS 将轨迹坐标转换到目标坐标系
+func (t *Trajectory) toCRS(to geo.CRS) {
+	from := crsOrStorage(t.CRS)
+	for i := range t.Points {
+		t.Points[i].Latitude, t.Points[i].Longitude = convertLatLng(t.Points[i].Latitude, t.Points[i].Longitude, from, to)
+	}
+	t.CRS = string(to)
+}
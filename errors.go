@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+// requestLang 按 Accept-Language 选择错误提示的语言
+func requestLang(c *gin.Context) apierror.Lang {
+	return apierror.Negotiate(c.GetHeader("Accept-Language"))
+}
+
+// requestID 返回 requestContext 确定的请求 ID，服务器错误的响应中返回该 ID，用于在日志中定位对应记录
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// isUniqueViolation 是否违反唯一约束
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// errorCode 错误对应的错误码，未登记的错误视为请求无效
+func errorCode(err error) apierror.Code {
+	var apiErr *apierror.Error
+	var verr *validationError
+	switch {
+	case errors.As(err, &verr):
+		return apierror.ValidationFailed
+	case errors.As(err, &apiErr):
+		return apiErr.Code
+	}
+	return apierror.InvalidRequest
+}
+
+// localizeError 返回错误在指定语言下的提示
+func localizeError(err error, lang apierror.Lang) string {
+	var apiErr *apierror.Error
+	var verr *validationError
+	switch {
+	case errors.As(err, &verr):
+		return verr.localize(lang)
+	case errors.As(err, &apiErr):
+		return apiErr.Localize(lang)
+	}
+	return apierror.Message(apierror.InvalidRequest, lang, err.Error())
+}
+
+// respondError 返回客户端错误：错误码和按 Accept-Language 本地化的提示，extra 中的字段一并返回。
+// err 为 *apierror.Error 或 *validationError 时使用对应的错误码，其他错误视为请求无效
+func (app *App) respondError(c *gin.Context, status int, err error, extra ...gin.H) {
+	lang := requestLang(c)
+	code := errorCode(err)
+	body := gin.H{"error": localizeError(err, lang), "code": code}
+	var verr *validationError
+	if errors.As(err, &verr) {
+		body["fields"] = verr.localizeFields(lang)
+	}
+	for _, h := range extra {
+		for k, v := range h {
+			body[k] = v
+		}
+	}
+
+	app.log(c).Info("请求错误",
+		zap.String("code", string(code)),
+		zap.Int("status", status),
+		zap.String("method", c.Request.Method),
+		zap.String("path", c.Request.URL.Path),
+		zap.String("error", err.Error()))
+	c.JSON(status, body)
+}
+
+// internalError 记录服务器错误并返回 500。响应中不包含错误细节（如 SQL 错误），
+// 只返回请求 ID，日志中的同一条记录带有该 ID 和错误码
+func (app *App) internalError(c *gin.Context, msg string, fields ...zap.Field) {
+	id := requestID(c)
+	fields = append(fields, zap.String("code", string(apierror.Internal)))
+	app.log(c).WithOptions(zap.AddCallerSkip(1)).Error(msg, fields...)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":      apierror.Message(apierror.Internal, requestLang(c), id),
+		"code":       apierror.Internal,
+		"request_id": id,
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+	"mapproject/pkg/gpx"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func (app *App) ExportGPX(c *gin.Context) {
+	// GPX 规范要求使用 WGS-84
+	crs, err := resolveCRS(c, "", geo.WGS84)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	markers, trajectories, err := app.loadExportData(c.Request.Context(), crs)
+	if err != nil {
+		app.internalError(c, "查询导出数据失败", zap.Error(err))
+		return
+	}
+
+	doc := &gpx.GPX{
+		Creator:  "学生动态轨迹",
+		Metadata: &gpx.Metadata{Name: "学生动态轨迹", Time: time.Now().UTC().Format(time.RFC3339)},
+	}
+	for _, m := range markers {
+		status := "insufficient"
+		if m.Sufficient() {
+			status = "sufficient"
+		}
+		doc.Waypoints = append(doc.Waypoints, gpx.Waypoint{
+			Lat:         m.Latitude,
+			Lon:         m.Longitude,
+			Name:        fmt.Sprintf("标记点 #%d", m.ID),
+			Comment:     fmt.Sprintf("当前值: %g / 需求值: %g", m.Value, m.RequiredValue),
+			Description: m.Description,
+			Type:        status,
+		})
+	}
+	for _, t := range trajectories {
+		seg := gpx.TrackSegment{}
+		for _, p := range t.Points {
+			seg.Points = append(seg.Points, gpx.Waypoint{Lat: p.Latitude, Lon: p.Longitude})
+		}
+		doc.Tracks = append(doc.Tracks, gpx.Track{
+			Name:        t.Name,
+			Description: t.Description,
+			Segments:    []gpx.TrackSegment{seg},
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := gpx.Encode(&buf, doc); err != nil {
+		app.internalError(c, "生成GPX失败", zap.Error(err))
+		return
+	}
+
+	app.recordUserAction(c, "export_gpx", fmt.Sprintf("导出GPX (%d 个标记点, %d 条轨迹)", len(markers), len(trajectories)), "")
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename("gpx")))
+	c.Data(http.StatusOK, "application/gpx+xml", buf.Bytes())
+}
+
+// gpxTrajectory 将一组 GPX 点转换为轨迹，按 JSON 接口的规则校验原始点（错误中的下标为点在航迹段中的序号），
+// 通过后再抽稀
+func gpxTrajectory(name, description string, points []gpx.Waypoint, tolerance float64, crs geo.CRS) (Trajectory, []rowError) {
+	t := Trajectory{Name: name, Description: description, CRS: string(crs)}
+	for _, p := range points {
+		t.Points = append(t.Points, LatLng{Latitude: p.Lat, Longitude: p.Lon})
+	}
+	if errs := validateImportedTrajectory(&t); len(errs) > 0 {
+		return t, errs
+	}
+
+	line := make([]geo.Point, 0, len(t.Points))
+	for _, p := range t.Points {
+		line = append(line, geo.Point{Lat: p.Latitude, Lng: p.Longitude})
+	}
+	t.Points = t.Points[:0]
+	for _, p := range geo.Simplify(line, tolerance) {
+		t.Points = append(t.Points, LatLng{Latitude: p.Lat, Longitude: p.Lng})
+	}
+	return t, nil
+}
+
+func (app *App) ImportGPX(c *gin.Context) {
+	crs, err := resolveCRS(c, "", geo.WGS84)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tolerance := app.Cfg.Import.SimplifyTolerance
+	if v := c.Query("tolerance"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "tolerance"))
+			return
+		}
+		tolerance = t
+	}
+
+	data, filename, err := app.readImportFile(c)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	doc, err := gpx.Decode(bytes.NewReader(data))
+	if err != nil {
+		app.log(c).Info("解析导入文件失败", zap.Error(err), zap.String("filename", filename))
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// 航点和航迹按 JSON 接口的规则校验，row 为航点（或轨迹）在文件中的序号（从 1 开始），轨迹的字段以 trajectory. 开头
+	invalid := []rowError{}
+	var trajectories []Trajectory
+	var originalPoints int
+	addTrajectory := func(name, description string, points []gpx.Waypoint) {
+		originalPoints += len(points)
+		t, errs := gpxTrajectory(name, description, points, tolerance, crs)
+		trajectories = append(trajectories, t)
+		for _, e := range errs {
+			e.Row, e.Field = len(trajectories), "trajectory."+e.Field
+			invalid = append(invalid, e)
+		}
+	}
+	for _, trk := range doc.Tracks {
+		for i, seg := range trk.Segments {
+			if len(seg.Points) < 2 {
+				continue
+			}
+			name := trk.Name
+			if len(trk.Segments) > 1 {
+				name = fmt.Sprintf("%s #%d", trk.Name, i+1)
+			}
+			addTrajectory(name, trk.Description, seg.Points)
+		}
+	}
+	for _, rte := range doc.Routes {
+		if len(rte.Points) < 2 {
+			continue
+		}
+		addTrajectory(rte.Name, rte.Description, rte.Points)
+	}
+
+	markers := make([]Marker, len(doc.Waypoints))
+	for i, wpt := range doc.Waypoints {
+		description := wpt.Description
+		if description == "" {
+			description = strings.TrimSpace(strings.Join([]string{wpt.Name, wpt.Comment}, " "))
+		}
+		markers[i] = Marker{Latitude: wpt.Lat, Longitude: wpt.Lon, Description: description, CRS: string(crs)}
+		for _, e := range validateImportedMarker(&markers[i]) {
+			e.Row = i + 1
+			invalid = append(invalid, e)
+		}
+	}
+	if len(invalid) > 0 {
+		app.respondError(c, http.StatusUnprocessableEntity, apierror.New(apierror.ImportFailed),
+			gin.H{"errors": localizeRowErrors(invalid, requestLang(c))})
+		return
+	}
+
+	tx, err := app.DB.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		app.internalError(c, "开始事务失败", zap.Error(err))
+		return
+	}
+	defer tx.Rollback()
+	db := app.tx(c, tx)
+
+	for i := range markers {
+		if err := insertMarker(db, &markers[i]); err != nil {
+			app.internalError(c, "插入标记点失败", zap.Error(err), zap.String("filename", filename))
+			return
+		}
+	}
+
+	var simplifiedPoints int
+	for i := range trajectories {
+		if err := insertTrajectory(db, &trajectories[i]); err != nil {
+			app.internalError(c, "插入轨迹失败", zap.Error(err), zap.String("filename", filename))
+			return
+		}
+		simplifiedPoints += len(trajectories[i].Points)
+	}
+
+	if err := tx.Commit(); err != nil {
+		app.internalError(c, "提交事务失败", zap.Error(err))
+		return
+	}
+	app.tiles.invalidateAll()
+
+	app.recordUserAction(c, "import_gpx",
+		fmt.Sprintf("从 %s 导入 %d 个标记点, %d 条轨迹", filename, len(doc.Waypoints), len(trajectories)),
+		"")
+
+	app.log(c).Info("导入GPX",
+		zap.String("filename", filename),
+		zap.Int("markers", len(doc.Waypoints)),
+		zap.Int("trajectories", len(trajectories)),
+		zap.Int("points", originalPoints),
+		zap.Int("simplified_points", simplifiedPoints),
+		zap.Float64("tolerance", tolerance))
+
+	c.JSON(http.StatusOK, gin.H{
+		"markers":           len(doc.Waypoints),
+		"trajectories":      len(trajectories),
+		"points":            originalPoints,
+		"simplified_points": simplifiedPoints,
+	})
+}
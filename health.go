@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 健康检查结果的状态
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFail     = "fail"
+	healthSkipped  = "skipped"
+)
+
+// dbWriteCheckTTL 数据库试写结果的缓存时间，避免频繁的探测请求每次都开启写事务
+const dbWriteCheckTTL = 5 * time.Second
+
+// amapHealthURL 检测高德地图API连通性时请求的地址，能收到任何 HTTP 响应即视为可达
+const amapHealthURL = "https://restapi.amap.com/"
+
+// startTime 进程启动时间，存活检查中返回运行时长
+var startTime = time.Now()
+
+// schemaColumns 迁移添加的列，缺少时说明迁移未完成
+var schemaColumns = []struct{ table, column string }{
+	{"markers", "description"},
+	{"markers", "sufficient_color"},
+	{"markers", "insufficient_color"},
+	{"markers", "external_key"},
+	{"markers", "source_crs"},
+	{"markers", "version"},
+	{"trajectories", "source_crs"},
+	{"images", "caption"},
+	{"visits", "session_id"},
+	{"visits", "is_bot"},
+	{"user_actions", "is_bot"},
+}
+
+// errDiskSpaceUnsupported 当前平台无法获取剩余磁盘空间
+var errDiskSpaceUnsupported = errors.New("当前平台不支持检查磁盘空间")
+
+// healthCheck 一项检查。critical 为 false 的检查失败时整体状态为 degraded，不影响就绪
+type healthCheck struct {
+	name     string
+	critical bool
+	run      func(ctx context.Context) (detail gin.H, err error)
+}
+
+// checkResult 单项检查的结果
+type checkResult struct {
+	Status     string  `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+	Detail     gin.H   `json:"detail,omitempty"`
+}
+
+// errCheckSkipped 检查按配置跳过
+var errCheckSkipped = errors.New("skipped")
+
+// dbWriteCheck 缓存最近一次数据库试写的结果，并发的检查共用同一次试写
+type dbWriteCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// run 返回 dbWriteCheckTTL 内的缓存结果，过期时重新试写
+func (wc *dbWriteCheck) run(ctx context.Context, db *sql.DB) (checked time.Time, err error) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if !wc.checked.IsZero() && time.Since(wc.checked) < dbWriteCheckTTL {
+		return wc.checked, wc.err
+	}
+	wc.err = tryWrite(ctx, db)
+	wc.checked = time.Now()
+	return wc.checked, wc.err
+}
+
+// tryWrite 在事务中试写一次（回滚，不留下数据），可以发现只读或被锁定的数据库
+func tryWrite(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "UPDATE data_versions SET version = version WHERE name = 'markers'"); err != nil {
+		return fmt.Errorf("写入失败: %w", err)
+	}
+	return nil
+}
+
+// checkDatabase 检查数据库连接，并试写一次（结果缓存 dbWriteCheckTTL）
+func (app *App) checkDatabase(ctx context.Context) (gin.H, error) {
+	if err := app.DB.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("连接失败: %w", err)
+	}
+	checked, err := app.dbWrite.run(ctx, app.DB)
+	if err != nil {
+		return nil, err
+	}
+	stats := app.DB.Stats()
+	return gin.H{
+		"open_connections": stats.OpenConnections,
+		"in_use":           stats.InUse,
+		"write_checked_at": checked.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// checkMigrations 检查迁移添加的列和空间索引是否都已存在
+func (app *App) checkMigrations(ctx context.Context) (gin.H, error) {
+	var missing []string
+	for _, sc := range schemaColumns {
+		var n int
+		err := app.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", sc.table, sc.column).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			missing = append(missing, sc.table+"."+sc.column)
+		}
+	}
+	var unindexed int
+	err := app.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM markers WHERE id NOT IN (SELECT id FROM markers_rtree)").Scan(&unindexed)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 || unindexed > 0 {
+		return gin.H{"missing_columns": missing, "unindexed_markers": unindexed}, errors.New("数据库迁移未完成")
+	}
+	return gin.H{"columns": len(schemaColumns)}, nil
+}
+
+// checkUploadDir 在上传目录中创建并删除一个临时文件
+func (app *App) checkUploadDir(ctx context.Context) (gin.H, error) {
+	f, err := os.CreateTemp(app.Cfg.Server.UploadDir, ".health-*")
+	if err != nil {
+		return nil, fmt.Errorf("上传目录不可写: %w", err)
+	}
+	name := f.Name()
+	_, err = f.WriteString("ok")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(name)
+	if err != nil {
+		return nil, fmt.Errorf("上传目录不可写: %w", err)
+	}
+	return gin.H{"path": app.Cfg.Server.UploadDir}, nil
+}
+
+// checkDiskSpace 检查上传目录所在磁盘的剩余空间
+func (app *App) checkDiskSpace(ctx context.Context) (gin.H, error) {
+	free, err := freeDiskSpace(app.Cfg.Server.UploadDir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return nil, errCheckSkipped
+	}
+	if err != nil {
+		return nil, err
+	}
+	freeMB := int64(free / (1 << 20))
+	detail := gin.H{"free_mb": freeMB, "min_free_mb": app.Cfg.Health.MinFreeDiskMB}
+	if freeMB < app.Cfg.Health.MinFreeDiskMB {
+		return detail, errors.New("磁盘剩余空间不足")
+	}
+	return detail, nil
+}
+
+// checkAmap 检查高德地图API是否可达，离线部署可通过 health.check_amap 关闭
+func (app *App) checkAmap(ctx context.Context) (gin.H, error) {
+	if !app.Cfg.Health.CheckAmap {
+		return nil, errCheckSkipped
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, amapHealthURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return gin.H{"status_code": resp.StatusCode}, nil
+}
+
+// runHealthChecks 并发执行各项检查，返回整体状态和各项结果
+func (app *App) runHealthChecks(ctx context.Context, checks []healthCheck) (string, map[string]checkResult) {
+	timeout := time.Duration(app.Cfg.Health.Timeout) * time.Second
+	results := make(map[string]checkResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, hc := range checks {
+		wg.Add(1)
+		go func(hc healthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			detail, err := hc.run(ctx)
+			res := checkResult{
+				Status:     healthOK,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+				Detail:     detail,
+			}
+			switch {
+			case errors.Is(err, errCheckSkipped):
+				res.Status = healthSkipped
+			case err != nil:
+				res.Status, res.Error = healthFail, err.Error()
+			}
+			mu.Lock()
+			results[hc.name] = res
+			mu.Unlock()
+		}(hc)
+	}
+	wg.Wait()
+
+	status := healthOK
+	for _, hc := range checks {
+		if results[hc.name].Status != healthFail {
+			continue
+		}
+		if hc.critical {
+			return healthFail, results
+		}
+		status = healthDegraded
+	}
+	return status, results
+}
+
+// respondHealth 执行检查并返回结果，关键检查失败时返回 503。
+// details 为 false 时（公开接口）只返回各项的状态和耗时，错误信息和路径等细节只写入日志
+func (app *App) respondHealth(c *gin.Context, checks []healthCheck, details bool) {
+	start := time.Now()
+	status, results := app.runHealthChecks(c.Request.Context(), checks)
+	code := http.StatusOK
+	if status == healthFail {
+		code = http.StatusServiceUnavailable
+		app.log(c).Warn("健康检查失败", zap.Any("checks", results))
+	}
+	if !details {
+		for name, res := range results {
+			res.Error, res.Detail = "", nil
+			results[name] = res
+		}
+	}
+	c.JSON(code, gin.H{
+		"status":      status,
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		"checks":      results,
+	})
+}
+
+// readinessChecks 决定能否接收请求的检查
+func (app *App) readinessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "database", critical: true, run: app.checkDatabase},
+		{name: "migrations", critical: true, run: app.checkMigrations},
+		{name: "uploads", critical: true, run: app.checkUploadDir},
+	}
+}
+
+// fullChecks 完整健康检查：就绪检查之外还检查磁盘空间和高德地图API连通性（非关键）
+func (app *App) fullChecks() []healthCheck {
+	return append(app.readinessChecks(),
+		healthCheck{name: "disk", critical: false, run: app.checkDiskSpace},
+		healthCheck{name: "amap", critical: false, run: app.checkAmap},
+	)
+}
+
+// Health 完整健康检查，只返回状态和耗时
+func (app *App) Health(c *gin.Context) {
+	app.respondHealth(c, app.fullChecks(), false)
+}
+
+// HealthDetails 完整健康检查，附带错误信息和各项细节，仅管理员可用
+func (app *App) HealthDetails(c *gin.Context) {
+	app.respondHealth(c, app.fullChecks(), true)
+}
+
+// Ready 就绪检查，供负载均衡或编排系统判断是否转发流量
+func (app *App) Ready(c *gin.Context) {
+	app.respondHealth(c, app.readinessChecks(), false)
+}
+
+// Live 存活检查，只说明进程能够响应请求，不检查依赖
+func (app *App) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":         healthOK,
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	})
+}
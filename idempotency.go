@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotencyKeyLength Idempotency-Key 的最大长度
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBodySize 带 Idempotency-Key 的请求体上限：一次上传最多的图片加上其余字段和 multipart 开销。
+	// 计算指纹需要把请求体读入内存，超过时返回 413
+	maxIdempotentBodySize = maxImagesPerMarker*maxImageSize + 1<<20
+)
+
+// bodyRecorder 在写出响应的同时保留一份响应体，供重放使用
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// requestFingerprint 计算请求指纹：方法、路径和请求体。multipart 请求按各部分的字段名、
+// 文件名和内容计算，不受每次随机生成的 boundary 影响
+func requestFingerprint(r *http.Request, body []byte) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		h.Write(body)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%q %q\n", part.FormName(), part.FileName())
+		_, err = io.Copy(h, part)
+		part.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// purgeIdempotencyKeys 删除过期的幂等记录，以及超过写超时仍未完成（进程中途退出）的记录
+func purgeIdempotencyKeys(db queryExecer, ttlHours, writeTimeout int) error {
+	_, err := db.Exec(`
+		DELETE FROM idempotency_keys
+		WHERE created_at < datetime('now', ?)
+		   OR (status = 0 AND created_at < datetime('now', ?))`,
+		fmt.Sprintf("-%d hours", ttlHours),
+		fmt.Sprintf("-%d seconds", writeTimeout))
+	return err
+}
+
+// idempotent 支持 Idempotency-Key 请求头：首次请求的响应保存 idempotency.ttl 小时，
+// 期间相同 key 和相同内容的请求直接重放原响应；key 相同但内容不同返回 422，
+// 原请求仍在处理中返回 409。只保存 2xx/3xx 响应，失败的请求（4xx、5xx）不保存，
+// 客户端修改内容后或稍后可以用同一个 key 重试
+func (app *App) idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader(idempotencyKeyHeader))
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.IdempotencyKeyTooLong, maxIdempotencyKeyLength))
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.respondError(c, http.StatusRequestEntityTooLarge, apierror.New(apierror.IdempotencyBodyLarge, maxIdempotentBodySize>>20))
+			c.Abort()
+			return
+		}
+		if err != nil {
+			app.respondError(c, http.StatusBadRequest, err)
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint, err := requestFingerprint(c.Request, body)
+		if err != nil {
+			app.respondError(c, http.StatusBadRequest, err)
+			c.Abort()
+			return
+		}
+
+		db := app.db(c)
+		if err := purgeIdempotencyKeys(db, app.Cfg.Idempotency.TTL, app.Cfg.Server.WriteTimeout); err != nil {
+			app.log(c).Warn("清理幂等记录失败", zap.Error(err))
+		}
+		result, err := db.Exec("INSERT INTO idempotency_keys (key, fingerprint) VALUES (?, ?) ON CONFLICT(key) DO NOTHING", key, fingerprint)
+		if err != nil {
+			app.internalError(c, "保存幂等记录失败", zap.Error(err))
+			c.Abort()
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			app.replayIdempotent(c, key, fingerprint)
+			return
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		status := recorder.Status()
+		if status >= http.StatusBadRequest {
+			_, err = db.Exec("DELETE FROM idempotency_keys WHERE key = ?", key)
+		} else {
+			_, err = db.Exec("UPDATE idempotency_keys SET status = ?, content_type = ?, etag = ?, body = ? WHERE key = ?",
+				status, recorder.Header().Get("Content-Type"), recorder.Header().Get("ETag"), recorder.body.Bytes(), key)
+		}
+		if err != nil {
+			app.log(c).Error("保存幂等记录失败", zap.Error(err), zap.String("key", key))
+		}
+	}
+}
+
+// replayIdempotent 处理重复的 Idempotency-Key
+func (app *App) replayIdempotent(c *gin.Context, key, fingerprint string) {
+	var stored, contentType, etag string
+	var status int
+	var body []byte
+	err := app.db(c).QueryRow("SELECT fingerprint, status, content_type, etag, body FROM idempotency_keys WHERE key = ?", key).
+		Scan(&stored, &status, &contentType, &etag, &body)
+	if err == sql.ErrNoRows {
+		// 原请求刚好失败并删除了记录
+		app.respondError(c, http.StatusConflict, apierror.New(apierror.IdempotencyRetry))
+		c.Abort()
+		return
+	}
+	if err != nil {
+		app.internalError(c, "查询幂等记录失败", zap.Error(err))
+		c.Abort()
+		return
+	}
+
+	switch {
+	case stored != fingerprint:
+		app.respondError(c, http.StatusUnprocessableEntity, apierror.New(apierror.IdempotencyKeyReused))
+		c.Abort()
+	case status == 0:
+		app.respondError(c, http.StatusConflict, apierror.New(apierror.IdempotencyInProgress))
+		c.Abort()
+	default:
+		app.log(c).Info("重放幂等请求", zap.String("key", key), zap.String("path", c.Request.URL.Path))
+		c.Header("Idempotent-Replayed", "true")
+		if etag != "" {
+			c.Header("ETag", etag)
+		}
+		c.Data(status, contentType, body)
+		c.Abort()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotent(t *testing.T) {
+	app := newTestApp(t)
+	app.Cfg.Idempotency.TTL = 24
+	app.Cfg.Server.WriteTimeout = 30
+
+	// 请求体包含 invalid 时返回 422，其余返回 201 和处理次数
+	calls := 0
+	r := gin.New()
+	r.POST("/items", app.idempotent(), func(c *gin.Context) {
+		calls++
+		body, _ := c.GetRawData()
+		if strings.Contains(string(body), "invalid") {
+			app.respondError(c, http.StatusUnprocessableEntity, apierror.New(apierror.ValidationFailed))
+			return
+		}
+		c.Header("ETag", `"1"`)
+		c.JSON(http.StatusCreated, gin.H{"calls": calls})
+	})
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	errorCode := func(w *httptest.ResponseRecorder) apierror.Code {
+		var resp struct {
+			Code apierror.Code `json:"code"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Code
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		first := post("k1", `{"name":"a"}`)
+		if first.Code != http.StatusCreated {
+			t.Fatalf("status = %d, want 201", first.Code)
+		}
+		again := post("k1", `{"name":"a"}`)
+		if again.Code != http.StatusCreated || again.Body.String() != first.Body.String() {
+			t.Errorf("replay = %d %s, want 201 %s", again.Code, again.Body, first.Body)
+		}
+		if again.Header().Get("Idempotent-Replayed") != "true" || again.Header().Get("ETag") != `"1"` {
+			t.Errorf("replay headers = %v", again.Header())
+		}
+		if calls != 1 {
+			t.Errorf("handler called %d times, want 1", calls)
+		}
+	})
+
+	t.Run("fingerprint mismatch", func(t *testing.T) {
+		if w := post("k1", `{"name":"b"}`); w.Code != http.StatusUnprocessableEntity || errorCode(w) != apierror.IdempotencyKeyReused {
+			t.Errorf("status = %d %s, want 422 %s", w.Code, errorCode(w), apierror.IdempotencyKeyReused)
+		}
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		// 模拟另一个仍在处理中的请求
+		fingerprint, _ := requestFingerprint(httptest.NewRequest(http.MethodPost, "/items", nil), []byte(`{"name":"c"}`))
+		if _, err := app.DB.Exec("INSERT INTO idempotency_keys (key, fingerprint) VALUES (?, ?)", "k2", fingerprint); err != nil {
+			t.Fatal(err)
+		}
+		if w := post("k2", `{"name":"c"}`); w.Code != http.StatusConflict || errorCode(w) != apierror.IdempotencyInProgress {
+			t.Errorf("status = %d %s, want 409 %s", w.Code, errorCode(w), apierror.IdempotencyInProgress)
+		}
+	})
+
+	t.Run("client error then corrected retry", func(t *testing.T) {
+		before := calls
+		if w := post("k3", `{"name":"invalid"}`); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status = %d, want 422", w.Code)
+		}
+		// 同样的内容重试会重新处理，而不是重放旧的错误
+		if w := post("k3", `{"name":"invalid"}`); w.Header().Get("Idempotent-Replayed") != "" {
+			t.Error("failed response was replayed")
+		}
+		// 修正后用同一个 key 提交成功，之后重放成功的响应
+		if w := post("k3", `{"name":"valid"}`); w.Code != http.StatusCreated {
+			t.Fatalf("corrected retry: status = %d %s, want 201", w.Code, w.Body)
+		}
+		if w := post("k3", `{"name":"valid"}`); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("replay after retry: status = %d, headers %v", w.Code, w.Header())
+		}
+		if got := calls - before; got != 3 {
+			t.Errorf("handler called %d times, want 3", got)
+		}
+	})
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+	"mapproject/pkg/kml"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// maxImportSize 导入文件（含 KMZ 内嵌图片）的最大体积
+const maxImportSize = 64 << 20 // 64MB
+
+// kmzImageDir KMZ 包内存放图片的目录
+const kmzImageDir = "files"
+
+// markerStyleID 按颜色生成共享样式 ID
+func markerStyleID(color string) string {
+	return "marker-" + strings.ToLower(strings.TrimPrefix(color, "#"))
+}
+
+func lineStyleID(color string) string {
+	return "line-" + strings.ToLower(strings.TrimPrefix(color, "#"))
+}
+
+// buildKML 将标记点和轨迹组装为 KML 文档，imageHref 决定图片链接的写法
+func buildKML(markers []Marker, trajectories []Trajectory, imageHref func(filename string) string) *kml.KML {
+	doc := &kml.KML{Document: kml.Document{Name: "学生动态轨迹"}}
+	styles := make(map[string]bool)
+
+	markerFolder := kml.Folder{Name: "标记点"}
+	for _, m := range markers {
+		color := m.InsufficientColor
+		if m.Sufficient() {
+			color = m.SufficientColor
+		}
+		styleID := markerStyleID(color)
+		if !styles[styleID] {
+			styles[styleID] = true
+			doc.Document.Styles = append(doc.Document.Styles, kml.Style{
+				ID:        styleID,
+				IconStyle: &kml.IconStyle{Color: kml.Color(color), Scale: "1.1"},
+			})
+		}
+
+		var desc strings.Builder
+		desc.WriteString(html.EscapeString(m.Description))
+		fmt.Fprintf(&desc, "<br/>当前值: %g / 需求值: %g", m.Value, m.RequiredValue)
+		for _, img := range m.Images {
+			fmt.Fprintf(&desc, `<br/><img src="%s" width="320"/>`, html.EscapeString(imageHref(img)))
+		}
+
+		pm := kml.Placemark{
+			Name:        fmt.Sprintf("标记点 #%d", m.ID),
+			Description: desc.String(),
+			StyleURL:    "#" + styleID,
+			Point: &kml.Point{Coordinates: kml.FormatCoordinates([]kml.Coordinate{
+				{Longitude: m.Longitude, Latitude: m.Latitude},
+			})},
+		}
+		pm.Set("id", strconv.Itoa(m.ID))
+		pm.Set("description", m.Description)
+		pm.Set("value", strconv.FormatFloat(m.Value, 'f', -1, 64))
+		pm.Set("required_value", strconv.FormatFloat(m.RequiredValue, 'f', -1, 64))
+		pm.Set("sufficient_color", m.SufficientColor)
+		pm.Set("insufficient_color", m.InsufficientColor)
+		markerFolder.Placemarks = append(markerFolder.Placemarks, pm)
+	}
+
+	trajectoryFolder := kml.Folder{Name: "轨迹"}
+	for _, t := range trajectories {
+		styleID := lineStyleID(t.Color)
+		if !styles[styleID] {
+			styles[styleID] = true
+			doc.Document.Styles = append(doc.Document.Styles, kml.Style{
+				ID:        styleID,
+				LineStyle: &kml.LineStyle{Color: kml.Color(t.Color), Width: "4"},
+			})
+		}
+
+		coords := make([]kml.Coordinate, 0, len(t.Points))
+		for _, p := range t.Points {
+			coords = append(coords, kml.Coordinate{Longitude: p.Longitude, Latitude: p.Latitude})
+		}
+		trajectoryFolder.Placemarks = append(trajectoryFolder.Placemarks, kml.Placemark{
+			Name:        t.Name,
+			Description: html.EscapeString(t.Description),
+			StyleURL:    "#" + styleID,
+			LineString:  &kml.LineString{Tessellate: 1, Coordinates: kml.FormatCoordinates(coords)},
+		})
+	}
+
+	doc.Document.Folders = []kml.Folder{markerFolder, trajectoryFolder}
+	return doc
+}
+
+// requestBaseURL 根据请求推断站点地址，用于生成可在外部查看器中打开的图片链接
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// loadExportData 查询标记点和轨迹并转换到导出坐标系
+func (app *App) loadExportData(ctx context.Context, crs geo.CRS) ([]Marker, []Trajectory, error) {
+	markers, err := app.loadMarkers(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	trajectories, err := app.loadTrajectories(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range markers {
+		markers[i].toCRS(crs)
+	}
+	for i := range trajectories {
+		trajectories[i].toCRS(crs)
+	}
+	return markers, trajectories, nil
+}
+
+func exportFilename(ext string) string {
+	return fmt.Sprintf("markers-%s.%s", time.Now().Format("20060102-150405"), ext)
+}
+
+func (app *App) ExportKML(c *gin.Context) {
+	// KML 规范要求使用 WGS-84
+	crs, err := resolveCRS(c, "", geo.WGS84)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	markers, trajectories, err := app.loadExportData(c.Request.Context(), crs)
+	if err != nil {
+		app.internalError(c, "查询导出数据失败", zap.Error(err))
+		return
+	}
+
+	baseURL := requestBaseURL(c)
+	doc := buildKML(markers, trajectories, func(filename string) string {
+		return baseURL + "/uploads/" + filename
+	})
+
+	var buf bytes.Buffer
+	if err := kml.Encode(&buf, doc); err != nil {
+		app.internalError(c, "生成KML失败", zap.Error(err))
+		return
+	}
+
+	app.recordUserAction(c, "export_kml", fmt.Sprintf("导出KML (%d 个标记点, %d 条轨迹)", len(markers), len(trajectories)), "")
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename("kml")))
+	c.Data(http.StatusOK, "application/vnd.google-earth.kml+xml", buf.Bytes())
+}
+
+func (app *App) ExportKMZ(c *gin.Context) {
+	// KML 规范要求使用 WGS-84
+	crs, err := resolveCRS(c, "", geo.WGS84)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	markers, trajectories, err := app.loadExportData(c.Request.Context(), crs)
+	if err != nil {
+		app.internalError(c, "查询导出数据失败", zap.Error(err))
+		return
+	}
+
+	doc := buildKML(markers, trajectories, func(filename string) string {
+		return path.Join(kmzImageDir, filename)
+	})
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(kml.DocFile)
+	if err == nil {
+		err = kml.Encode(w, doc)
+	}
+	if err != nil {
+		app.internalError(c, "生成KML失败", zap.Error(err))
+		return
+	}
+
+	for _, m := range markers {
+		for _, img := range m.Images {
+			filename := filepath.Base(img)
+			data, err := os.ReadFile(filepath.Join(app.Cfg.Server.UploadDir, filename))
+			if err != nil {
+				// 图片文件丢失时跳过，不影响其余数据导出
+				app.log(c).Warn("读取图片失败", zap.Error(err), zap.String("filename", filename))
+				continue
+			}
+			w, err := zw.Create(path.Join(kmzImageDir, filename))
+			if err == nil {
+				_, err = w.Write(data)
+			}
+			if err != nil {
+				app.internalError(c, "写入KMZ失败", zap.Error(err), zap.String("filename", filename))
+				return
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		app.internalError(c, "生成KMZ失败", zap.Error(err))
+		return
+	}
+
+	app.recordUserAction(c, "export_kmz", fmt.Sprintf("导出KMZ (%d 个标记点, %d 条轨迹)", len(markers), len(trajectories)), "")
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename("kmz")))
+	c.Data(http.StatusOK, "application/vnd.google-earth.kmz", buf.Bytes())
+}
+
+// readImportFile 读取表单中名为 file 的上传文件
+func (app *App) readImportFile(c *gin.Context) ([]byte, string, error) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return nil, "", err
+	}
+	if fileHeader.Size > maxImportSize {
+		return nil, "", apierror.New(apierror.FileTooLarge)
+	}
+	f, err := fileHeader.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxImportSize))
+	if err != nil {
+		return nil, "", err
+	}
+	app.metrics.observeUpload("import", int64(len(data)))
+	return data, fileHeader.Filename, nil
+}
+
+// saveUploadFile 将数据写入上传目录，文件名冲突时追加序号，返回最终文件名
+func (app *App) saveUploadFile(name string, data []byte) (string, error) {
+	name = filepath.Base(name)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s_%d%s", stem, i, ext)
+		}
+		f, err := os.OpenFile(filepath.Join(app.Cfg.Server.UploadDir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", err
+		}
+		return candidate, f.Close()
+	}
+}
+
+func (app *App) removeUploadFiles(filenames []string) {
+	for _, filename := range filenames {
+		os.Remove(filepath.Join(app.Cfg.Server.UploadDir, filename))
+	}
+}
+
+func parseFloatData(p *kml.Placemark, name string) float64 {
+	if v, ok := p.Get(name); ok {
+		f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f
+	}
+	return 0
+}
+
+func (app *App) ImportKML(c *gin.Context) {
+	crs, err := resolveCRS(c, "", geo.WGS84)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	data, filename, err := app.readImportFile(c)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var doc *kml.KML
+	var files map[string][]byte
+	if kml.IsKMZ(data) {
+		doc, files, err = kml.ReadKMZ(data, maxImportSize)
+	} else {
+		doc, err = kml.Decode(bytes.NewReader(data))
+	}
+	if errors.Is(err, kml.ErrKMZTooLarge) {
+		err = apierror.New(apierror.FileTooLarge)
+	}
+	if err != nil {
+		app.log(c).Info("解析导入文件失败", zap.Error(err), zap.String("filename", filename))
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	lineColors := make(map[string]string)
+	for _, s := range doc.Document.Styles {
+		if s.LineStyle == nil {
+			continue
+		}
+		// 无法识别的颜色使用默认颜色
+		if color := kml.HexColor(s.LineStyle.Color); hexColorPattern.MatchString(color) {
+			lineColors["#"+s.ID] = color
+		}
+	}
+
+	tx, err := app.DB.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		app.internalError(c, "开始事务失败", zap.Error(err))
+		return
+	}
+	defer tx.Rollback()
+	db := app.tx(c, tx)
+
+	var savedFiles []string
+	// 标记点和轨迹按 JSON 接口的规则校验，row 为标记点（或轨迹）在文件中的序号（从 1 开始），
+	// 轨迹的字段以 trajectory. 开头
+	var invalid []rowError
+	fail := func(status int, err error) {
+		app.removeUploadFiles(savedFiles)
+		switch {
+		case status >= http.StatusInternalServerError:
+			app.internalError(c, "导入KML失败", zap.Error(err), zap.String("filename", filename))
+		case len(invalid) > 0:
+			app.respondError(c, status, err, gin.H{"errors": localizeRowErrors(invalid, requestLang(c))})
+		default:
+			app.respondError(c, status, err)
+		}
+	}
+
+	var markerCount, trajectoryCount, pointNum, lineNum int
+	for _, pm := range doc.Document.AllPlacemarks() {
+		pm := pm
+		var points []kml.Point
+		var lines []kml.LineString
+		if pm.Point != nil {
+			points = append(points, *pm.Point)
+		}
+		if pm.LineString != nil {
+			lines = append(lines, *pm.LineString)
+		}
+		if pm.MultiGeometry != nil {
+			points = append(points, pm.MultiGeometry.Points...)
+			lines = append(lines, pm.MultiGeometry.LineStrings...)
+		}
+
+		description, ok := pm.Get("description")
+		if !ok {
+			description = kml.PlainText(pm.Description)
+		}
+
+		for _, pt := range points {
+			coords, err := kml.ParseCoordinates(pt.Coordinates)
+			if err != nil || len(coords) == 0 {
+				fail(http.StatusBadRequest, apierror.New(apierror.InvalidPlacemark, pm.Name))
+				return
+			}
+			marker := Marker{
+				Latitude:      coords[0].Latitude,
+				Longitude:     coords[0].Longitude,
+				Value:         parseFloatData(&pm, "value"),
+				RequiredValue: parseFloatData(&pm, "required_value"),
+				Description:   description,
+				CRS:           string(crs),
+			}
+			marker.SufficientColor, _ = pm.Get("sufficient_color")
+			marker.InsufficientColor, _ = pm.Get("insufficient_color")
+			pointNum++
+			if errs := validateImportedMarker(&marker); len(errs) > 0 {
+				for _, e := range errs {
+					e.Row = pointNum
+					invalid = append(invalid, e)
+				}
+				continue
+			}
+			if err := insertMarker(db, &marker); err != nil {
+				fail(http.StatusInternalServerError, err)
+				return
+			}
+			markerCount++
+
+			// 只导入 KMZ 包内的图片，外部链接不做下载。与上传接口相同检查大小、类型和数量
+			var images int
+			for _, src := range kml.ImageSources(pm.Description) {
+				content, ok := files[strings.TrimPrefix(path.Clean(src), "/")]
+				if !ok {
+					continue
+				}
+				mimeType, checkErr := checkImage(content, int64(len(content)))
+				if checkErr == nil && images == maxImagesPerMarker {
+					checkErr = apierror.New(apierror.TooManyImages, maxImagesPerMarker, 0)
+				}
+				if checkErr != nil {
+					e := newRowError("images", checkErr)
+					e.Row = pointNum
+					invalid = append(invalid, e)
+					break
+				}
+				images++
+				if len(invalid) > 0 {
+					// 导入已注定失败，只继续校验
+					continue
+				}
+				saved, err := app.saveUploadFile(path.Base(src), content)
+				if err != nil {
+					fail(http.StatusInternalServerError, err)
+					return
+				}
+				savedFiles = append(savedFiles, saved)
+				if _, err := db.Exec("INSERT INTO images (marker_id, filename, file_size, mime_type) VALUES (?, ?, ?, ?)",
+					marker.ID, saved, len(content), mimeType); err != nil {
+					fail(http.StatusInternalServerError, err)
+					return
+				}
+			}
+		}
+
+		for _, line := range lines {
+			coords, err := kml.ParseCoordinates(line.Coordinates)
+			if err != nil || len(coords) < 2 {
+				fail(http.StatusBadRequest, apierror.New(apierror.InvalidTrajectory, pm.Name))
+				return
+			}
+			t := Trajectory{Name: pm.Name, Description: description, Color: lineColors[pm.StyleURL], CRS: string(crs)}
+			for _, co := range coords {
+				t.Points = append(t.Points, LatLng{Latitude: co.Latitude, Longitude: co.Longitude})
+			}
+			lineNum++
+			if errs := validateImportedTrajectory(&t); len(errs) > 0 {
+				for _, e := range errs {
+					e.Row, e.Field = lineNum, "trajectory."+e.Field
+					invalid = append(invalid, e)
+				}
+				continue
+			}
+			if err := insertTrajectory(db, &t); err != nil {
+				fail(http.StatusInternalServerError, err)
+				return
+			}
+			trajectoryCount++
+		}
+	}
+
+	if len(invalid) > 0 {
+		fail(http.StatusUnprocessableEntity, apierror.New(apierror.ImportFailed))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	app.tiles.invalidateAll()
+
+	app.recordUserAction(c, "import_kml",
+		fmt.Sprintf("从 %s 导入 %d 个标记点, %d 条轨迹, %d 张图片", filename, markerCount, trajectoryCount, len(savedFiles)),
+		"")
+
+	app.log(c).Info("导入KML",
+		zap.String("filename", filename),
+		zap.Int("markers", markerCount),
+		zap.Int("trajectories", trajectoryCount),
+		zap.Int("images", len(savedFiles)))
+
+	c.JSON(http.StatusOK, gin.H{
+		"markers":      markerCount,
+		"trajectories": trajectoryCount,
+		"images":       savedFiles,
+	})
+}
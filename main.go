@@ -3,43 +3,101 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/backup"
 	"mapproject/pkg/config"
+	"mapproject/pkg/geo"
 	"mapproject/pkg/logger"
+	"mapproject/pkg/useragent"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type Marker struct {
 	ID                int      `json:"id"`
-	Latitude          float64  `json:"latitude"`
-	Longitude         float64  `json:"longitude"`
-	Value             float64  `json:"value"`
-	RequiredValue     float64  `json:"required_value"`
-	Description       string   `json:"description"`
-	SufficientColor   string   `json:"sufficient_color"`
-	InsufficientColor string   `json:"insufficient_color"`
+	Latitude          float64  `json:"latitude" binding:"min=-90,max=90"`
+	Longitude         float64  `json:"longitude" binding:"min=-180,max=180"`
+	Value             float64  `json:"value" binding:"min=0,max=1000000000"`
+	RequiredValue     float64  `json:"required_value" binding:"min=0,max=1000000000"`
+	Description       string   `json:"description" binding:"max=500"`
+	ExternalKey       string   `json:"external_key,omitempty" binding:"max=100"`
+	CRS               string   `json:"crs,omitempty"`
+	CreatedAt         string   `json:"created_at,omitempty"`
+	UpdatedAt         string   `json:"updated_at,omitempty"`
+	Version           int      `json:"version,omitempty"`
+	Distance          *float64 `json:"distance,omitempty"`
+	SufficientColor   string   `json:"sufficient_color" binding:"omitempty,color"`
+	InsufficientColor string   `json:"insufficient_color" binding:"omitempty,color"`
 	Images            []string `json:"images"`
+
+	// 以下字段只在查询单个标记点时返回
+	SourceCRS    string      `json:"source_crs,omitempty"`
+	ImageDetails []ImageInfo `json:"image_details,omitempty"`
+}
+
+// 标记点的默认颜色
+const (
+	defaultSufficientColor   = "#409EFF"
+	defaultInsufficientColor = "#F56C6C"
+)
+
+// ImageInfo 图片的元数据
+type ImageInfo struct {
+	Filename  string `json:"filename"`
+	Caption   string `json:"caption"`
+	FileSize  int64  `json:"file_size"`
+	MimeType  string `json:"mime_type"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Sufficient 当前值是否已达到需求值
+func (m *Marker) Sufficient() bool {
+	return m.Value >= m.RequiredValue
 }
 
 type App struct {
 	DB     *sql.DB
 	Cfg    *config.Config
 	Logger *zap.Logger
+
+	clusters clusterCache
+	tiles    tileCache
+	amap     amapCache
+	metrics  *appMetrics
+	visits   *visitRecorder
+	privacy  *ipAnonymizer
+	dbWrite  dbWriteCheck
 }
 
+// dbLocks 进程持有的数据库共享锁，保留引用避免锁文件被回收关闭
+var dbLocks []*os.File
+
 func initDB(dbPath string) *sql.DB {
+	// 进程退出前一直持有共享锁，恢复备份时据此拒绝替换正在使用的数据库
+	lock, err := backup.LockShared(dbPath)
+	if err != nil {
+		logger.Log.Fatal("锁定数据库失败", zap.Error(err), zap.String("path", dbPath))
+	}
+	dbLocks = append(dbLocks, lock)
+
 	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
 	if err != nil {
 		logger.Log.Fatal("数据库连接失败", zap.Error(err), zap.String("path", dbPath))
@@ -54,6 +112,10 @@ func initDB(dbPath string) *sql.DB {
 	// 运行迁移
 	migrateDatabase(db)
 
+	if err := initSearchIndex(db); err != nil {
+		logger.Log.Warn("全文索引不可用，搜索功能已禁用", zap.Error(err))
+	}
+
 	return db
 }
 
@@ -68,6 +130,9 @@ func createTables(db *sql.DB) {
 		description TEXT DEFAULT '',
 		sufficient_color TEXT DEFAULT '#409EFF',
 		insufficient_color TEXT DEFAULT '#F56C6C',
+		external_key TEXT,
+		source_crs TEXT DEFAULT 'gcj02',
+		version INTEGER NOT NULL DEFAULT 1,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
@@ -77,9 +142,20 @@ func createTables(db *sql.DB) {
 		filename TEXT NOT NULL,
 		file_size INTEGER DEFAULT 0,
 		mime_type TEXT DEFAULT '',
+		caption TEXT DEFAULT '',
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY(marker_id) REFERENCES markers(id) ON DELETE CASCADE
 	);
+	CREATE TABLE IF NOT EXISTS trajectories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT DEFAULT '',
+		description TEXT DEFAULT '',
+		color TEXT DEFAULT '#409EFF',
+		coordinates TEXT NOT NULL DEFAULT '[]',
+		source_crs TEXT DEFAULT 'gcj02',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
 	CREATE TABLE IF NOT EXISTS visits (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		ip TEXT,
@@ -98,15 +174,74 @@ func createTables(db *sql.DB) {
 		action_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
+	-- 数据版本号，由触发器在数据变化时递增，用于缓存失效
+	CREATE TABLE IF NOT EXISTS data_versions (
+		name TEXT PRIMARY KEY,
+		version INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT OR IGNORE INTO data_versions (name) VALUES ('markers');
+
+	-- 幂等请求记录，status 为 0 表示原请求仍在处理中
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL DEFAULT '',
+		etag TEXT NOT NULL DEFAULT '',
+		body BLOB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- 超过保留期的访问数据按 UTC 日期汇总后的统计
+	CREATE TABLE IF NOT EXISTS visit_daily_stats (
+		day TEXT NOT NULL,
+		is_bot INTEGER NOT NULL,
+		page_views INTEGER NOT NULL,
+		unique_visitors INTEGER NOT NULL,
+		sessions INTEGER NOT NULL,
+		PRIMARY KEY (day, is_bot)
+	);
+	CREATE TABLE IF NOT EXISTS path_daily_stats (
+		day TEXT NOT NULL,
+		path TEXT NOT NULL,
+		is_bot INTEGER NOT NULL,
+		page_views INTEGER NOT NULL,
+		unique_visitors INTEGER NOT NULL,
+		PRIMARY KEY (day, path, is_bot)
+	);
+	CREATE TABLE IF NOT EXISTS action_daily_stats (
+		day TEXT NOT NULL,
+		action_type TEXT NOT NULL,
+		is_bot INTEGER NOT NULL,
+		actions INTEGER NOT NULL,
+		unique_visitors INTEGER NOT NULL,
+		PRIMARY KEY (day, action_type, is_bot)
+	);
+
+	-- IP 哈希使用的盐，period 为盐周期编号
+	CREATE TABLE IF NOT EXISTS ip_hash_salts (
+		period INTEGER PRIMARY KEY,
+		salt TEXT NOT NULL
+	);
+
+	-- 标记点空间索引，由触发器与 markers 保持同步
+	CREATE VIRTUAL TABLE IF NOT EXISTS markers_rtree USING rtree(
+		id,
+		min_lng, max_lng,
+		min_lat, max_lat
+	);
+
 	-- 创建索引
 	CREATE INDEX IF NOT EXISTS idx_markers_location ON markers(latitude, longitude);
 	CREATE INDEX IF NOT EXISTS idx_markers_created_at ON markers(created_at);
 	CREATE INDEX IF NOT EXISTS idx_images_marker_id ON images(marker_id);
+	CREATE INDEX IF NOT EXISTS idx_trajectories_created_at ON trajectories(created_at);
 	CREATE INDEX IF NOT EXISTS idx_visits_ip ON visits(ip);
 	CREATE INDEX IF NOT EXISTS idx_visits_visit_time ON visits(visit_time);
 	CREATE INDEX IF NOT EXISTS idx_user_actions_ip ON user_actions(ip);
 	CREATE INDEX IF NOT EXISTS idx_user_actions_action_time ON user_actions(action_time);
 	CREATE INDEX IF NOT EXISTS idx_user_actions_action_type ON user_actions(action_type);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
 
 	-- 创建触发器
 	CREATE TRIGGER IF NOT EXISTS update_markers_updated_at
@@ -116,6 +251,60 @@ func createTables(db *sql.DB) {
 		    UPDATE markers SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
 		END;
 
+	CREATE TRIGGER IF NOT EXISTS markers_rtree_insert
+		AFTER INSERT ON markers
+		FOR EACH ROW
+		BEGIN
+		    INSERT OR REPLACE INTO markers_rtree (id, min_lng, max_lng, min_lat, max_lat)
+		    VALUES (NEW.id, NEW.longitude, NEW.longitude, NEW.latitude, NEW.latitude);
+		END;
+
+	CREATE TRIGGER IF NOT EXISTS markers_rtree_update
+		AFTER UPDATE OF latitude, longitude ON markers
+		FOR EACH ROW
+		BEGIN
+		    UPDATE markers_rtree
+		    SET min_lng = NEW.longitude, max_lng = NEW.longitude, min_lat = NEW.latitude, max_lat = NEW.latitude
+		    WHERE id = NEW.id;
+		END;
+
+	CREATE TRIGGER IF NOT EXISTS markers_rtree_delete
+		AFTER DELETE ON markers
+		FOR EACH ROW
+		BEGIN
+		    DELETE FROM markers_rtree WHERE id = OLD.id;
+		END;
+
+	CREATE TRIGGER IF NOT EXISTS markers_version_insert
+		AFTER INSERT ON markers
+		BEGIN
+		    UPDATE data_versions SET version = version + 1 WHERE name = 'markers';
+		END;
+
+	CREATE TRIGGER IF NOT EXISTS markers_version_update
+		AFTER UPDATE ON markers
+		BEGIN
+		    UPDATE data_versions SET version = version + 1 WHERE name = 'markers';
+		END;
+
+	CREATE TRIGGER IF NOT EXISTS markers_version_delete
+		AFTER DELETE ON markers
+		BEGIN
+		    UPDATE data_versions SET version = version + 1 WHERE name = 'markers';
+		END;
+
+	CREATE TRIGGER IF NOT EXISTS images_version_insert
+		AFTER INSERT ON images
+		BEGIN
+		    UPDATE data_versions SET version = version + 1 WHERE name = 'markers';
+		END;
+
+	CREATE TRIGGER IF NOT EXISTS images_version_delete
+		AFTER DELETE ON images
+		BEGIN
+		    UPDATE data_versions SET version = version + 1 WHERE name = 'markers';
+		END;
+
 	-- 创建视图
 	CREATE VIEW IF NOT EXISTS marker_summary AS
 	SELECT
@@ -220,224 +409,424 @@ func migrateDatabase(db *sql.DB) {
 		}
 		logger.Log.Info("成功添加 insufficient_color 列到 markers 表")
 	}
+
+	// external_key 用于表格导入时按外部编号更新
+	if err := addColumnIfMissing(db, "markers", "external_key", "TEXT"); err != nil {
+		logger.Log.Error("添加 external_key 列失败", zap.Error(err))
+		return
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_markers_external_key ON markers(external_key)`); err != nil {
+		logger.Log.Error("创建 external_key 索引失败", zap.Error(err))
+		return
+	}
+
+	// source_crs 记录坐标提交时使用的坐标系，库中坐标统一存为 GCJ-02
+	for _, table := range []string{"markers", "trajectories"} {
+		if err := addColumnIfMissing(db, table, "source_crs", "TEXT DEFAULT 'gcj02'"); err != nil {
+			logger.Log.Error("添加 source_crs 列失败", zap.Error(err), zap.String("table", table))
+			return
+		}
+	}
+
+	// version 用于乐观并发控制，每次更新递增
+	if err := addColumnIfMissing(db, "markers", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		logger.Log.Error("添加 version 列失败", zap.Error(err))
+		return
+	}
+
+	if err := addColumnIfMissing(db, "images", "caption", "TEXT DEFAULT ''"); err != nil {
+		logger.Log.Error("添加 caption 列失败", zap.Error(err))
+		return
+	}
+
+	// session_id 为访问所属的会话，is_bot 标记爬虫和程序的访问，新增列时按 User-Agent 识别已有记录
+	if err := addColumnIfMissing(db, "visits", "session_id", "TEXT"); err != nil {
+		logger.Log.Error("添加 session_id 列失败", zap.Error(err))
+		return
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_visits_session_id ON visits(session_id)`); err != nil {
+		logger.Log.Error("创建 session_id 索引失败", zap.Error(err))
+		return
+	}
+	for _, table := range []string{"visits", "user_actions"} {
+		exists, err := columnExists(db, table, "is_bot")
+		if err == nil && !exists {
+			err = addColumnIfMissing(db, table, "is_bot", "INTEGER NOT NULL DEFAULT 0")
+			if err == nil {
+				err = markBotUserAgents(db, table)
+			}
+		}
+		if err != nil {
+			logger.Log.Error("添加 is_bot 列失败", zap.Error(err), zap.String("table", table))
+			return
+		}
+	}
+
+	// 补齐空间索引中缺失的标记点（R*Tree 创建前已存在的数据）
+	if _, err := db.Exec(`
+		INSERT INTO markers_rtree (id, min_lng, max_lng, min_lat, max_lat)
+		SELECT id, longitude, longitude, latitude, latitude FROM markers
+		WHERE id NOT IN (SELECT id FROM markers_rtree)
+	`); err != nil {
+		logger.Log.Error("同步空间索引失败", zap.Error(err))
+		return
+	}
+}
+
+// columnExists 判断表中是否有该列
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&exists)
+	return exists, err
+}
+
+// addColumnIfMissing 在列不存在时为表添加列
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	exists, err := columnExists(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return err
+	}
+	logger.Log.Info("成功添加列", zap.String("table", table), zap.String("column", column))
+	return nil
 }
 
-func errorHandler() gin.HandlerFunc {
+// markBotUserAgents 按 User-Agent 把表中爬虫和程序的记录标记为 is_bot
+func markBotUserAgents(db *sql.DB, table string) error {
+	rows, err := db.Query(fmt.Sprintf("SELECT DISTINCT COALESCE(user_agent, '') FROM %s", table))
+	if err != nil {
+		return err
+	}
+	var bots []string
+	for rows.Next() {
+		var ua string
+		if err := rows.Scan(&ua); err != nil {
+			rows.Close()
+			return err
+		}
+		if useragent.IsBot(ua) {
+			bots = append(bots, ua)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, ua := range bots {
+		if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET is_bot = 1 WHERE COALESCE(user_agent, '') = ?", table), ua); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) errorHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Next()
-		if len(c.Errors) > 0 {
-			err := c.Errors.Last()
-			logger.Log.Error("请求处理失败", zap.Error(err), zap.String("request_id", c.GetString("request_id")))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if len(c.Errors) > 0 && !c.Writer.Written() {
+			app.internalError(c, "请求处理失败", zap.Error(c.Errors.Last()))
 		}
 	}
 }
 
+// insertMarker 插入标记点并回填 ID，未提供颜色时使用默认颜色。
+// 坐标按 marker.CRS 解释，入库前转换为存储坐标系，marker 本身的坐标保持不变
+func insertMarker(db execer, marker *Marker) error {
+	if marker.SufficientColor == "" {
+		marker.SufficientColor = defaultSufficientColor
+	}
+	if marker.InsufficientColor == "" {
+		marker.InsufficientColor = defaultInsufficientColor
+	}
+
+	crs := crsOrStorage(marker.CRS)
+	lat, lng := convertLatLng(marker.Latitude, marker.Longitude, crs, storageCRS)
+	result, err := db.Exec("INSERT INTO markers (latitude, longitude, value, required_value, description, sufficient_color, insufficient_color, external_key, source_crs) VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)",
+		lat, lng, marker.Value, marker.RequiredValue, marker.Description, marker.SufficientColor, marker.InsufficientColor, marker.ExternalKey, crs)
+	if err != nil {
+		return err
+	}
+
+	id, _ := result.LastInsertId()
+	marker.ID = int(id)
+	marker.CRS = string(crs)
+	marker.Version = 1
+	return nil
+}
+
 func (app *App) CreateMarker(c *gin.Context) {
 	var marker Marker
-	if err := c.ShouldBindJSON(&marker); err != nil {
-		app.Logger.Error("解析请求数据失败", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !app.bindJSON(c, &marker) {
 		return
 	}
 
-	// 设置默认颜色（如果未提供）
-	if marker.SufficientColor == "" {
-		marker.SufficientColor = "#409EFF"
-	}
-	if marker.InsufficientColor == "" {
-		marker.InsufficientColor = "#F56C6C"
+	crs, err := resolveCRS(c, marker.CRS, storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
 	}
+	marker.CRS = string(crs)
 
-	result, err := app.DB.Exec("INSERT INTO markers (latitude, longitude, value, required_value, description, sufficient_color, insufficient_color) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		marker.Latitude, marker.Longitude, marker.Value, marker.RequiredValue, marker.Description, marker.SufficientColor, marker.InsufficientColor)
-	if err != nil {
-		app.Logger.Error("插入标记点失败",
+	if err := insertMarker(app.db(c), &marker); err != nil {
+		app.internalError(c, "插入标记点失败",
 			zap.Error(err),
 			zap.Float64("latitude", marker.Latitude),
 			zap.Float64("longitude", marker.Longitude))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	id, _ := result.LastInsertId()
-	marker.ID = int(id)
+	app.tiles.invalidatePoints(geo.Convert(geo.Point{Lat: marker.Latitude, Lng: marker.Longitude}, crs, storageCRS))
 
 	// 记录创建标记点的操作
 	app.recordUserAction(c, "create_marker",
 		fmt.Sprintf("创建标记点 (%.6f, %.6f)", marker.Latitude, marker.Longitude),
 		fmt.Sprintf("%d", marker.ID))
 
-	app.Logger.Info("新增标记点",
+	app.log(c).Info("新增标记点",
 		zap.Int("id", marker.ID),
 		zap.Float64("latitude", marker.Latitude),
 		zap.Float64("longitude", marker.Longitude))
 
-	c.JSON(http.StatusOK, marker)
+	respondMarker(c, http.StatusOK, &marker)
 }
 
 func (app *App) UpdateMarker(c *gin.Context) {
 	id := c.Param("id")
 	var marker Marker
-	if err := c.ShouldBindJSON(&marker); err != nil {
-		app.Logger.Error("解析请求数据失败", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !app.bindJSON(c, &marker) {
 		return
 	}
 
 	// 设置默认颜色（如果未提供）
 	if marker.SufficientColor == "" {
-		marker.SufficientColor = "#409EFF"
+		marker.SufficientColor = defaultSufficientColor
 	}
 	if marker.InsufficientColor == "" {
-		marker.InsufficientColor = "#F56C6C"
+		marker.InsufficientColor = defaultInsufficientColor
 	}
 
-	result, err := app.DB.Exec("UPDATE markers SET latitude = ?, longitude = ?, value = ?, required_value = ?, description = ?, sufficient_color = ?, insufficient_color = ? WHERE id = ?",
-		marker.Latitude, marker.Longitude, marker.Value, marker.RequiredValue, marker.Description, marker.SufficientColor, marker.InsufficientColor, id)
+	crs, err := resolveCRS(c, marker.CRS, storageCRS)
 	if err != nil {
-		app.Logger.Error("更新标记点失败",
-			zap.Error(err),
-			zap.String("id", id),
-			zap.Float64("latitude", marker.Latitude),
-			zap.Float64("longitude", marker.Longitude))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		app.respondError(c, http.StatusBadRequest, err)
 		return
 	}
+	marker.CRS = string(crs)
+	lat, lng := convertLatLng(marker.Latitude, marker.Longitude, crs, storageCRS)
 
-	rowsAffected, err := result.RowsAffected()
+	expected, ok := app.expectedVersion(c, marker.Version)
+	if !ok {
+		return
+	}
+
+	// 旧位置用于清除瓦片缓存
+	var old geo.Point
+	err = app.db(c).QueryRow("SELECT latitude, longitude FROM markers WHERE id = ?", id).Scan(&old.Lat, &old.Lng)
+	if err == sql.ErrNoRows {
+		app.respondError(c, http.StatusNotFound, errMarkerNotFound)
+		return
+	}
 	if err != nil {
-		app.Logger.Error("获取更新结果失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		app.internalError(c, "查询标记点失败", zap.Error(err), zap.String("id", id))
 		return
 	}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "标记点不存在"})
+	// 按版本号条件更新，未命中说明标记点已被修改或删除
+	cond, condArgs := versionCondition(expected)
+	args := append([]interface{}{lat, lng, marker.Value, marker.RequiredValue, marker.Description,
+		marker.SufficientColor, marker.InsufficientColor, crs, id}, condArgs...)
+	err = app.db(c).QueryRow("UPDATE markers SET latitude = ?, longitude = ?, value = ?, required_value = ?, description = ?, sufficient_color = ?, insufficient_color = ?, source_crs = ?, version = version + 1 WHERE id = ? AND "+cond+" RETURNING version",
+		args...).Scan(&marker.Version)
+	if err == sql.ErrNoRows {
+		app.respondVersionConflict(c, id, crs)
+		return
+	}
+	if err != nil {
+		app.internalError(c, "更新标记点失败",
+			zap.Error(err),
+			zap.String("id", id),
+			zap.Float64("latitude", marker.Latitude),
+			zap.Float64("longitude", marker.Longitude))
 		return
 	}
+	app.tiles.invalidatePoints(old, geo.Point{Lat: lat, Lng: lng})
+	marker.ID, _ = strconv.Atoi(id)
 
 	// 记录更新标记点的操作
 	app.recordUserAction(c, "update_marker",
 		fmt.Sprintf("更新标记点 #%s (%.6f, %.6f)", id, marker.Latitude, marker.Longitude),
 		id)
 
-	app.Logger.Info("更新标记点",
+	app.log(c).Info("更新标记点",
 		zap.String("id", id),
 		zap.Float64("latitude", marker.Latitude),
 		zap.Float64("longitude", marker.Longitude))
 
-	c.JSON(http.StatusOK, marker)
+	respondMarker(c, http.StatusOK, &marker)
 }
 
-func (app *App) DeleteMarker(c *gin.Context) {
-	id := c.Param("id")
-
-	// 获取标记点信息用于记录
-	var lat, lng float64
-	err := app.DB.QueryRow("SELECT latitude, longitude FROM markers WHERE id = ?", id).Scan(&lat, &lng)
-	if err != nil && err != sql.ErrNoRows {
-		app.Logger.Error("查询标记点失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// deleteMarker 在事务中按版本号条件删除标记点及其图片记录，返回原位置（存储坐标系）和图片文件名，
+// 文件需在事务提交后删除。未命中时返回 errMarkerNotFound 或 errVersionConflict
+func deleteMarker(tx queryExecer, id string, expected int) (geo.Point, []string, error) {
+	var pos geo.Point
+	cond, condArgs := versionCondition(expected)
+	err := tx.QueryRow("DELETE FROM markers WHERE id = ? AND "+cond+" RETURNING latitude, longitude",
+		append([]interface{}{id}, condArgs...)...).Scan(&pos.Lat, &pos.Lng)
+	if err == sql.ErrNoRows {
+		return pos, nil, missingMarkerError(tx, id)
 	}
-
-	tx, err := app.DB.Begin()
 	if err != nil {
-		app.Logger.Error("开始事务失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return pos, nil, err
 	}
-	defer tx.Rollback()
 
 	rows, err := tx.Query("SELECT filename FROM images WHERE marker_id = ?", id)
 	if err != nil {
-		app.Logger.Error("查询图片失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return pos, nil, err
 	}
 	defer rows.Close()
 
+	var filenames []string
 	for rows.Next() {
 		var filename string
 		if err := rows.Scan(&filename); err != nil {
-			app.Logger.Error("扫描图片数据失败", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return pos, nil, err
 		}
-		os.Remove(filepath.Join(app.Cfg.Server.UploadDir, filepath.Base(filename)))
+		filenames = append(filenames, filename)
 	}
+	if err := rows.Err(); err != nil {
+		return pos, nil, err
+	}
+	rows.Close()
 
 	if _, err := tx.Exec("DELETE FROM images WHERE marker_id = ?", id); err != nil {
-		app.Logger.Error("删除图片记录失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return pos, nil, err
+	}
+	return pos, filenames, nil
+}
+
+func (app *App) DeleteMarker(c *gin.Context) {
+	id := c.Param("id")
+	expected, ok := app.expectedVersion(c, 0)
+	if !ok {
+		return
+	}
+
+	tx, err := app.DB.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		app.internalError(c, "开始事务失败", zap.Error(err))
 		return
 	}
+	defer tx.Rollback()
+	db := app.tx(c, tx)
 
-	if _, err := tx.Exec("DELETE FROM markers WHERE id = ?", id); err != nil {
-		app.Logger.Error("删除标记点失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// 先按版本号条件删除标记点，未命中说明已被修改或删除
+	pos, filenames, err := deleteMarker(db, id, expected)
+	switch {
+	case errors.Is(err, errMarkerNotFound):
+		app.respondError(c, http.StatusNotFound, err)
+		return
+	case errors.Is(err, errVersionConflict):
+		tx.Rollback()
+		app.respondVersionConflict(c, id, storageCRS)
+		return
+	case err != nil:
+		app.internalError(c, "删除标记点失败", zap.Error(err), zap.String("id", id))
 		return
 	}
 
 	if err := tx.Commit(); err != nil {
-		app.Logger.Error("提交事务失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		app.internalError(c, "提交事务失败", zap.Error(err))
 		return
 	}
+	app.removeUploadFiles(filenames)
+	app.tiles.invalidatePoints(pos)
 
 	// 记录删除标记点的操作
 	app.recordUserAction(c, "delete_marker",
-		fmt.Sprintf("删除标记点 #%s (%.6f, %.6f)", id, lat, lng),
+		fmt.Sprintf("删除标记点 #%s (%.6f, %.6f)", id, pos.Lat, pos.Lng),
 		id)
 
 	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
 }
 
+// readFileHead 读取上传文件开头用于判断类型的内容
+func readFileHead(file *multipart.FileHeader) ([]byte, error) {
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
 func (app *App) UploadImages(c *gin.Context) {
 	markerID := c.Param("id")
+	_, span := tracer.Start(c.Request.Context(), "parse multipart form")
 	form, err := c.MultipartForm()
+	endSpan(span, err)
 	if err != nil {
-		app.Logger.Error("解析表单数据失败", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		app.respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	files := form.File["images"]
-	var filenames []string
-	maxSize := int64(5 << 20) // 5MB
-	allowedTypes := map[string]bool{
-		"image/jpeg": true,
-		"image/png":  true,
+	caption := strings.TrimSpace(c.PostForm("caption"))
+	if len(files) == 0 {
+		app.respondError(c, http.StatusUnprocessableEntity, newFieldError("images", "required", apierror.New(apierror.FieldRequired, "images")))
+		return
+	}
+	if err := validateCaption(caption); err != nil {
+		app.respondError(c, http.StatusUnprocessableEntity, err)
+		return
 	}
 
+	var existing int
+	if err := app.db(c).QueryRow("SELECT COUNT(*) FROM images WHERE marker_id = ?", markerID).Scan(&existing); err != nil {
+		app.internalError(c, "查询图片失败", zap.Error(err), zap.String("marker_id", markerID))
+		return
+	}
+	if existing+len(files) > maxImagesPerMarker {
+		app.respondError(c, http.StatusUnprocessableEntity, newFieldError("images", "too_many",
+			apierror.New(apierror.TooManyImages, maxImagesPerMarker, existing)))
+		return
+	}
+	var filenames []string
 	for _, file := range files {
-		if file.Size > maxSize {
-			app.Logger.Error("文件过大", zap.String("filename", file.Filename))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "文件过大"})
+		head, err := readFileHead(file)
+		if err != nil {
+			app.respondError(c, http.StatusBadRequest, err)
 			return
 		}
-		if !allowedTypes[file.Header.Get("Content-Type")] {
-			app.Logger.Error("不支持的文件类型", zap.String("filename", file.Filename))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "不支持的文件类型"})
+		mimeType, checkErr := checkImage(head, file.Size)
+		if checkErr != nil {
+			app.log(c).Info("图片未通过检查", zap.String("filename", file.Filename), zap.String("code", string(checkErr.Code)))
+			app.respondError(c, http.StatusBadRequest, checkErr)
 			return
 		}
 
 		filename := filepath.Base(file.Filename)
 		savePath := filepath.Join(app.Cfg.Server.UploadDir, filename)
-		if err := c.SaveUploadedFile(file, savePath); err != nil {
-			app.Logger.Error("保存文件失败", zap.Error(err), zap.String("filename", filename))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		_, span := tracer.Start(c.Request.Context(), "save upload file",
+			trace.WithAttributes(attribute.String("file.name", filename), attribute.Int64("file.size", file.Size)))
+		err = c.SaveUploadedFile(file, savePath)
+		endSpan(span, err)
+		if err != nil {
+			app.internalError(c, "保存文件失败", zap.Error(err), zap.String("filename", filename))
 			return
 		}
 
-		_, err = app.DB.Exec("INSERT INTO images (marker_id, filename) VALUES (?, ?)",
-			markerID, filename)
+		_, err = app.db(c).Exec("INSERT INTO images (marker_id, filename, file_size, mime_type, caption) VALUES (?, ?, ?, ?, ?)",
+			markerID, filename, file.Size, mimeType, caption)
 		if err != nil {
-			app.Logger.Error("插入图片记录失败", zap.Error(err), zap.String("filename", filename))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			app.internalError(c, "插入图片记录失败", zap.Error(err), zap.String("filename", filename))
 			return
 		}
+		app.metrics.observeUpload("image", file.Size)
 
 		// 记录上传图片的操作
 		app.recordUserAction(c, "upload_image",
@@ -450,58 +839,91 @@ func (app *App) UploadImages(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"files": filenames})
 }
 
+func (app *App) UpdateImageCaption(c *gin.Context) {
+	markerID := c.Param("id")
+	filename := c.Param("filename")
+
+	var req struct {
+		Caption string `json:"caption"`
+	}
+	if !app.bindJSON(c, &req) {
+		return
+	}
+	req.Caption = strings.TrimSpace(req.Caption)
+	if err := validateCaption(req.Caption); err != nil {
+		app.respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	result, err := app.db(c).Exec("UPDATE images SET caption = ? WHERE marker_id = ? AND filename = ?",
+		req.Caption, markerID, filename)
+	if err != nil {
+		app.internalError(c, "更新图片说明失败",
+			zap.Error(err),
+			zap.String("marker_id", markerID),
+			zap.String("filename", filename))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		app.respondError(c, http.StatusNotFound, apierror.New(apierror.ImageNotFound))
+		return
+	}
+
+	app.recordUserAction(c, "update_image_caption",
+		fmt.Sprintf("修改标记点 #%s 图片 %s 的说明", markerID, filename),
+		markerID)
+
+	c.JSON(http.StatusOK, gin.H{"filename": filename, "caption": req.Caption})
+}
+
 func (app *App) DeleteImage(c *gin.Context) {
 	markerID := c.Param("id")
 	filename := c.Param("filename")
 
 	var count int
-	err := app.DB.QueryRow("SELECT COUNT(*) FROM images WHERE marker_id = ? AND filename = ?",
+	err := app.db(c).QueryRow("SELECT COUNT(*) FROM images WHERE marker_id = ? AND filename = ?",
 		markerID, filename).Scan(&count)
 	if err != nil {
-		app.Logger.Error("验证图片所属关系失败",
+		app.internalError(c, "验证图片所属关系失败",
 			zap.Error(err),
 			zap.String("marker_id", markerID),
 			zap.String("filename", filename))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	if count == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "图片不存在或不属于该标记点"})
+		app.respondError(c, http.StatusNotFound, apierror.New(apierror.ImageNotFound))
 		return
 	}
 
-	tx, err := app.DB.Begin()
+	tx, err := app.DB.BeginTx(c.Request.Context(), nil)
 	if err != nil {
-		app.Logger.Error("开始事务失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		app.internalError(c, "开始事务失败", zap.Error(err))
 		return
 	}
 	defer tx.Rollback()
+	db := app.tx(c, tx)
 
-	if _, err := tx.Exec("DELETE FROM images WHERE marker_id = ? AND filename = ?",
+	if _, err := db.Exec("DELETE FROM images WHERE marker_id = ? AND filename = ?",
 		markerID, filename); err != nil {
-		app.Logger.Error("删除图片记录失败",
+		app.internalError(c, "删除图片记录失败",
 			zap.Error(err),
 			zap.String("marker_id", markerID),
 			zap.String("filename", filename))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	filename = filepath.Base(filename)
 	err = os.Remove(filepath.Join(app.Cfg.Server.UploadDir, filename))
 	if err != nil && !os.IsNotExist(err) {
-		app.Logger.Error("删除图片文件失败",
+		app.internalError(c, "删除图片文件失败",
 			zap.Error(err),
 			zap.String("filename", filename))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	if err := tx.Commit(); err != nil {
-		app.Logger.Error("提交事务失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		app.internalError(c, "提交事务失败", zap.Error(err))
 		return
 	}
 
@@ -510,197 +932,207 @@ func (app *App) DeleteImage(c *gin.Context) {
 		fmt.Sprintf("从标记点 #%s 删除图片 %s", markerID, filename),
 		markerID)
 
-	app.Logger.Info("删除图片成功",
+	app.log(c).Info("删除图片成功",
 		zap.String("marker_id", markerID),
 		zap.String("filename", filename))
 
 	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
 }
 
-func (app *App) GetMarkers(c *gin.Context) {
-	rows, err := app.DB.Query("SELECT id, latitude, longitude, value, required_value, description, sufficient_color, insufficient_color FROM markers")
+// markerColumns 查询标记点时的列，与 scanMarker 的顺序一致
+const markerColumns = `m.id, m.latitude, m.longitude, m.value, m.required_value, m.description,
+	m.sufficient_color, m.insufficient_color, COALESCE(m.external_key, ''),
+	COALESCE(m.created_at, ''), COALESCE(m.updated_at, ''), m.version`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryExecer *sql.DB 和 *sql.Tx 共有的方法，供可在事务内调用的函数使用
+type queryExecer interface {
+	execer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanMarker 按 markerColumns 的顺序扫描一行，extra 接收其后追加的列
+func scanMarker(row rowScanner, m *Marker, extra ...interface{}) error {
+	dest := []interface{}{&m.ID, &m.Latitude, &m.Longitude, &m.Value, &m.RequiredValue, &m.Description,
+		&m.SufficientColor, &m.InsufficientColor, &m.ExternalKey, &m.CreatedAt, &m.UpdatedAt, &m.Version}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	m.CRS = string(storageCRS)
+	return nil
+}
+
+// selectMarkers 按条件查询标记点（表别名为 m），不含图片
+func (app *App) selectMarkers(ctx context.Context, where string, args []interface{}, tail string) ([]Marker, error) {
+	ctx, done := app.startQuery(ctx, "select_markers")
+	defer done()
+	rows, err := app.dbContext(ctx).Query("SELECT "+markerColumns+" FROM markers m "+where+" "+tail, args...)
 	if err != nil {
-		app.Logger.Error("查询标记点失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
-	markers := make(map[int]*Marker)
+	var result []Marker
 	for rows.Next() {
 		var m Marker
-		if err := rows.Scan(&m.ID, &m.Latitude, &m.Longitude, &m.Value, &m.RequiredValue, &m.Description, &m.SufficientColor, &m.InsufficientColor); err != nil {
-			app.Logger.Error("扫描标记点数据失败", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		if err := scanMarker(rows, &m); err != nil {
+			return nil, err
 		}
-		markers[m.ID] = &m
+		result = append(result, m)
 	}
+	return result, rows.Err()
+}
 
-	rows, err = app.DB.Query("SELECT marker_id, filename FROM images")
+// queryMarkers 按条件查询标记点（表别名为 m）并附带图片
+func (app *App) queryMarkers(ctx context.Context, where string, args []interface{}, tail string) ([]Marker, error) {
+	result, err := app.selectMarkers(ctx, where, args, tail)
 	if err != nil {
-		app.Logger.Error("查询图片失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
-	defer rows.Close()
+	if err := app.attachImages(ctx, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
 
-	for rows.Next() {
-		var markerID int
-		var filename string
-		if err := rows.Scan(&markerID, &filename); err != nil {
-			app.Logger.Error("扫描图片数据失败", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+// attachImages 分批查询并填充标记点的图片列表
+func (app *App) attachImages(ctx context.Context, markers []Marker) error {
+	ctx, done := app.startQuery(ctx, "marker_images")
+	defer done()
+	db := app.dbContext(ctx)
+	const batchSize = 500
+	index := make(map[int]int, len(markers))
+	for i := range markers {
+		index[markers[i].ID] = i
+	}
+
+	for start := 0; start < len(markers); start += batchSize {
+		end := start + batchSize
+		if end > len(markers) {
+			end = len(markers)
 		}
-		if m, ok := markers[markerID]; ok {
-			m.Images = append(m.Images, filename)
+		ids := make([]interface{}, 0, end-start)
+		for _, m := range markers[start:end] {
+			ids = append(ids, m.ID)
 		}
-	}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
 
-	var result []Marker
-	for _, m := range markers {
-		result = append(result, *m)
+		rows, err := db.Query("SELECT marker_id, filename FROM images WHERE marker_id IN ("+placeholders+") ORDER BY id", ids...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var markerID int
+			var filename string
+			if err := rows.Scan(&markerID, &filename); err != nil {
+				rows.Close()
+				return err
+			}
+			if i, ok := index[markerID]; ok {
+				markers[i].Images = append(markers[i].Images, filename)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
 	}
-
-	c.JSON(http.StatusOK, result)
+	return nil
 }
 
-func (app *App) recordVisit(c *gin.Context) {
-	ip := c.ClientIP()
-	userAgent := c.Request.UserAgent()
-	path := c.Request.URL.Path
-	referer := c.Request.Referer()
+// dataVersion 返回数据版本号，数据变化时由触发器递增
+func (app *App) dataVersion(ctx context.Context, name string) (int64, error) {
+	ctx, done := app.startQuery(ctx, "data_version")
+	defer done()
+	var version int64
+	err := app.dbContext(ctx).QueryRow("SELECT version FROM data_versions WHERE name = ?", name).Scan(&version)
+	return version, err
+}
 
-	_, err := app.DB.Exec(`
-		INSERT INTO visits (ip, user_agent, path, referer)
-		VALUES (?, ?, ?, ?)
-	`, ip, userAgent, path, referer)
+// loadMarkers 查询所有标记点及其图片
+func (app *App) loadMarkers(ctx context.Context) ([]Marker, error) {
+	return app.queryMarkers(ctx, "", nil, "ORDER BY m.id")
+}
 
+func (app *App) GetMarkers(c *gin.Context) {
+	crs, err := resolveCRS(c, "", storageCRS)
 	if err != nil {
-		app.Logger.Error("记录访问失败",
-			zap.Error(err),
-			zap.String("ip", ip),
-			zap.String("path", path))
+		app.respondError(c, http.StatusBadRequest, err)
+		return
 	}
-}
 
-func (app *App) recordUserAction(c *gin.Context, actionType string, actionDetail string, targetID string) {
-	ip := c.ClientIP()
-	userAgent := c.Request.UserAgent()
+	q, err := parseMarkerQuery(c.Request.URL.Query(), crs)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
 
-	_, err := app.DB.Exec(`
-		INSERT INTO user_actions (ip, user_agent, action_type, action_detail, target_id)
-		VALUES (?, ?, ?, ?, ?)
-	`, ip, userAgent, actionType, actionDetail, targetID)
+	if q.near != nil {
+		markers, total, err := app.nearMarkers(c.Request.Context(), q)
+		if err != nil {
+			app.internalError(c, "查询附近标记点失败", zap.Error(err))
+			return
+		}
+		for i := range markers {
+			markers[i].toCRS(crs)
+		}
+		c.Header("X-Total-Count", strconv.Itoa(total))
+		c.JSON(http.StatusOK, markers)
+		return
+	}
 
+	where, args := q.whereClause(true)
+	markers, err := app.queryMarkers(c.Request.Context(), where, args, q.orderClause())
 	if err != nil {
-		app.Logger.Error("记录用户操作失败",
-			zap.Error(err),
-			zap.String("ip", ip),
-			zap.String("action_type", actionType))
+		app.internalError(c, "查询标记点失败", zap.Error(err))
+		return
 	}
-}
 
-func (app *App) GetVisits(c *gin.Context) {
-	rows, err := app.DB.Query(`
-		SELECT 
-			v.ip,
-			v.user_agent,
-			COUNT(DISTINCT v.id) as visit_count,
-			MAX(v.visit_time) as last_visit,
-			GROUP_CONCAT(DISTINCT v.path) as paths,
-			GROUP_CONCAT(DISTINCT v.referer) as referers,
-			GROUP_CONCAT(
-				json_object(
-					'type', ua.action_type,
-					'detail', ua.action_detail,
-					'target', ua.target_id,
-					'time', ua.action_time
-				)
-			) as actions
-		FROM visits v
-		LEFT JOIN user_actions ua ON v.ip = ua.ip AND v.user_agent = ua.user_agent
-		GROUP BY v.ip, v.user_agent
-		ORDER BY last_visit DESC
-		LIMIT 1000
-	`)
+	var total int
+	countWhere, countArgs := q.whereClause(false)
+	ctx, done := app.startQuery(c.Request.Context(), "count_markers")
+	err = app.dbContext(ctx).QueryRow("SELECT COUNT(*) FROM markers m "+countWhere, countArgs...).Scan(&total)
+	done()
 	if err != nil {
-		app.Logger.Error("查询访问记录失败", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		app.internalError(c, "统计标记点失败", zap.Error(err))
 		return
 	}
-	defer rows.Close()
 
-	var visits []map[string]interface{}
-	for rows.Next() {
-		var ip, userAgent, paths, referers, actionsJson string
-		var visitCount int
-		var lastVisit string
-		if err := rows.Scan(&ip, &userAgent, &visitCount, &lastVisit, &paths, &referers, &actionsJson); err != nil {
-			app.Logger.Error("扫描访问记录失败", zap.Error(err))
-			continue
-		}
-
-		uniquePaths := make(map[string]bool)
-		for _, path := range strings.Split(paths, ",") {
-			if path != "" {
-				uniquePaths[path] = true
-			}
-		}
+	// 保持返回数组以兼容现有页面，总数和下一页游标放在响应头中
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if q.limit > 0 && len(markers) == q.limit {
+		c.Header("X-Next-Cursor", q.cursorAfter(&markers[len(markers)-1]))
+	}
 
-		uniqueReferers := make(map[string]bool)
-		for _, referer := range strings.Split(referers, ",") {
-			if referer != "" {
-				uniqueReferers[referer] = true
-			}
-		}
+	for i := range markers {
+		markers[i].toCRS(crs)
+	}
 
-		pathsList := make([]string, 0, len(uniquePaths))
-		for path := range uniquePaths {
-			pathsList = append(pathsList, path)
-		}
+	c.JSON(http.StatusOK, markers)
+}
 
-		referersList := make([]string, 0, len(uniqueReferers))
-		for referer := range uniqueReferers {
-			referersList = append(referersList, referer)
-		}
+func (app *App) recordUserAction(c *gin.Context, actionType string, actionDetail string, targetID string) {
+	ctx, done := app.startQuery(c.Request.Context(), "record_action")
+	defer done()
+	ip := app.privacy.anonymize(ctx, c.ClientIP(), time.Now())
+	userAgent := c.Request.UserAgent()
 
-		// 解析操作记录
-		var actions []map[string]interface{}
-		if actionsJson != "" && actionsJson != "null" {
-			actionStrings := strings.Split(actionsJson, "},{")
-			for _, actionStr := range actionStrings {
-				actionMap := make(map[string]interface{})
-				// 简单解析 JSON 对象字符串
-				actionStr = strings.Trim(actionStr, "[]}{")
-				pairs := strings.Split(actionStr, ",")
-				for _, pair := range pairs {
-					kv := strings.Split(pair, ":")
-					if len(kv) == 2 {
-						key := strings.Trim(kv[0], "\" ")
-						value := strings.Trim(kv[1], "\" ")
-						actionMap[key] = value
-					}
-				}
-				if len(actionMap) > 0 {
-					actions = append(actions, actionMap)
-				}
-			}
-		}
+	_, err := app.dbContext(ctx).Exec(`
+		INSERT INTO user_actions (ip, user_agent, action_type, action_detail, target_id, is_bot)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ip, userAgent, actionType, actionDetail, targetID, useragent.IsBot(userAgent))
 
-		visits = append(visits, map[string]interface{}{
-			"ip":         ip,
-			"userAgent":  userAgent,
-			"visitCount": visitCount,
-			"lastVisit":  lastVisit,
-			"paths":      pathsList,
-			"referers":   referersList,
-			"actions":    actions,
-		})
+	if err != nil {
+		app.log(c).Error("记录用户操作失败",
+			zap.Error(err),
+			zap.String("ip", ip),
+			zap.String("action_type", actionType))
 	}
-
-	c.JSON(http.StatusOK, visits)
 }
 
 func main() {
@@ -709,7 +1141,8 @@ func main() {
 		log.Fatalf("加载配置失败: %v", err)
 	}
 
-	if err := logger.InitLogger(cfg.Logging.File, cfg.Logging.Level); err != nil {
+	// 访问日志含有访客 IP，旧日志的保留时间不超过 privacy.retention_days
+	if err := logger.InitLogger(cfg.Logging.File, cfg.Logging.Level, cfg.Privacy.RetentionDays); err != nil {
 		log.Fatalf("初始化日志失败: %v", err)
 	}
 
@@ -717,9 +1150,19 @@ func main() {
 		log.Fatalf("配置不完整: UploadDir 或 Port 缺失")
 	}
 
+	// 命令行子命令，如 backup、restore
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+
 	db := initDB(cfg.Database.Path)
 	defer db.Close()
 
+	shutdownTracing, err := initTracing(context.Background(), cfg)
+	if err != nil {
+		logger.Log.Fatal("初始化链路追踪失败", zap.Error(err))
+	}
+
 	if err := os.MkdirAll(cfg.Server.UploadDir, 0755); err != nil {
 		logger.Log.Fatal("创建上传目录失败",
 			zap.Error(err),
@@ -727,75 +1170,96 @@ func main() {
 	}
 
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-	r.Use(errorHandler())
-
+	r := gin.New()
+	// 默认不信任任何代理，客户端地址取直连地址；部署在反向代理之后时配置代理地址以使用 X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.Security.TrustedProxies); err != nil {
+		logger.Log.Fatal("security.trusted_proxies 配置无效", zap.Error(err))
+	}
 	app := &App{DB: db, Cfg: cfg, Logger: logger.Log}
+	app.metrics = newAppMetrics(db, app.Logger)
+	app.privacy = &ipAnonymizer{app: app}
+	app.visits = newVisitRecorder(app)
+	if !app.adminConfigured() {
+		logger.Log.Warn("未配置 security.admin_ips 或 security.admin_token，管理接口、访问统计和 /metrics 已禁用")
+	}
+	r.Use(otelgin.Middleware(cfg.Tracing.ServiceName), app.requestContext(), app.metrics.middleware(), app.recovery(), app.errorHandler())
 
 	// 自定义静态文件处理
 	r.Use(func(c *gin.Context) {
 		if strings.HasPrefix(c.Request.URL.Path, "/uploads/") {
 			c.Header("Cache-Control", "public, max-age=3600")
 		}
-		app.recordVisit(c)
+		app.visits.record(c)
 		c.Next()
 	})
 	r.Static("/uploads", cfg.Server.UploadDir)
 	r.Static("/static", "./static")
+	r.GET("/tiles/markers/:z/:x/:y", app.GetMarkerTile)
+	r.GET("/metrics", app.adminOnly(), app.metrics.handler())
 
 	api := r.Group("/api")
 	{
 		markers := api.Group("/markers")
 		{
-			markers.POST("", app.CreateMarker)
+			markers.POST("", app.idempotent(), app.CreateMarker)
 			markers.GET("", app.GetMarkers)
+			markers.GET("/clusters", app.GetMarkerClusters)
+			markers.POST("/bulk", app.BulkMarkers)
+			markers.GET("/:id", app.GetMarker)
 			markers.PUT("/:id", app.UpdateMarker)
+			markers.PATCH("/:id", app.PatchMarker)
 			markers.DELETE("/:id", app.DeleteMarker)
-			markers.POST("/:id/images", app.UploadImages)
+			markers.POST("/:id/images", app.idempotent(), app.UploadImages)
+			markers.PUT("/:id/images/:filename", app.UpdateImageCaption)
 			markers.DELETE("/:id/images/:filename", app.DeleteImage)
 		}
-		api.GET("/visits", app.GetVisits)
-
-		// 高德地图静态图API代理
-		api.GET("/amap-staticmap", func(c *gin.Context) {
-			// 构建高德地图静态图API的URL
-			amapURL := "https://restapi.amap.com/v3/staticmap?key=" + cfg.Map.APIKey
-
-			// 将请求参数传递给高德API
-			queryParams := c.Request.URL.Query()
-			for key, values := range queryParams {
-				for _, value := range values {
-					if key != "key" { // 不传递客户端的key，使用服务器配置的key
-						amapURL += "&" + key + "=" + value
-					}
-				}
-			}
-
-			// 使用http客户端请求高德地图API
-			resp, err := http.Get(amapURL)
-			if err != nil {
-				logger.Log.Error("请求高德地图API失败", zap.Error(err), zap.String("url", amapURL))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "请求高德地图API失败"})
-				return
-			}
-			defer resp.Body.Close()
-
-			// 设置响应头
-			for key, values := range resp.Header {
-				for _, value := range values {
-					c.Header(key, value)
-				}
-			}
+		trajectories := api.Group("/trajectories")
+		{
+			trajectories.POST("", app.CreateTrajectory)
+			trajectories.GET("", app.GetTrajectories)
+			trajectories.DELETE("/:id", app.DeleteTrajectory)
+		}
+		api.GET("/export/kml", app.ExportKML)
+		api.GET("/export/kmz", app.ExportKMZ)
+		api.POST("/import/kml", app.ImportKML)
+		api.GET("/export/gpx", app.ExportGPX)
+		api.POST("/import/gpx", app.ImportGPX)
+		api.GET("/export/csv", app.ExportCSV)
+		api.GET("/export/xlsx", app.ExportXLSX)
+		api.POST("/import/markers", app.ImportMarkers)
+		api.GET("/search", app.Search)
+		// 访问记录包含访客的 IP 和 User-Agent，只允许管理员查看
+		visits := api.Group("/visits", app.adminOnly())
+		{
+			visits.GET("", app.GetVisits)
+			visits.GET("/visitors", app.GetVisitors)
+			visits.GET("/actions", app.GetUserActions)
+		}
 
-			// 设置CORS头，允许任何来源访问
-			c.Header("Access-Control-Allow-Origin", "*")
+		analytics := api.Group("/analytics", app.adminOnly())
+		{
+			analytics.GET("/summary", app.GetAnalyticsSummary)
+			analytics.GET("/traffic", app.GetAnalyticsTraffic)
+			analytics.GET("/paths", app.GetAnalyticsTopPaths)
+			analytics.GET("/referers", app.GetAnalyticsTopReferers)
+			analytics.GET("/devices", app.GetAnalyticsDevices)
+			analytics.GET("/actions", app.GetAnalyticsActions)
+		}
+		api.GET("/health", app.Health)
+		api.GET("/health/ready", app.Ready)
+		api.GET("/health/live", app.Live)
 
-			// 设置状态码
-			c.Status(resp.StatusCode)
+		admin := api.Group("/admin", app.adminOnly())
+		{
+			admin.POST("/backups", app.CreateBackup)
+			admin.GET("/backups", app.ListBackups)
+			admin.GET("/backups/:name", app.DownloadBackup)
+			admin.GET("/health", app.HealthDetails)
+			admin.DELETE("/visitor-data", app.EraseVisitorData)
+		}
 
-			// 将高德地图API的响应直接传递给客户端
-			c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
-		})
+		// 高德地图静态图API代理
+		api.GET("/amap-staticmap", app.AmapStaticMap)
 	}
 
 	r.GET("/admin", func(c *gin.Context) {
@@ -821,12 +1285,23 @@ func main() {
 		}
 	}()
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	go app.scheduleBackups(jobsCtx)
+	go app.scheduleRetention(jobsCtx)
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	stopJobs()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Log.Fatal("服务器关闭失败", zap.Error(err))
 	}
+	if err := app.visits.close(ctx); err != nil {
+		logger.Log.Error("写入剩余访问记录超时", zap.Error(err))
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Log.Error("导出链路数据失败", zap.Error(err))
+	}
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// loadMarker 查询单个标记点及其图片元数据，坐标为存储坐标系，不存在时返回 nil
+func (app *App) loadMarker(ctx context.Context, id string) (*Marker, error) {
+	ctx, done := app.startQuery(ctx, "load_marker")
+	defer done()
+	db := app.dbContext(ctx)
+	markers, err := app.queryMarkers(ctx, "WHERE m.id = ?", []interface{}{id}, "")
+	if err != nil || len(markers) == 0 {
+		return nil, err
+	}
+	m := &markers[0]
+
+	if err := db.QueryRow("SELECT COALESCE(source_crs, '') FROM markers WHERE id = ?", m.ID).Scan(&m.SourceCRS); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT filename, COALESCE(caption, ''), COALESCE(file_size, 0), COALESCE(mime_type, ''), COALESCE(created_at, '')
+		FROM images WHERE marker_id = ? ORDER BY id
+	`, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var img ImageInfo
+		if err := rows.Scan(&img.Filename, &img.Caption, &img.FileSize, &img.MimeType, &img.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.ImageDetails = append(m.ImageDetails, img)
+	}
+	return m, rows.Err()
+}
+
+func (app *App) GetMarker(c *gin.Context) {
+	id := c.Param("id")
+	crs, err := resolveCRS(c, "", storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	marker, err := app.loadMarker(c.Request.Context(), id)
+	if err != nil {
+		app.internalError(c, "查询标记点失败", zap.Error(err), zap.String("id", id))
+		return
+	}
+	if marker == nil {
+		app.respondError(c, http.StatusNotFound, errMarkerNotFound)
+		return
+	}
+
+	marker.toCRS(crs)
+	respondMarker(c, http.StatusOK, marker)
+}
+
+// patchableFields PATCH 可修改的字段
+var patchableFields = map[string]bool{
+	"latitude":           true,
+	"longitude":          true,
+	"value":              true,
+	"required_value":     true,
+	"description":        true,
+	"external_key":       true,
+	"sufficient_color":   true,
+	"insufficient_color": true,
+}
+
+// applyMarkerPatch 按 JSON Merge Patch (RFC 7396) 语义修改标记点：未出现的字段保持不变，
+// null 将字段恢复为默认值（坐标不能为 null）。只检查取值类型，取值范围由 validateStruct 校验。返回被修改的字段名
+func applyMarkerPatch(m *Marker, patch map[string]json.RawMessage) ([]string, error) {
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		if field == "crs" || field == "version" {
+			continue
+		}
+		if !patchableFields[field] {
+			return nil, apierror.New(apierror.UnsupportedField, field)
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		raw := patch[field]
+		isNull := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+
+		switch field {
+		case "latitude", "longitude", "value", "required_value":
+			var f float64
+			if isNull {
+				if field == "latitude" || field == "longitude" {
+					return nil, apierror.New(apierror.FieldNotNullable, field)
+				}
+			} else if err := json.Unmarshal(raw, &f); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, apierror.New(apierror.FieldNotNumber, field)
+			}
+			switch field {
+			case "latitude":
+				m.Latitude = f
+			case "longitude":
+				m.Longitude = f
+			case "value":
+				m.Value = f
+			case "required_value":
+				m.RequiredValue = f
+			}
+
+		case "description", "external_key", "sufficient_color", "insufficient_color":
+			var s string
+			if !isNull {
+				if err := json.Unmarshal(raw, &s); err != nil {
+					return nil, apierror.New(apierror.FieldNotString, field)
+				}
+				s = strings.TrimSpace(s)
+			}
+			switch field {
+			case "description":
+				m.Description = s
+			case "external_key":
+				m.ExternalKey = s
+			case "sufficient_color", "insufficient_color":
+				if field == "sufficient_color" {
+					m.SufficientColor = s
+				} else {
+					m.InsufficientColor = s
+				}
+			}
+		}
+	}
+
+	if m.SufficientColor == "" {
+		m.SufficientColor = defaultSufficientColor
+	}
+	if m.InsufficientColor == "" {
+		m.InsufficientColor = defaultInsufficientColor
+	}
+	return fields, nil
+}
+
+// invalidPatchError 修改内容不合法（字段不支持或取值无效）
+type invalidPatchError struct{ error }
+
+func (e invalidPatchError) Unwrap() error { return e.error }
+
+// markerChange 一次修改涉及的字段及修改前后的位置（存储坐标系）
+type markerChange struct {
+	fields   []string
+	old, new geo.Point
+	version  int
+}
+
+// patchMarker 在 db（可以是事务）中按 JSON Merge Patch 修改标记点，patch 中的坐标按 crs 解释。
+// expected 为修改所基于的版本，不一致时返回 errVersionConflict；没有实际修改字段时不写库
+func patchMarker(db queryExecer, id string, expected int, patch map[string]json.RawMessage, crs geo.CRS) (*markerChange, error) {
+	var marker Marker
+	err := scanMarker(db.QueryRow("SELECT "+markerColumns+", COALESCE(m.source_crs, '') FROM markers m WHERE m.id = ?", id),
+		&marker, &marker.SourceCRS)
+	if err == sql.ErrNoRows {
+		return nil, errMarkerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expected != anyVersion && marker.Version != expected {
+		return nil, errVersionConflict
+	}
+	change := &markerChange{old: geo.Point{Lat: marker.Latitude, Lng: marker.Longitude}, version: marker.Version}
+
+	// 在请求坐标系下修改坐标，再转换回存储坐标系
+	marker.toCRS(crs)
+	change.fields, err = applyMarkerPatch(&marker, patch)
+	if err != nil {
+		return nil, invalidPatchError{err}
+	}
+	// 只校验本次修改的字段，已有数据不合规时不影响修改其他字段
+	if err := validateStruct(&marker, change.fields...); err != nil {
+		return nil, err
+	}
+	if len(change.fields) == 0 {
+		change.new = change.old
+		return change, nil
+	}
+	lat, lng := convertLatLng(marker.Latitude, marker.Longitude, crs, storageCRS)
+
+	// 只修改坐标以外的字段时保留原坐标系，避免坐标往返转换引入误差
+	sourceCRS := marker.SourceCRS
+	if patch["latitude"] != nil || patch["longitude"] != nil {
+		sourceCRS = string(crs)
+	} else {
+		lat, lng = change.old.Lat, change.old.Lng
+	}
+	change.new = geo.Point{Lat: lat, Lng: lng}
+
+	// 修改基于读取时的版本，期间被他人修改则条件更新不会命中
+	err = db.QueryRow(`
+		UPDATE markers SET latitude = ?, longitude = ?, value = ?, required_value = ?, description = ?,
+			external_key = NULLIF(?, ''), sufficient_color = ?, insufficient_color = ?, source_crs = ?,
+			version = version + 1
+		WHERE id = ? AND version = ?
+		RETURNING version`,
+		lat, lng, marker.Value, marker.RequiredValue, marker.Description, marker.ExternalKey,
+		marker.SufficientColor, marker.InsufficientColor, sourceCRS, id, marker.Version).Scan(&change.version)
+	if err == sql.ErrNoRows {
+		return nil, errVersionConflict
+	}
+	if isUniqueViolation(err) {
+		return nil, errExternalKeyTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// PatchMarker 按 JSON Merge Patch 语义部分更新标记点，坐标按 crs 解释（查询参数或请求体中的 crs 字段）
+func (app *App) PatchMarker(c *gin.Context) {
+	id := c.Param("id")
+
+	body, err := c.GetRawData()
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.NotJSONObject))
+		return
+	}
+
+	var bodyCRS string
+	if raw, ok := patch["crs"]; ok {
+		if err := json.Unmarshal(raw, &bodyCRS); err != nil {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.FieldNotString, "crs"))
+			return
+		}
+	}
+	crs, err := resolveCRS(c, bodyCRS, storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var bodyVersion int
+	if raw, ok := patch["version"]; ok {
+		if err := json.Unmarshal(raw, &bodyVersion); err != nil {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.FieldNotInteger, "version"))
+			return
+		}
+	}
+	expected, ok := app.expectedVersion(c, bodyVersion)
+	if !ok {
+		return
+	}
+
+	change, err := patchMarker(app.db(c), id, expected, patch, crs)
+	var invalid invalidPatchError
+	var verr *validationError
+	switch {
+	case errors.As(err, &verr):
+		app.respondError(c, http.StatusUnprocessableEntity, verr)
+		return
+	case errors.Is(err, errMarkerNotFound):
+		app.respondError(c, http.StatusNotFound, errMarkerNotFound)
+		return
+	case errors.Is(err, errVersionConflict):
+		app.respondVersionConflict(c, id, crs)
+		return
+	case errors.Is(err, errExternalKeyTaken):
+		app.respondError(c, http.StatusConflict, err)
+		return
+	case errors.As(err, &invalid):
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		app.internalError(c, "更新标记点失败", zap.Error(err), zap.String("id", id))
+		return
+	}
+	fields := change.fields
+	if len(fields) > 0 {
+		app.tiles.invalidatePoints(change.old, change.new)
+
+		app.recordUserAction(c, "update_marker",
+			fmt.Sprintf("修改标记点 #%s 的 %s", id, strings.Join(fields, ", ")),
+			id)
+
+		app.log(c).Info("修改标记点", zap.String("id", id), zap.Strings("fields", fields))
+	}
+
+	updated, err := app.loadMarker(c.Request.Context(), id)
+	if err != nil || updated == nil {
+		app.internalError(c, "查询更新后的标记点失败", zap.Error(err), zap.String("id", id))
+		return
+	}
+	updated.toCRS(crs)
+	respondMarker(c, http.StatusOK, updated)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+)
+
+// maxPageSize 单页最多返回的标记点数量
+const maxPageSize = 1000
+
+// markerSortColumns 允许排序的字段及对应的 SQL 表达式
+var markerSortColumns = map[string]string{
+	"id":             "m.id",
+	"value":          "m.value",
+	"required_value": "m.required_value",
+	"latitude":       "m.latitude",
+	"longitude":      "m.longitude",
+	"created_at":     "COALESCE(m.created_at, '')",
+	"updated_at":     "COALESCE(m.updated_at, '')",
+}
+
+// markerQuery 由查询参数构造的标记点筛选、排序和分页条件
+type markerQuery struct {
+	where  []string
+	args   []interface{}
+	sort   string
+	desc   bool
+	limit  int
+	cursor *markerCursor
+	near   *nearQuery
+}
+
+// markerCursor 键集分页游标：上一页最后一条记录的排序值和 ID
+type markerCursor struct {
+	Value interface{} `json:"v"`
+	ID    int         `json:"id"`
+}
+
+// encodeCursor 把游标编码为不透明的字符串，cur 为各列表自己的游标结构
+func encodeCursor(cur interface{}) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor 把 encodeCursor 生成的字符串解码到 cur
+func decodeCursor(s string, cur interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return apierror.New(apierror.InvalidParam, "cursor")
+	}
+	if err := json.Unmarshal(data, cur); err != nil {
+		return apierror.New(apierror.InvalidParam, "cursor")
+	}
+	return nil
+}
+
+// sqliteTimeLayout 库中 CURRENT_TIMESTAMP 的格式（UTC）
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// parseTimeParam 解析日期参数，支持 RFC3339 和 YYYY-MM-DD，转换为库中 CURRENT_TIMESTAMP 的 UTC 格式
+func parseTimeParam(s string) (string, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC().Format(sqliteTimeLayout), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Format(sqliteTimeLayout), nil
+	}
+	return "", fmt.Errorf("无效的时间: %s", s)
+}
+
+// escapeLike 转义 LIKE 模式中的通配符，配合 ESCAPE '\' 使用
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (q *markerQuery) add(cond string, args ...interface{}) {
+	q.where = append(q.where, cond)
+	q.args = append(q.args, args...)
+}
+
+// parseMarkerQuery 解析 GET /api/markers 的筛选参数，坐标参数按 crs 解释
+func parseMarkerQuery(params url.Values, crs geo.CRS) (*markerQuery, error) {
+	q := &markerQuery{sort: "id"}
+
+	switch status := params.Get("status"); status {
+	case "":
+	case "sufficient":
+		q.add("m.value >= m.required_value")
+	case "insufficient":
+		q.add("m.value < m.required_value")
+	default:
+		return nil, apierror.New(apierror.InvalidParam, "status")
+	}
+
+	ranges := []struct{ param, cond string }{
+		{"min_value", "m.value >= ?"},
+		{"max_value", "m.value <= ?"},
+		{"min_required_value", "m.required_value >= ?"},
+		{"max_required_value", "m.required_value <= ?"},
+	}
+	for _, r := range ranges {
+		if v := params.Get(r.param); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, apierror.New(apierror.InvalidParam, r.param)
+			}
+			q.add(r.cond, f)
+		}
+	}
+
+	dates := []struct{ param, cond string }{
+		{"created_after", "m.created_at >= ?"},
+		{"created_before", "m.created_at < ?"},
+		{"updated_after", "m.updated_at >= ?"},
+		{"updated_before", "m.updated_at < ?"},
+	}
+	for _, d := range dates {
+		if v := params.Get(d.param); v != "" {
+			t, err := parseTimeParam(v)
+			if err != nil {
+				return nil, apierror.New(apierror.InvalidParam, d.param)
+			}
+			q.add(d.cond, t)
+		}
+	}
+
+	if text := strings.TrimSpace(params.Get("q")); text != "" {
+		pattern := "%" + escapeLike(text) + "%"
+		q.add(`(m.description LIKE ? ESCAPE '\' OR m.external_key LIKE ? ESCAPE '\')`, pattern, pattern)
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		// 支持 sort=-value 表示降序
+		if strings.HasPrefix(sort, "-") {
+			q.desc = true
+			sort = sort[1:]
+		}
+		if _, ok := markerSortColumns[sort]; !ok {
+			return nil, apierror.New(apierror.UnsupportedSort, sort)
+		}
+		q.sort = sort
+	}
+	switch order := params.Get("order"); order {
+	case "":
+	case "asc":
+		q.desc = false
+	case "desc":
+		q.desc = true
+	default:
+		return nil, apierror.New(apierror.InvalidParam, "order")
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, apierror.New(apierror.InvalidParam, "limit")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		q.limit = limit
+	}
+	if v := params.Get("cursor"); v != "" {
+		var cur markerCursor
+		if err := decodeCursor(v, &cur); err != nil {
+			return nil, err
+		}
+		q.cursor = &cur
+	}
+
+	if err := q.parseSpatialQuery(params, crs); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// whereClause 返回筛选条件，includeCursor 为 true 时附加游标条件
+func (q *markerQuery) whereClause(includeCursor bool) (string, []interface{}) {
+	conds := append([]string(nil), q.where...)
+	args := append([]interface{}(nil), q.args...)
+	if includeCursor && q.cursor != nil {
+		col := markerSortColumns[q.sort]
+		op := ">"
+		if q.desc {
+			op = "<"
+		}
+		conds = append(conds, fmt.Sprintf("(%s %s ? OR (%s = ? AND m.id %s ?))", col, op, col, op))
+		args = append(args, q.cursor.Value, q.cursor.Value, q.cursor.ID)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// orderClause 以 ID 作为次级排序，保证分页顺序稳定
+func (q *markerQuery) orderClause() string {
+	dir := "ASC"
+	if q.desc {
+		dir = "DESC"
+	}
+	clause := fmt.Sprintf("ORDER BY %s %s", markerSortColumns[q.sort], dir)
+	if q.sort != "id" {
+		clause += ", m.id " + dir
+	}
+	if q.limit > 0 {
+		clause += fmt.Sprintf(" LIMIT %d", q.limit)
+	}
+	return clause
+}
+
+// cursorAfter 生成指向 m 之后的游标，m 的坐标须为存储坐标系
+func (q *markerQuery) cursorAfter(m *Marker) string {
+	var v interface{}
+	switch q.sort {
+	case "id":
+		v = m.ID
+	case "value":
+		v = m.Value
+	case "required_value":
+		v = m.RequiredValue
+	case "latitude":
+		v = m.Latitude
+	case "longitude":
+		v = m.Longitude
+	case "created_at":
+		v = m.CreatedAt
+	case "updated_at":
+		v = m.UpdatedAt
+	}
+	return encodeCursor(markerCursor{Value: v, ID: m.ID})
+}
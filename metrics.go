@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// metricsNamespace 指标名前缀
+const metricsNamespace = "mapproject"
+
+// appMetrics 应用的 Prometheus 指标，使用独立的 registry，不依赖全局默认注册表
+type appMetrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	dbDuration   *prometheus.HistogramVec
+	uploads      *prometheus.CounterVec
+	uploadBytes  *prometheus.CounterVec
+
+	amapDuration    prometheus.Histogram
+	amapErrors      prometheus.Counter
+	amapCacheHits   prometheus.Counter
+	amapCacheMisses prometheus.Counter
+
+	visitsWritten prometheus.Counter
+	visitsDropped *prometheus.CounterVec
+}
+
+// newAppMetrics 创建并注册指标，包括 Go 运行时、进程、连接池和业务数据的指标
+func newAppMetrics(db *sql.DB, logger *zap.Logger) *appMetrics {
+	m := &appMetrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP 请求数，按方法、路由模板和状态码统计",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP 请求处理耗时",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "数据库查询耗时，按查询名称统计",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"query"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "uploads_total",
+			Help:      "上传的文件数，kind 为 image 或 import",
+		}, []string{"kind"}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_bytes_total",
+			Help:      "上传的文件字节数，kind 为 image 或 import",
+		}, []string{"kind"}),
+		amapDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "amap_upstream_duration_seconds",
+			Help:      "请求高德地图API的耗时",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+		}),
+		amapErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "amap_upstream_errors_total",
+			Help:      "请求高德地图API失败（连接失败或非 2xx 响应）的次数",
+		}),
+		amapCacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "amap_cache_hits_total",
+			Help:      "高德静态图代理命中缓存的次数",
+		}),
+		amapCacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "amap_cache_misses_total",
+			Help:      "高德静态图代理未命中缓存的次数",
+		}),
+		visitsWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "visits_written_total",
+			Help:      "写入数据库的访问记录数",
+		}),
+		visitsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "visits_dropped_total",
+			Help:      "未写入的访问记录数，reason 为 sampled（队列积压时抽样丢弃）、queue_full 或 write_error",
+		}, []string{"reason"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "markers"),
+		newDomainCollector(db, logger),
+		m.httpRequests, m.httpDuration, m.dbDuration, m.uploads, m.uploadBytes,
+		m.amapDuration, m.amapErrors, m.amapCacheHits, m.amapCacheMisses,
+		m.visitsWritten, m.visitsDropped,
+	)
+	return m
+}
+
+// timeQuery 开始计时一次数据库查询，调用返回的函数结束计时。m 为 nil（如命令行子命令）时不记录
+func (m *appMetrics) timeQuery(name string) func() {
+	if m == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		m.dbDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeUpload 记录一个上传的文件
+func (m *appMetrics) observeUpload(kind string, size int64) {
+	if m == nil {
+		return
+	}
+	m.uploads.WithLabelValues(kind).Inc()
+	m.uploadBytes.WithLabelValues(kind).Add(float64(size))
+}
+
+// observeVisits 记录写入和丢弃的访问记录数，reason 为空表示成功写入
+func (m *appMetrics) observeVisits(reason string, n int) {
+	if m == nil {
+		return
+	}
+	if reason == "" {
+		m.visitsWritten.Add(float64(n))
+		return
+	}
+	m.visitsDropped.WithLabelValues(reason).Add(float64(n))
+}
+
+// middleware 统计每个请求的数量和耗时。按路由模板而不是实际路径统计，未匹配路由的请求统一记为 unmatched
+func (m *appMetrics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		m.httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		m.httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// handler 输出 Prometheus 文本格式的指标
+func (m *appMetrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// domainCollector 在抓取时从数据库统计标记点和图片数量
+type domainCollector struct {
+	db     *sql.DB
+	logger *zap.Logger
+
+	markers *prometheus.Desc
+	status  *prometheus.Desc
+	images  *prometheus.Desc
+}
+
+func newDomainCollector(db *sql.DB, logger *zap.Logger) *domainCollector {
+	return &domainCollector{
+		db:     db,
+		logger: logger,
+		markers: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "markers"),
+			"标记点总数", nil, nil),
+		status: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "markers_by_status"),
+			"按状态统计的标记点数量，status 为 sufficient（value 不小于 required_value）或 insufficient", []string{"status"}, nil),
+		images: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "images"),
+			"图片总数", nil, nil),
+	}
+}
+
+func (dc *domainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dc.markers
+	ch <- dc.status
+	ch <- dc.images
+}
+
+func (dc *domainCollector) Collect(ch chan<- prometheus.Metric) {
+	var total, sufficient, images int
+	err := dc.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(value >= required_value), 0), (SELECT COUNT(*) FROM images)
+		FROM markers`).Scan(&total, &sufficient, &images)
+	if err != nil {
+		dc.logger.Error("统计指标失败", zap.Error(err))
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(dc.markers, prometheus.GaugeValue, float64(total))
+	ch <- prometheus.MustNewConstMetric(dc.status, prometheus.GaugeValue, float64(sufficient), "sufficient")
+	ch <- prometheus.MustNewConstMetric(dc.status, prometheus.GaugeValue, float64(total-sufficient), "insufficient")
+	ch <- prometheus.MustNewConstMetric(dc.images, prometheus.GaugeValue, float64(images))
+}
@@ -0,0 +1,240 @@
+// Package apierror 定义 API 错误码目录及其多语言提示。错误码是稳定的，客户端应据此判断错误类型，
+// 提示文本可能随版本调整
+package apierror
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Lang 提示文本的语言
+type Lang string
+
+const (
+	ZhCN Lang = "zh-CN"
+	EN   Lang = "en"
+)
+
+// DefaultLang 未指定或不支持请求的语言时使用
+const DefaultLang = ZhCN
+
+// Code 错误码
+type Code string
+
+const (
+	Internal         Code = "internal_error"
+	InvalidRequest   Code = "invalid_request"
+	NotJSONObject    Code = "not_json_object"
+	InvalidParam     Code = "invalid_parameter"
+	MissingParam     Code = "missing_parameter"
+	UnsupportedParam Code = "unsupported_parameter"
+	UnsupportedCRS   Code = "unsupported_crs"
+	UnsupportedSort  Code = "unsupported_sort"
+	Forbidden        Code = "forbidden"
+	UpstreamFailed   Code = "upstream_failed"
+
+	MarkerNotFound     Code = "marker_not_found"
+	ImageNotFound      Code = "image_not_found"
+	TrajectoryNotFound Code = "trajectory_not_found"
+	BackupNotFound     Code = "backup_not_found"
+	TileNotFound       Code = "tile_not_found"
+
+	PreconditionRequired Code = "precondition_required"
+	VersionConflict      Code = "version_conflict"
+	ExternalKeyTaken     Code = "external_key_taken"
+
+	UnsupportedField Code = "unsupported_field"
+	FieldNotNullable Code = "field_not_nullable"
+	FieldNotNumber   Code = "field_not_number"
+	FieldNotString   Code = "field_not_string"
+	FieldNotInteger  Code = "field_not_integer"
+
+	ValidationFailed    Code = "validation_failed"
+	FieldRequired       Code = "field_required"
+	FieldTooSmall       Code = "field_too_small"
+	FieldTooLarge       Code = "field_too_large"
+	FieldTooShort       Code = "field_too_short"
+	FieldTooLong        Code = "field_too_long"
+	FieldInvalidColor   Code = "field_invalid_color"
+	FieldInvalid        Code = "field_invalid"
+	TooManyImages       Code = "too_many_images"
+	FileTooLarge        Code = "file_too_large"
+	UnsupportedFileType Code = "unsupported_file_type"
+	EmptyFile           Code = "empty_file"
+
+	TrajectoryTooShort Code = "trajectory_too_short"
+	InvalidPlacemark   Code = "invalid_placemark"
+	InvalidTrajectory  Code = "invalid_trajectory"
+	LatLngIncomplete   Code = "lat_lng_incomplete"
+	LatLngRequired     Code = "lat_lng_required"
+	InvalidID          Code = "invalid_id"
+	InvalidNumber      Code = "invalid_number"
+	UnknownField       Code = "unknown_field"
+	MissingColumn      Code = "missing_column"
+	InvalidSpreadsheet Code = "invalid_spreadsheet"
+	ImportFailed       Code = "import_failed"
+
+	SearchUnavailable Code = "search_unavailable"
+
+	TooManyOperations    Code = "too_many_operations"
+	UnsupportedOperation Code = "unsupported_operation"
+	BulkFailed           Code = "bulk_failed"
+
+	IdempotencyKeyTooLong Code = "idempotency_key_too_long"
+	IdempotencyKeyReused  Code = "idempotency_key_reused"
+	IdempotencyInProgress Code = "idempotency_in_progress"
+	IdempotencyRetry      Code = "idempotency_retry"
+	IdempotencyBodyLarge  Code = "idempotency_body_too_large"
+)
+
+// catalogue 各错误码的提示模板，参数按 fmt 格式化
+var catalogue = map[Code]map[Lang]string{
+	Internal: {
+		ZhCN: "服务器内部错误，请稍后重试（错误编号 %s）",
+		EN:   "Internal server error, please try again later (reference %s)",
+	},
+	InvalidRequest:   {ZhCN: "请求无效：%s", EN: "Invalid request: %s"},
+	NotJSONObject:    {ZhCN: "请求体必须是 JSON 对象", EN: "Request body must be a JSON object"},
+	InvalidParam:     {ZhCN: "无效的参数 %s", EN: "Invalid parameter: %s"},
+	MissingParam:     {ZhCN: "缺少参数 %s", EN: "Missing parameter: %s"},
+	UnsupportedParam: {ZhCN: "此处不支持参数 %s", EN: "Parameter not supported here: %s"},
+	UnsupportedCRS:   {ZhCN: "不支持的坐标系: %s", EN: "Unsupported coordinate system: %s"},
+	UnsupportedSort:  {ZhCN: "不支持的排序字段: %s", EN: "Unsupported sort field: %s"},
+	Forbidden:        {ZhCN: "无权访问", EN: "Access denied"},
+	UpstreamFailed:   {ZhCN: "请求高德地图API失败", EN: "Request to the AMap API failed"},
+
+	MarkerNotFound:     {ZhCN: "标记点不存在", EN: "Marker not found"},
+	ImageNotFound:      {ZhCN: "图片不存在或不属于该标记点", EN: "Image not found or does not belong to this marker"},
+	TrajectoryNotFound: {ZhCN: "轨迹不存在", EN: "Trajectory not found"},
+	BackupNotFound:     {ZhCN: "备份不存在", EN: "Backup not found"},
+	TileNotFound:       {ZhCN: "瓦片不存在", EN: "Tile not found"},
+
+	PreconditionRequired: {
+		ZhCN: "修改标记点需要提供 If-Match 请求头或 version 字段",
+		EN:   "Modifying a marker requires an If-Match header or a version field",
+	},
+	VersionConflict: {
+		ZhCN: "标记点已被其他人修改，请基于最新数据重试",
+		EN:   "The marker has been modified by someone else, please retry based on the latest data",
+	},
+	ExternalKeyTaken: {ZhCN: "external_key 已被其他标记点使用", EN: "external_key is already used by another marker"},
+
+	UnsupportedField: {ZhCN: "不支持修改字段: %s", EN: "Field cannot be modified: %s"},
+	FieldNotNullable: {ZhCN: "%s 不能为 null", EN: "%s cannot be null"},
+	FieldNotNumber:   {ZhCN: "%s 必须是数字", EN: "%s must be a number"},
+	FieldNotString:   {ZhCN: "%s 必须是字符串", EN: "%s must be a string"},
+	FieldNotInteger:  {ZhCN: "%s 必须是整数", EN: "%s must be an integer"},
+
+	ValidationFailed:    {ZhCN: "参数校验失败", EN: "Validation failed"},
+	FieldRequired:       {ZhCN: "%s 不能为空", EN: "%s is required"},
+	FieldTooSmall:       {ZhCN: "%s 不能小于 %s", EN: "%s must be at least %s"},
+	FieldTooLarge:       {ZhCN: "%s 不能大于 %s", EN: "%s must be at most %s"},
+	FieldTooShort:       {ZhCN: "%s 不能少于 %s 个字符", EN: "%s must be at least %s characters"},
+	FieldTooLong:        {ZhCN: "%s 不能超过 %s 个字符", EN: "%s must be at most %s characters"},
+	FieldInvalidColor:   {ZhCN: "%s 必须是 #RRGGBB 格式的颜色", EN: "%s must be a colour in #RRGGBB format"},
+	FieldInvalid:        {ZhCN: "%s 无效", EN: "%s is invalid"},
+	TooManyImages:       {ZhCN: "每个标记点最多 %d 张图片，当前已有 %d 张", EN: "A marker can have at most %d images, it already has %d"},
+	FileTooLarge:        {ZhCN: "文件过大", EN: "File too large"},
+	UnsupportedFileType: {ZhCN: "不支持的文件类型", EN: "Unsupported file type"},
+	EmptyFile:           {ZhCN: "文件为空", EN: "File is empty"},
+
+	TrajectoryTooShort: {ZhCN: "轨迹至少需要两个点", EN: "A trajectory needs at least two points"},
+	InvalidPlacemark:   {ZhCN: "地标 %s 坐标无效", EN: "Placemark %s has invalid coordinates"},
+	InvalidTrajectory:  {ZhCN: "轨迹 %s 坐标无效", EN: "Trajectory %s has invalid coordinates"},
+	LatLngIncomplete:   {ZhCN: "经纬度需要同时提供", EN: "Latitude and longitude must be provided together"},
+	LatLngRequired:     {ZhCN: "新建标记点需要经纬度", EN: "Latitude and longitude are required for new markers"},
+	InvalidID:          {ZhCN: "无效的ID", EN: "Invalid ID"},
+	InvalidNumber:      {ZhCN: "不是有效的数字", EN: "Not a valid number"},
+	UnknownField:       {ZhCN: "未知的字段: %s", EN: "Unknown field: %s"},
+	MissingColumn:      {ZhCN: "表头中没有列: %s", EN: "Column not found in header: %s"},
+	InvalidSpreadsheet: {ZhCN: "解析%s失败: %s", EN: "Failed to parse %s: %s"},
+	ImportFailed:       {ZhCN: "导入数据有误，未写入任何数据", EN: "Import data contains errors, nothing was written"},
+
+	SearchUnavailable: {
+		ZhCN: "全文检索不可用，请使用 -tags sqlite_fts5 编译",
+		EN:   "Full-text search is unavailable, build with -tags sqlite_fts5",
+	},
+
+	TooManyOperations:    {ZhCN: "单次最多 %d 项操作", EN: "At most %d operations per request"},
+	UnsupportedOperation: {ZhCN: "不支持的操作: %s", EN: "Unsupported operation: %s"},
+	BulkFailed:           {ZhCN: "部分操作失败，未写入任何数据", EN: "Some operations failed, nothing was written"},
+
+	IdempotencyKeyTooLong: {ZhCN: "Idempotency-Key 不能超过 %d 个字符", EN: "Idempotency-Key must be at most %d characters"},
+	IdempotencyKeyReused:  {ZhCN: "Idempotency-Key 已用于内容不同的请求", EN: "Idempotency-Key was already used for a different request"},
+	IdempotencyInProgress: {ZhCN: "相同 Idempotency-Key 的请求正在处理中", EN: "A request with the same Idempotency-Key is still in progress"},
+	IdempotencyRetry:      {ZhCN: "相同 Idempotency-Key 的请求处理失败，请重试", EN: "The request with the same Idempotency-Key failed, please retry"},
+	IdempotencyBodyLarge:  {ZhCN: "带 Idempotency-Key 的请求体不能超过 %d MB", EN: "Request body with Idempotency-Key must be at most %d MB"},
+}
+
+// Message 返回错误码在指定语言下的提示，缺少该语言时使用默认语言
+func Message(code Code, lang Lang, args ...interface{}) string {
+	templates, ok := catalogue[code]
+	if !ok {
+		return string(code)
+	}
+	tmpl, ok := templates[lang]
+	if !ok {
+		tmpl = templates[DefaultLang]
+	}
+	if len(args) == 0 {
+		return tmpl
+	}
+	return fmt.Sprintf(tmpl, args...)
+}
+
+// Error 带错误码的错误，Error() 返回默认语言的提示
+type Error struct {
+	Code Code
+	Args []interface{}
+}
+
+func New(code Code, args ...interface{}) *Error {
+	return &Error{Code: code, Args: args}
+}
+
+func (e *Error) Error() string {
+	return Message(e.Code, DefaultLang, e.Args...)
+}
+
+// Localize 返回指定语言的提示
+func (e *Error) Localize(lang Lang) string {
+	return Message(e.Code, lang, e.Args...)
+}
+
+// Negotiate 按 Accept-Language 请求头（含 q 权重）选择支持的语言，
+// zh 开头的语言使用简体中文，en 开头的使用英文
+func Negotiate(acceptLanguage string) Lang {
+	type candidate struct {
+		lang Lang
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if q <= 0 {
+			continue
+		}
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		switch {
+		case tag == "zh" || strings.HasPrefix(tag, "zh-"):
+			candidates = append(candidates, candidate{ZhCN, q})
+		case tag == "en" || strings.HasPrefix(tag, "en-"):
+			candidates = append(candidates, candidate{EN, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return DefaultLang
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
@@ -0,0 +1,97 @@
+package apierror
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		header string
+		want   Lang
+	}{
+		{"", DefaultLang},
+		{"en", EN},
+		{"en-US", EN},
+		{"EN-gb", EN},
+		{"zh", ZhCN},
+		{"zh-CN", ZhCN},
+		{"zh-Hant-TW", ZhCN},
+		{"fr-FR", DefaultLang},
+		{"fr-FR, en;q=0.5", EN},
+		{"en-US,en;q=0.9,zh-CN;q=0.8", EN},
+		{"zh-CN;q=0.8, en;q=0.9", EN},
+		{"en;q=0.3, zh;q=0.7", ZhCN},
+		{"en;q=0, zh;q=0.1", ZhCN},
+		{"en;q=0", DefaultLang},
+		{"en;q=abc, zh;q=0.1", ZhCN},
+		{" en ; q=0.9 ", EN},
+		{"*", DefaultLang},
+		{"english", DefaultLang},
+		// 权重相同时取先出现的
+		{"en, zh", EN},
+		{"zh, en", ZhCN},
+	}
+	for _, tt := range tests {
+		if got := Negotiate(tt.header); got != tt.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+var verbPattern = regexp.MustCompile(`%[a-z]`)
+
+// 每个错误码都有两种语言的提示，且格式化参数一致
+func TestCatalogue(t *testing.T) {
+	for code, templates := range catalogue {
+		zh, en := templates[ZhCN], templates[EN]
+		if zh == "" || en == "" {
+			t.Errorf("%s: missing translation: zh-CN %q, en %q", code, zh, en)
+			continue
+		}
+		zhVerbs, enVerbs := verbPattern.FindAllString(zh, -1), verbPattern.FindAllString(en, -1)
+		if len(zhVerbs) != len(enVerbs) {
+			t.Errorf("%s: zh-CN has %v, en has %v", code, zhVerbs, enVerbs)
+			continue
+		}
+		for i := range zhVerbs {
+			if zhVerbs[i] != enVerbs[i] {
+				t.Errorf("%s: argument %d is %s in zh-CN but %s in en", code, i+1, zhVerbs[i], enVerbs[i])
+			}
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		code Code
+		lang Lang
+		args []interface{}
+		want string
+	}{
+		{MarkerNotFound, ZhCN, nil, "标记点不存在"},
+		{MarkerNotFound, EN, nil, "Marker not found"},
+		{MarkerNotFound, "fr", nil, "标记点不存在"},
+		{InvalidParam, EN, []interface{}{"limit"}, "Invalid parameter: limit"},
+		{TooManyImages, ZhCN, []interface{}{20, 18}, Message(TooManyImages, DefaultLang, 20, 18)},
+		{"no_such_code", EN, nil, "no_such_code"},
+	}
+	for _, tt := range tests {
+		if got := Message(tt.code, tt.lang, tt.args...); got != tt.want {
+			t.Errorf("Message(%s, %s, %v) = %q, want %q", tt.code, tt.lang, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	err := New(FieldTooLong, "description", "500")
+	if err.Code != FieldTooLong {
+		t.Errorf("Code = %q, want %q", err.Code, FieldTooLong)
+	}
+	if got, want := err.Error(), Message(FieldTooLong, DefaultLang, "description", "500"); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if got, want := err.Localize(EN), Message(FieldTooLong, EN, "description", "500"); got != want {
+		t.Errorf("Localize(en) = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,461 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// FormatVersion 备份包格式版本，格式不兼容地变更时递增
+const FormatVersion = 1
+
+const (
+	manifestName = "manifest.json"
+	databaseName = "markers.db"
+	uploadsDir   = "uploads"
+	filePrefix   = "backup-"
+	fileSuffix   = ".tar.gz"
+	lockSuffix   = ".lock"
+)
+
+// sidecarSuffixes SQLite 数据库的附属文件（回滚日志和 WAL），必须与数据库文件一起移动
+var sidecarSuffixes = []string{"-journal", "-wal", "-shm"}
+
+// ErrDatabaseInUse 数据库正被其他进程（如运行中的服务）使用
+var ErrDatabaseInUse = errors.New("数据库正在使用中，请先停止服务")
+
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	SQLiteVersion string    `json:"sqlite_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	Files         []File    `json:"files"`
+}
+
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Info 备份目录中的一个备份包
+type Info struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FileName 生成按时间排序的备份文件名，时间后附加随机后缀，同一秒内的多次备份不会互相覆盖
+func FileName(t time.Time) string {
+	return filePrefix + t.Format("20060102-150405") + fmt.Sprintf("-%06x", rand.Intn(1<<24)) + fileSuffix
+}
+
+// LockShared 对数据库加共享锁（锁文件为 dbPath.lock），使用数据库的进程在运行期间持有，
+// 多个进程可以同时持有；Restore 需要排他锁，据此拒绝恢复正在使用的数据库。返回的文件关闭时释放锁
+func LockShared(dbPath string) (*os.File, error) {
+	return lockFile(dbPath+lockSuffix, false)
+}
+
+// IsBackupFile 判断文件名是否为本程序生成的备份包
+func IsBackupFile(name string) bool {
+	return strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) && filepath.Base(name) == name
+}
+
+// snapshotDatabase 使用 SQLite 在线备份 API 将数据库一致地复制到 dest
+func snapshotDatabase(ctx context.Context, db *sql.DB, dest string) error {
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			b, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// 分批复制，期间释放锁，避免长时间阻塞写入
+			for {
+				done, err := b.Step(256)
+				if err != nil {
+					b.Close()
+					return err
+				}
+				if done {
+					return b.Close()
+				}
+				select {
+				case <-ctx.Done():
+					b.Close()
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+	})
+}
+
+// hashFile 计算文件大小和 SHA-256
+func hashFile(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func addFile(tw *tar.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Create 生成包含数据库快照、上传文件和清单的备份包，写入 destPath
+func Create(ctx context.Context, db *sql.DB, uploadDir, destPath string) (*Manifest, error) {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(destPath), ".backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshot := filepath.Join(tmpDir, databaseName)
+	if err := snapshotDatabase(ctx, db, snapshot); err != nil {
+		return nil, fmt.Errorf("数据库快照失败: %v", err)
+	}
+
+	sqliteVersion, _, _ := sqlite3.Version()
+	manifest := &Manifest{FormatVersion: FormatVersion, SQLiteVersion: sqliteVersion, CreatedAt: time.Now().UTC()}
+
+	// sources 记录包内路径对应的磁盘文件
+	sources := map[string]string{databaseName: snapshot}
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			sources[path.Join(uploadsDir, e.Name())] = filepath.Join(uploadDir, e.Name())
+		}
+	}
+	for name, src := range sources {
+		size, sum, err := hashFile(src)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, File{Path: name, Size: size, SHA256: sum})
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	// 先写临时文件，完成后再改名，避免留下不完整的备份包
+	tmpArchive := filepath.Join(tmpDir, "archive"+fileSuffix)
+	if err := writeArchive(tmpArchive, manifest, sources); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpArchive, destPath); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeArchive(dest string, manifest *Manifest, sources map[string]string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	for _, f := range manifest.Files {
+		if err := addFile(tw, sources[f.Path], f.Path); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// Extract 解包到 destDir 并逐一校验清单中的文件，数据库还需通过完整性检查
+func Extract(archivePath, destDir string) (*Manifest, error) {
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("备份包格式错误: %v", err)
+	}
+	tr := tar.NewReader(gr)
+
+	var manifest *Manifest
+	extracted := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("备份包格式错误: %v", err)
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if path.IsAbs(name) || strings.HasPrefix(name, "../") || name == ".." {
+			return nil, fmt.Errorf("备份包包含非法路径: %s", hdr.Name)
+		}
+		if name == manifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("清单格式错误: %v", err)
+			}
+			continue
+		}
+
+		target := filepath.Join(destDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		extracted[name] = true
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("备份包缺少清单")
+	}
+	if manifest.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("不支持的备份格式版本: %d", manifest.FormatVersion)
+	}
+
+	hasDatabase := false
+	for _, f := range manifest.Files {
+		if !extracted[f.Path] {
+			return nil, fmt.Errorf("备份包缺少文件: %s", f.Path)
+		}
+		delete(extracted, f.Path)
+		size, sum, err := hashFile(filepath.Join(destDir, filepath.FromSlash(f.Path)))
+		if err != nil {
+			return nil, err
+		}
+		if size != f.Size || sum != f.SHA256 {
+			return nil, fmt.Errorf("文件校验失败: %s", f.Path)
+		}
+		if f.Path == databaseName {
+			hasDatabase = true
+		}
+	}
+	for name := range extracted {
+		return nil, fmt.Errorf("备份包包含清单外的文件: %s", name)
+	}
+	if !hasDatabase {
+		return nil, fmt.Errorf("备份包缺少数据库")
+	}
+
+	if err := checkIntegrity(filepath.Join(destDir, databaseName)); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func checkIntegrity(dbPath string) error {
+	db, err := sql.Open("sqlite3", dbPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("数据库完整性检查失败: %v", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("数据库完整性检查失败: %s", result)
+	}
+	return nil
+}
+
+// Verify 校验备份包但不修改任何数据
+func Verify(archivePath string) (*Manifest, error) {
+	tmpDir, err := os.MkdirTemp("", "backup-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	return Extract(archivePath, tmpDir)
+}
+
+// Restore 校验通过后用备份替换数据库和上传目录。原有数据改名保留，返回其路径。
+// 调用前必须停止服务，服务仍在运行（持有 LockShared 的锁）时返回 ErrDatabaseInUse
+func Restore(archivePath, dbPath, uploadDir string) (oldDB, oldUploads string, err error) {
+	lock, err := lockFile(dbPath+lockSuffix, true)
+	if err != nil {
+		return "", "", err
+	}
+	defer lock.Close()
+
+	// 解包到数据库所在目录，保证后续改名不跨文件系统
+	stagingDir, err := os.MkdirTemp(filepath.Dir(dbPath), ".restore-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if _, err := Extract(archivePath, stagingDir); err != nil {
+		return "", "", err
+	}
+	stagedUploads := filepath.Join(stagingDir, uploadsDir)
+	if err := os.MkdirAll(stagedUploads, 0755); err != nil {
+		return "", "", err
+	}
+
+	suffix := ".before-restore-" + time.Now().Format("20060102-150405")
+	if _, err := os.Stat(dbPath); err == nil {
+		oldDB = dbPath + suffix
+		if err := os.Rename(dbPath, oldDB); err != nil {
+			return "", "", err
+		}
+	}
+	// 附属文件随原数据库一起改名：其中未写回的数据属于原数据库，打开保留的副本时 SQLite 会据此恢复；
+	// 留在原处的回滚日志会被当作热日志应用到恢复后的数据库
+	for _, s := range sidecarSuffixes {
+		if _, err := os.Stat(dbPath + s); err != nil {
+			continue
+		}
+		if oldDB == "" {
+			oldDB = dbPath + suffix
+		}
+		if err := os.Rename(dbPath+s, oldDB+s); err != nil {
+			return oldDB, "", err
+		}
+	}
+	if err := os.Rename(filepath.Join(stagingDir, databaseName), dbPath); err != nil {
+		return oldDB, "", err
+	}
+
+	if _, err := os.Stat(uploadDir); err == nil {
+		oldUploads = filepath.Clean(uploadDir) + suffix
+		if err := os.Rename(uploadDir, oldUploads); err != nil {
+			return oldDB, "", err
+		}
+	}
+	if err := os.Rename(stagedUploads, uploadDir); err != nil {
+		return oldDB, oldUploads, err
+	}
+	return oldDB, oldUploads, nil
+}
+
+// List 列出备份目录中的备份包，最新的在前
+func List(dir string) ([]Info, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Info{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := []Info{}
+	for _, e := range entries {
+		if !IsBackupFile(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		result = append(result, Info{Name: e.Name(), Size: info.Size(), CreatedAt: info.ModTime()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name > result[j].Name })
+	return result, nil
+}
+
+// Prune 只保留最新的 keep 个备份包，返回被删除的文件名
+func Prune(dir string, keep int) ([]string, error) {
+	backups, err := List(dir)
+	if err != nil || keep <= 0 || len(backups) <= keep {
+		return nil, err
+	}
+	var removed []string
+	for _, b := range backups[keep:] {
+		if err := os.Remove(filepath.Join(dir, b.Name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, b.Name)
+	}
+	return removed, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package backup
+
+import "os"
+
+// lockFile 当前平台不支持文件锁，只创建锁文件，恢复时不检查数据库是否正在使用
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
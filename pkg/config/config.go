@@ -44,12 +44,66 @@ type Config struct {
 		KeyFile        string   `yaml:"key_file"`
 		AllowedOrigins []string `yaml:"allowed_origins"`
 		IPWhitelist    []string `yaml:"ip_whitelist"`
+		AdminIPs       []string `yaml:"admin_ips"`
+		AdminToken     string   `yaml:"admin_token"`
+		TrustedProxies []string `yaml:"trusted_proxies"`
 	} `yaml:"security"`
 
+	Backup struct {
+		Dir       string `yaml:"dir"`
+		Interval  int    `yaml:"interval"`
+		Retention int    `yaml:"retention"`
+	} `yaml:"backup"`
+
+	Import struct {
+		SimplifyTolerance float64 `yaml:"simplify_tolerance"`
+	} `yaml:"import"`
+
 	RateLimit struct {
 		RequestsPerSecond float64 `yaml:"requests_per_second"`
 		Burst             int     `yaml:"burst"`
 	} `yaml:"rate_limit"`
+
+	Idempotency struct {
+		TTL int `yaml:"ttl"`
+	} `yaml:"idempotency"`
+
+	Health struct {
+		CheckAmap     bool  `yaml:"check_amap"`
+		MinFreeDiskMB int64 `yaml:"min_free_disk_mb"`
+		Timeout       int   `yaml:"timeout"`
+	} `yaml:"health"`
+
+	Tracing struct {
+		Enabled     bool    `yaml:"enabled"`
+		Endpoint    string  `yaml:"endpoint"`
+		Protocol    string  `yaml:"protocol"`
+		Insecure    bool    `yaml:"insecure"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+		ServiceName string  `yaml:"service_name"`
+	} `yaml:"tracing"`
+
+	Visits struct {
+		IncludePaths         []string `yaml:"include_paths"`
+		ExcludePaths         []string `yaml:"exclude_paths"`
+		QueueSize            int      `yaml:"queue_size"`
+		BatchSize            int      `yaml:"batch_size"`
+		FlushInterval        int      `yaml:"flush_interval"`
+		PressureSampleRatio  float64  `yaml:"pressure_sample_ratio"`
+		SessionTimeout       int      `yaml:"session_timeout"`
+		SessionCookie        bool     `yaml:"session_cookie"`
+		BotRequestsPerMinute int      `yaml:"bot_requests_per_minute"`
+	} `yaml:"visits"`
+
+	Privacy struct {
+		IPMode           string `yaml:"ip_mode"`
+		HashKey          string `yaml:"hash_key"`
+		IPv4Prefix       int    `yaml:"ipv4_prefix"`
+		IPv6Prefix       int    `yaml:"ipv6_prefix"`
+		SaltRotationDays int    `yaml:"salt_rotation_days"`
+		RetentionDays    int    `yaml:"retention_days"`
+		Rollup           bool   `yaml:"rollup"`
+	} `yaml:"privacy"`
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -105,12 +159,75 @@ func setDefaults(config *Config) {
 	if config.Database.ConnMaxLifetime == 0 {
 		config.Database.ConnMaxLifetime = 3600 // 1 hour
 	}
+	if config.Backup.Dir == "" {
+		config.Backup.Dir = "./backups"
+	}
+	if config.Backup.Retention == 0 {
+		config.Backup.Retention = 7
+	}
+	if config.Import.SimplifyTolerance == 0 {
+		config.Import.SimplifyTolerance = 5 // meters
+	}
 	if config.RateLimit.RequestsPerSecond == 0 {
 		config.RateLimit.RequestsPerSecond = 10
 	}
 	if config.RateLimit.Burst == 0 {
 		config.RateLimit.Burst = 20
 	}
+	if config.Idempotency.TTL == 0 {
+		config.Idempotency.TTL = 24 // hours
+	}
+	if config.Health.MinFreeDiskMB == 0 {
+		config.Health.MinFreeDiskMB = 100
+	}
+	if config.Health.Timeout == 0 {
+		config.Health.Timeout = 3 // seconds
+	}
+	if config.Tracing.Endpoint == "" {
+		config.Tracing.Endpoint = "localhost:4318"
+	}
+	if config.Tracing.Protocol == "" {
+		config.Tracing.Protocol = "http"
+	}
+	if config.Tracing.SampleRatio == 0 {
+		config.Tracing.SampleRatio = 1
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "mapproject"
+	}
+	if config.Visits.ExcludePaths == nil {
+		config.Visits.ExcludePaths = []string{"/api/health", "/static/", "/uploads/", "/tiles/", "/metrics"}
+	}
+	if config.Visits.QueueSize == 0 {
+		config.Visits.QueueSize = 4096
+	}
+	if config.Visits.BatchSize == 0 {
+		config.Visits.BatchSize = 200
+	}
+	if config.Visits.FlushInterval == 0 {
+		config.Visits.FlushInterval = 2 // seconds
+	}
+	if config.Visits.PressureSampleRatio == 0 {
+		config.Visits.PressureSampleRatio = 0.1
+	}
+	if config.Visits.SessionTimeout == 0 {
+		config.Visits.SessionTimeout = 30 // minutes
+	}
+	if config.Visits.BotRequestsPerMinute == 0 {
+		config.Visits.BotRequestsPerMinute = 120
+	}
+	if config.Privacy.IPMode == "" {
+		config.Privacy.IPMode = "truncate"
+	}
+	if config.Privacy.IPv4Prefix == 0 {
+		config.Privacy.IPv4Prefix = 24
+	}
+	if config.Privacy.IPv6Prefix == 0 {
+		config.Privacy.IPv6Prefix = 48
+	}
+	if config.Privacy.SaltRotationDays == 0 {
+		config.Privacy.SaltRotationDays = 1
+	}
 }
 
 // validateConfig 验证配置
@@ -127,5 +244,32 @@ func validateConfig(config *Config) error {
 	if config.Database.Path == "" {
 		return fmt.Errorf("数据库路径不能为空")
 	}
+	if config.Tracing.Protocol != "http" && config.Tracing.Protocol != "grpc" {
+		return fmt.Errorf("不支持的链路追踪协议: %s", config.Tracing.Protocol)
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("链路追踪采样率必须在 0 到 1 之间: %v", config.Tracing.SampleRatio)
+	}
+	if config.Visits.QueueSize < 0 || config.Visits.BatchSize < 0 || config.Visits.FlushInterval < 0 ||
+		config.Visits.SessionTimeout < 0 || config.Visits.BotRequestsPerMinute < 0 {
+		return fmt.Errorf("访问记录的队列长度、批量大小、写入间隔、会话超时和请求频率不能为负数")
+	}
+	if config.Visits.PressureSampleRatio < 0 || config.Visits.PressureSampleRatio > 1 {
+		return fmt.Errorf("访问记录采样率必须在 0 到 1 之间: %v", config.Visits.PressureSampleRatio)
+	}
+	switch config.Privacy.IPMode {
+	case "full", "truncate", "hash":
+	default:
+		return fmt.Errorf("不支持的 IP 保存方式: %s", config.Privacy.IPMode)
+	}
+	if config.Privacy.IPMode == "hash" && len(config.Privacy.HashKey) < 16 {
+		return fmt.Errorf("ip_mode 为 hash 时 hash_key 至少需要 16 个字符")
+	}
+	if config.Privacy.IPv4Prefix < 0 || config.Privacy.IPv4Prefix > 32 || config.Privacy.IPv6Prefix < 0 || config.Privacy.IPv6Prefix > 128 {
+		return fmt.Errorf("IP 截断位数无效: ipv4_prefix=%d, ipv6_prefix=%d", config.Privacy.IPv4Prefix, config.Privacy.IPv6Prefix)
+	}
+	if config.Privacy.SaltRotationDays < 0 || config.Privacy.RetentionDays < 0 {
+		return fmt.Errorf("盐更换周期和访问数据保留天数不能为负数")
+	}
 	return nil
 }
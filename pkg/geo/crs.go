@@ -0,0 +1,141 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// CRS 坐标参考系
+type CRS string
+
+const (
+	// WGS84 GPS、GPX、照片 EXIF 和 GeoJSON 使用的国际标准坐标系
+	WGS84 CRS = "wgs84"
+	// GCJ02 国测局坐标系（火星坐标），高德地图使用
+	GCJ02 CRS = "gcj02"
+	// BD09 百度地图坐标系，在 GCJ02 基础上再次加偏
+	BD09 CRS = "bd09"
+)
+
+// ParseCRS 解析坐标系名称，兼容常见写法（如 WGS-84、EPSG:4326、GCJ-02、BD-09）
+func ParseCRS(s string) (CRS, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	name = strings.NewReplacer("-", "", "_", "").Replace(name)
+	switch name {
+	case "wgs84", "epsg:4326", "gps":
+		return WGS84, nil
+	case "gcj02", "amap", "gaode":
+		return GCJ02, nil
+	case "bd09", "bd09ll", "baidu":
+		return BD09, nil
+	}
+	return "", fmt.Errorf("不支持的坐标系: %s", s)
+}
+
+const (
+	krasovskyA  = 6378245.0
+	krasovskyEE = 0.00669342162296594323
+	bdXPi       = math.Pi * 3000.0 / 180.0
+)
+
+// outOfChina 中国境外不做加偏，与国测局算法保持一致
+func outOfChina(p Point) bool {
+	return p.Lng < 72.004 || p.Lng > 137.8347 || p.Lat < 0.8293 || p.Lat > 55.8271
+}
+
+func transformLat(x, y float64) float64 {
+	ret := -100.0 + 2.0*x + 3.0*y + 0.2*y*y + 0.1*x*y + 0.2*math.Sqrt(math.Abs(x))
+	ret += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	ret += (20.0*math.Sin(y*math.Pi) + 40.0*math.Sin(y/3.0*math.Pi)) * 2.0 / 3.0
+	ret += (160.0*math.Sin(y/12.0*math.Pi) + 320*math.Sin(y*math.Pi/30.0)) * 2.0 / 3.0
+	return ret
+}
+
+func transformLng(x, y float64) float64 {
+	ret := 300.0 + x + 2.0*y + 0.1*x*x + 0.1*x*y + 0.1*math.Sqrt(math.Abs(x))
+	ret += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	ret += (20.0*math.Sin(x*math.Pi) + 40.0*math.Sin(x/3.0*math.Pi)) * 2.0 / 3.0
+	ret += (150.0*math.Sin(x/12.0*math.Pi) + 300.0*math.Sin(x/30.0*math.Pi)) * 2.0 / 3.0
+	return ret
+}
+
+// WGS84ToGCJ02 WGS-84 转 GCJ-02
+func WGS84ToGCJ02(p Point) Point {
+	if outOfChina(p) {
+		return p
+	}
+	dLat := transformLat(p.Lng-105.0, p.Lat-35.0)
+	dLng := transformLng(p.Lng-105.0, p.Lat-35.0)
+	radLat := p.Lat / 180.0 * math.Pi
+	magic := math.Sin(radLat)
+	magic = 1 - krasovskyEE*magic*magic
+	sqrtMagic := math.Sqrt(magic)
+	dLat = (dLat * 180.0) / ((krasovskyA * (1 - krasovskyEE)) / (magic * sqrtMagic) * math.Pi)
+	dLng = (dLng * 180.0) / (krasovskyA / sqrtMagic * math.Cos(radLat) * math.Pi)
+	return Point{Lat: p.Lat + dLat, Lng: p.Lng + dLng}
+}
+
+// GCJ02ToWGS84 GCJ-02 转 WGS-84，迭代逼近，误差小于 1 厘米
+func GCJ02ToWGS84(p Point) Point {
+	if outOfChina(p) {
+		return p
+	}
+	w := p
+	for i := 0; i < 10; i++ {
+		g := WGS84ToGCJ02(w)
+		dLat, dLng := g.Lat-p.Lat, g.Lng-p.Lng
+		w.Lat -= dLat
+		w.Lng -= dLng
+		if math.Abs(dLat) < 1e-9 && math.Abs(dLng) < 1e-9 {
+			break
+		}
+	}
+	return w
+}
+
+// GCJ02ToBD09 GCJ-02 转 BD-09
+func GCJ02ToBD09(p Point) Point {
+	x, y := p.Lng, p.Lat
+	z := math.Sqrt(x*x+y*y) + 0.00002*math.Sin(y*bdXPi)
+	theta := math.Atan2(y, x) + 0.000003*math.Cos(x*bdXPi)
+	return Point{Lat: z*math.Sin(theta) + 0.006, Lng: z*math.Cos(theta) + 0.0065}
+}
+
+// BD09ToGCJ02 BD-09 转 GCJ-02。常用的近似公式误差可达 0.2 米，在此基础上迭代逼近，误差小于 1 厘米
+func BD09ToGCJ02(p Point) Point {
+	x, y := p.Lng-0.0065, p.Lat-0.006
+	z := math.Sqrt(x*x+y*y) - 0.00002*math.Sin(y*bdXPi)
+	theta := math.Atan2(y, x) - 0.000003*math.Cos(x*bdXPi)
+	g := Point{Lat: z * math.Sin(theta), Lng: z * math.Cos(theta)}
+	for i := 0; i < 10; i++ {
+		b := GCJ02ToBD09(g)
+		dLat, dLng := b.Lat-p.Lat, b.Lng-p.Lng
+		g.Lat -= dLat
+		g.Lng -= dLng
+		if math.Abs(dLat) < 1e-9 && math.Abs(dLng) < 1e-9 {
+			break
+		}
+	}
+	return g
+}
+
+// Convert 在坐标系之间转换，统一经由 GCJ-02 中转
+func Convert(p Point, from, to CRS) Point {
+	if from == to {
+		return p
+	}
+	switch from {
+	case WGS84:
+		p = WGS84ToGCJ02(p)
+	case BD09:
+		p = BD09ToGCJ02(p)
+	}
+	switch to {
+	case WGS84:
+		return GCJ02ToWGS84(p)
+	case BD09:
+		return GCJ02ToBD09(p)
+	}
+	return p
+}
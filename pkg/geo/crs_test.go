@@ -0,0 +1,152 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+// 经纬度 1e-9 度约为 0.1 毫米
+const coordEpsilon = 1e-9
+
+func near(a, b Point, epsilon float64) bool {
+	return math.Abs(a.Lat-b.Lat) <= epsilon && math.Abs(a.Lng-b.Lng) <= epsilon
+}
+
+func TestParseCRS(t *testing.T) {
+	tests := []struct {
+		in   string
+		want CRS
+	}{
+		{"wgs84", WGS84},
+		{"WGS-84", WGS84},
+		{"EPSG:4326", WGS84},
+		{" gps ", WGS84},
+		{"GCJ-02", GCJ02},
+		{"gcj_02", GCJ02},
+		{"amap", GCJ02},
+		{"BD-09", BD09},
+		{"bd09ll", BD09},
+		{"baidu", BD09},
+	}
+	for _, tt := range tests {
+		got, err := ParseCRS(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseCRS(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "epsg:3857", "mercator"} {
+		if _, err := ParseCRS(in); err == nil {
+			t.Errorf("ParseCRS(%q) succeeded, want error", in)
+		}
+	}
+}
+
+// 参考值与 coordtransform 等常用实现的结果一致（北京天安门附近）
+func TestConvertReferencePoints(t *testing.T) {
+	p := Point{Lat: 39.915, Lng: 116.404}
+	tests := []struct {
+		name string
+		got  Point
+		want Point
+	}{
+		{"WGS84ToGCJ02", WGS84ToGCJ02(p), Point{Lat: 39.91640428150164, Lng: 116.41024449916938}},
+		{"GCJ02ToBD09", GCJ02ToBD09(p), Point{Lat: 39.92133699351022, Lng: 116.41036949371030}},
+		{"Convert wgs84->bd09", Convert(p, WGS84, BD09), GCJ02ToBD09(WGS84ToGCJ02(p))},
+	}
+	for _, tt := range tests {
+		if !near(tt.got, tt.want, coordEpsilon) {
+			t.Errorf("%s(%v) = %v, want %v", tt.name, p, tt.got, tt.want)
+		}
+	}
+
+	// BD09ToGCJ02 迭代求精，与近似公式的结果相差不到 0.2 米
+	approx := Point{Lat: 39.90865673957631, Lng: 116.39762729119315}
+	if got := BD09ToGCJ02(p); Distance(got, approx) > 0.2 {
+		t.Errorf("BD09ToGCJ02(%v) = %v, %.3f m from %v", p, got, Distance(got, approx), approx)
+	}
+}
+
+// 中国境内 GCJ-02 的偏移在几十到几百米之间
+func TestWGS84ToGCJ02Offset(t *testing.T) {
+	for _, p := range []Point{
+		{Lat: 39.915, Lng: 116.404},   // 北京
+		{Lat: 31.2304, Lng: 121.4737}, // 上海
+		{Lat: 22.5431, Lng: 114.0579}, // 深圳
+		{Lat: 43.8256, Lng: 87.6168},  // 乌鲁木齐
+	} {
+		d := Distance(p, WGS84ToGCJ02(p))
+		if d < 50 || d > 1000 {
+			t.Errorf("WGS84ToGCJ02(%v) moved %.1f m, want 50~1000 m", p, d)
+		}
+	}
+}
+
+func TestConvertOutsideChina(t *testing.T) {
+	for _, p := range []Point{
+		{Lat: 51.5074, Lng: -0.1278},   // 伦敦
+		{Lat: 40.7128, Lng: -74.0060},  // 纽约
+		{Lat: -33.8688, Lng: 151.2093}, // 悉尼
+		{Lat: 35.6762, Lng: 139.6503},  // 东京
+		{Lat: 0, Lng: 0},
+	} {
+		if got := WGS84ToGCJ02(p); got != p {
+			t.Errorf("WGS84ToGCJ02(%v) = %v, want unchanged", p, got)
+		}
+		if got := GCJ02ToWGS84(p); got != p {
+			t.Errorf("GCJ02ToWGS84(%v) = %v, want unchanged", p, got)
+		}
+		if got := Convert(p, WGS84, GCJ02); got != p {
+			t.Errorf("Convert(%v, wgs84, gcj02) = %v, want unchanged", p, got)
+		}
+		// BD-09 在境外同样加偏，往返后应还原
+		if got := Convert(Convert(p, WGS84, BD09), BD09, WGS84); !near(got, p, 1e-8) {
+			t.Errorf("wgs84->bd09->wgs84(%v) = %v", p, got)
+		}
+	}
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	crss := []CRS{WGS84, GCJ02, BD09}
+	// 覆盖中国境内南北东西各处
+	var points []Point
+	for lat := 18.0; lat <= 53; lat += 5 {
+		for lng := 74.0; lng <= 135; lng += 6 {
+			points = append(points, Point{Lat: lat, Lng: lng})
+		}
+	}
+	for _, p := range points {
+		for _, from := range crss {
+			for _, to := range crss {
+				got := Convert(Convert(p, from, to), to, from)
+				// 逆变换迭代到 1e-9 度
+				if !near(got, p, 1e-8) {
+					t.Errorf("%s->%s->%s(%v) = %v, off by %.3f m", from, to, from, p, got, Distance(p, got))
+				}
+			}
+		}
+	}
+}
+
+func TestInversePrecision(t *testing.T) {
+	for _, p := range []Point{
+		{Lat: 39.915, Lng: 116.404},
+		{Lat: 31.2304, Lng: 121.4737},
+		{Lat: 29.6520, Lng: 91.1721},
+	} {
+		if d := Distance(p, GCJ02ToWGS84(WGS84ToGCJ02(p))); d > 0.01 {
+			t.Errorf("GCJ02ToWGS84(WGS84ToGCJ02(%v)) off by %.4f m, want < 1 cm", p, d)
+		}
+		if d := Distance(p, BD09ToGCJ02(GCJ02ToBD09(p))); d > 0.01 {
+			t.Errorf("BD09ToGCJ02(GCJ02ToBD09(%v)) off by %.4f m, want < 1 cm", p, d)
+		}
+	}
+}
+
+func TestConvertSameCRS(t *testing.T) {
+	p := Point{Lat: 39.915, Lng: 116.404}
+	for _, c := range []CRS{WGS84, GCJ02, BD09} {
+		if got := Convert(p, c, c); got != p {
+			t.Errorf("Convert(%v, %s, %s) = %v, want unchanged", p, c, c, got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package geo
+
+import "math"
+
+// EarthRadius 地球平均半径（米）
+const EarthRadius = 6371008.8
+
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+func toRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// Distance 使用 haversine 公式计算两点间的球面距离（米）
+func Distance(a, b Point) float64 {
+	dLat := toRad(b.Lat - a.Lat)
+	dLng := toRad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// project 以 origin 为原点做等距矩形投影，返回以米为单位的平面坐标
+func project(p, origin Point) (x, y float64) {
+	x = toRad(p.Lng-origin.Lng) * EarthRadius * math.Cos(toRad(origin.Lat))
+	y = toRad(p.Lat-origin.Lat) * EarthRadius
+	return x, y
+}
+
+// perpendicularDistance 计算 p 到线段 ab 的距离（米）
+func perpendicularDistance(p, a, b Point) float64 {
+	px, py := project(p, a)
+	bx, by := project(b, a)
+	lengthSq := bx*bx + by*by
+	if lengthSq == 0 {
+		return math.Hypot(px, py)
+	}
+	t := (px*bx + py*by) / lengthSq
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// Simplify 使用 Douglas–Peucker 算法抽稀折线，tolerance 为允许的最大偏差（米）
+func Simplify(points []Point, tolerance float64) []Point {
+	if len(points) < 3 || tolerance <= 0 {
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	// 用显式栈代替递归，避免超长轨迹导致栈过深
+	type span struct{ first, last int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		maxDist, index := 0.0, -1
+		for i := s.first + 1; i < s.last; i++ {
+			if d := perpendicularDistance(points[i], points[s.first], points[s.last]); d > maxDist {
+				maxDist, index = d, i
+			}
+		}
+		if index >= 0 && maxDist > tolerance {
+			keep[index] = true
+			stack = append(stack, span{s.first, index}, span{index, s.last})
+		}
+	}
+
+	result := make([]Point, 0, len(points))
+	for i, p := range points {
+		if keep[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// BoundingBox 返回以 center 为中心、半径 radius（米）的外接经纬度矩形
+func BoundingBox(center Point, radius float64) (sw, ne Point) {
+	dLat := radius / EarthRadius * 180 / math.Pi
+	dLng := 180.0
+	if cos := math.Cos(toRad(center.Lat)); cos > 1e-9 {
+		dLng = math.Min(180, dLat/cos)
+	}
+	sw = Point{Lat: math.Max(-90, center.Lat-dLat), Lng: math.Max(-180, center.Lng-dLng)}
+	ne = Point{Lat: math.Min(90, center.Lat+dLat), Lng: math.Min(180, center.Lng+dLng)}
+	return sw, ne
+}
+
+// TileSize Web 墨卡托瓦片的像素尺寸
+const TileSize = 256
+
+// maxMercatorLat Web 墨卡托投影可表示的最大纬度
+const maxMercatorLat = 85.05112878
+
+// MercatorPixel 返回点在指定缩放级别下的 Web 墨卡托全局像素坐标
+func MercatorPixel(p Point, zoom int) (x, y float64) {
+	lat := math.Max(-maxMercatorLat, math.Min(maxMercatorLat, p.Lat))
+	scale := TileSize * math.Exp2(float64(zoom))
+	x = (p.Lng + 180) / 360 * scale
+	sinLat := math.Sin(toRad(lat))
+	y = (0.5 - math.Log((1+sinLat)/(1-sinLat))/(4*math.Pi)) * scale
+	return x, y
+}
+
+// MercatorPoint 是 MercatorPixel 的逆运算，由全局像素坐标求经纬度
+func MercatorPoint(x, y float64, zoom int) Point {
+	scale := TileSize * math.Exp2(float64(zoom))
+	lng := x/scale*360 - 180
+	n := math.Pi * (1 - 2*y/scale)
+	lat := math.Atan(math.Sinh(n)) * 180 / math.Pi
+	return Point{Lat: lat, Lng: lng}
+}
@@ -0,0 +1,147 @@
+package geo
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+		tol  float64
+	}{
+		{"same point", Point{Lat: 39.9, Lng: 116.4}, Point{Lat: 39.9, Lng: 116.4}, 0, 0},
+		{"one degree of latitude", Point{Lat: 0, Lng: 0}, Point{Lat: 1, Lng: 0}, EarthRadius * math.Pi / 180, 1e-6},
+		{"beijing to shanghai", Point{Lat: 39.9042, Lng: 116.4074}, Point{Lat: 31.2304, Lng: 121.4737}, 1067e3, 2e3},
+		{"antipodal", Point{Lat: 0, Lng: 0}, Point{Lat: 0, Lng: 180}, math.Pi * EarthRadius, 1e-6},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); math.Abs(got-tt.want) > tt.tol {
+			t.Errorf("%s: Distance() = %.3f, want %.3f", tt.name, got, tt.want)
+		}
+		if got, back := Distance(tt.a, tt.b), Distance(tt.b, tt.a); got != back {
+			t.Errorf("%s: Distance() not symmetric: %v vs %v", tt.name, got, back)
+		}
+	}
+}
+
+// offset 返回 origin 向东 east 米、向北 north 米的点
+func offset(origin Point, east, north float64) Point {
+	return Point{
+		Lat: origin.Lat + north/EarthRadius*180/math.Pi,
+		Lng: origin.Lng + east/(EarthRadius*math.Cos(toRad(origin.Lat)))*180/math.Pi,
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	o := Point{Lat: 39.9, Lng: 116.4}
+	line := func(offsets ...[2]float64) []Point {
+		points := make([]Point, len(offsets))
+		for i, d := range offsets {
+			points[i] = offset(o, d[0], d[1])
+		}
+		return points
+	}
+
+	tests := []struct {
+		name      string
+		points    []Point
+		tolerance float64
+		keep      []int // 保留的点在输入中的下标
+	}{
+		{
+			name:      "too short",
+			points:    line([2]float64{0, 0}, [2]float64{100, 100}),
+			tolerance: 10,
+			keep:      []int{0, 1},
+		},
+		{
+			name:      "zero tolerance",
+			points:    line([2]float64{0, 0}, [2]float64{50, 1}, [2]float64{100, 0}),
+			tolerance: 0,
+			keep:      []int{0, 1, 2},
+		},
+		{
+			name:      "collinear",
+			points:    line([2]float64{0, 0}, [2]float64{100, 0}, [2]float64{200, 0}, [2]float64{300, 0}),
+			tolerance: 1,
+			keep:      []int{0, 3},
+		},
+		{
+			name:      "jitter within tolerance",
+			points:    line([2]float64{0, 0}, [2]float64{100, 3}, [2]float64{200, -4}, [2]float64{300, 2}, [2]float64{400, 0}),
+			tolerance: 5,
+			keep:      []int{0, 4},
+		},
+		{
+			name:      "peak kept",
+			points:    line([2]float64{0, 0}, [2]float64{100, 40}, [2]float64{200, 80}, [2]float64{300, 40}, [2]float64{400, 0}),
+			tolerance: 10,
+			keep:      []int{0, 2, 4},
+		},
+		{
+			name:      "corner",
+			points:    line([2]float64{0, 0}, [2]float64{100, 0}, [2]float64{200, 0}, [2]float64{200, 100}, [2]float64{200, 200}),
+			tolerance: 1,
+			keep:      []int{0, 2, 4},
+		},
+		{
+			name:      "deviation just below tolerance dropped",
+			points:    line([2]float64{0, 0}, [2]float64{100, 10}, [2]float64{200, 0}),
+			tolerance: 10.001,
+			keep:      []int{0, 2},
+		},
+		{
+			name:      "closed loop",
+			points:    line([2]float64{0, 0}, [2]float64{100, 0}, [2]float64{100, 100}, [2]float64{0, 100}, [2]float64{0, 0}),
+			tolerance: 1,
+			keep:      []int{0, 1, 2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := make([]Point, len(tt.keep))
+			for i, k := range tt.keep {
+				want[i] = tt.points[k]
+			}
+			if got := Simplify(tt.points, tt.tolerance); !reflect.DeepEqual(got, want) {
+				t.Errorf("Simplify() kept %d of %d points, want %v", len(got), len(tt.points), tt.keep)
+			}
+		})
+	}
+}
+
+func TestSimplifyLongTrack(t *testing.T) {
+	// 两万个点的正弦曲线（振幅 50 米、波长 1 千米），抽稀后每个原始点到所在线段的距离不超过容差
+	const n = 20000
+	o := Point{Lat: 30, Lng: 120}
+	points := make([]Point, n)
+	for i := range points {
+		x := float64(i)
+		points[i] = offset(o, x, 50*math.Sin(x/1000*2*math.Pi))
+	}
+	const tolerance = 5.0
+	got := Simplify(points, tolerance)
+	if len(got) >= n/10 || len(got) < 2 {
+		t.Fatalf("Simplify() kept %d of %d points", len(got), n)
+	}
+	if got[0] != points[0] || got[len(got)-1] != points[n-1] {
+		t.Error("Simplify() dropped an endpoint")
+	}
+
+	j := 0
+	for i, p := range points {
+		for j+1 < len(got)-1 && got[j+1] == points[i] {
+			j++
+		}
+		if p == got[j] {
+			continue
+		}
+		if d := perpendicularDistance(p, got[j], got[j+1]); d > tolerance+1e-6 {
+			t.Fatalf("point %d is %.2f m from the simplified track, want <= %v", i, d, tolerance)
+		}
+	}
+}
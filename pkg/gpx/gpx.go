@@ -0,0 +1,81 @@
+package gpx
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+const Namespace = "http://www.topografix.com/GPX/1/1"
+
+type GPX struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Xmlns     string     `xml:"xmlns,attr,omitempty"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Metadata  *Metadata  `xml:"metadata,omitempty"`
+	Waypoints []Waypoint `xml:"wpt"`
+	Routes    []Route    `xml:"rte"`
+	Tracks    []Track    `xml:"trk"`
+}
+
+type Metadata struct {
+	Name string `xml:"name,omitempty"`
+	Time string `xml:"time,omitempty"`
+}
+
+// Waypoint 对应 wptType，同样用于 rtept 和 trkpt
+type Waypoint struct {
+	Lat         float64  `xml:"lat,attr"`
+	Lon         float64  `xml:"lon,attr"`
+	Ele         *float64 `xml:"ele,omitempty"`
+	Time        string   `xml:"time,omitempty"`
+	Name        string   `xml:"name,omitempty"`
+	Comment     string   `xml:"cmt,omitempty"`
+	Description string   `xml:"desc,omitempty"`
+	Type        string   `xml:"type,omitempty"`
+}
+
+type Route struct {
+	Name        string     `xml:"name,omitempty"`
+	Description string     `xml:"desc,omitempty"`
+	Points      []Waypoint `xml:"rtept"`
+}
+
+type Track struct {
+	Name        string         `xml:"name,omitempty"`
+	Description string         `xml:"desc,omitempty"`
+	Segments    []TrackSegment `xml:"trkseg"`
+}
+
+type TrackSegment struct {
+	Points []Waypoint `xml:"trkpt"`
+}
+
+// Encode 输出带 XML 声明的 GPX 1.1 文档
+func Encode(w io.Writer, doc *GPX) error {
+	if doc.Xmlns == "" {
+		doc.Xmlns = Namespace
+	}
+	if doc.Version == "" {
+		doc.Version = "1.1"
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// Decode 解析 GPX 文档，兼容 1.0 和 1.1
+func Decode(r io.Reader) (*GPX, error) {
+	var doc GPX
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("解析GPX失败: %v", err)
+	}
+	return &doc, nil
+}
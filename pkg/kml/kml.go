@@ -0,0 +1,271 @@
+package kml
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const Namespace = "http://www.opengis.net/kml/2.2"
+
+// DocFile KMZ 中主 KML 文件的名称
+const DocFile = "doc.kml"
+
+type KML struct {
+	XMLName  xml.Name `xml:"kml"`
+	Xmlns    string   `xml:"xmlns,attr,omitempty"`
+	Document Document `xml:"Document"`
+}
+
+type Document struct {
+	Name       string      `xml:"name,omitempty"`
+	Styles     []Style     `xml:"Style"`
+	Folders    []Folder    `xml:"Folder"`
+	Placemarks []Placemark `xml:"Placemark"`
+}
+
+type Folder struct {
+	Name       string      `xml:"name,omitempty"`
+	Folders    []Folder    `xml:"Folder"`
+	Placemarks []Placemark `xml:"Placemark"`
+}
+
+type Style struct {
+	ID        string     `xml:"id,attr,omitempty"`
+	IconStyle *IconStyle `xml:"IconStyle,omitempty"`
+	LineStyle *LineStyle `xml:"LineStyle,omitempty"`
+}
+
+type IconStyle struct {
+	Color string `xml:"color,omitempty"`
+	Scale string `xml:"scale,omitempty"`
+}
+
+type LineStyle struct {
+	Color string `xml:"color,omitempty"`
+	Width string `xml:"width,omitempty"`
+}
+
+type Placemark struct {
+	Name          string         `xml:"name,omitempty"`
+	Description   string         `xml:"description,omitempty"`
+	StyleURL      string         `xml:"styleUrl,omitempty"`
+	ExtendedData  *ExtendedData  `xml:"ExtendedData,omitempty"`
+	Point         *Point         `xml:"Point,omitempty"`
+	LineString    *LineString    `xml:"LineString,omitempty"`
+	MultiGeometry *MultiGeometry `xml:"MultiGeometry,omitempty"`
+}
+
+type ExtendedData struct {
+	Data []Data `xml:"Data"`
+}
+
+type Data struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type Point struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type LineString struct {
+	Tessellate  int    `xml:"tessellate,omitempty"`
+	Coordinates string `xml:"coordinates"`
+}
+
+type MultiGeometry struct {
+	Points      []Point      `xml:"Point"`
+	LineStrings []LineString `xml:"LineString"`
+}
+
+// Coordinate 经纬度坐标，顺序与 KML 一致（经度在前）
+type Coordinate struct {
+	Longitude float64
+	Latitude  float64
+}
+
+// Get 读取扩展数据中指定名称的值
+func (p *Placemark) Get(name string) (string, bool) {
+	if p.ExtendedData == nil {
+		return "", false
+	}
+	for _, d := range p.ExtendedData.Data {
+		if d.Name == name {
+			return d.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set 设置扩展数据
+func (p *Placemark) Set(name, value string) {
+	if p.ExtendedData == nil {
+		p.ExtendedData = &ExtendedData{}
+	}
+	p.ExtendedData.Data = append(p.ExtendedData.Data, Data{Name: name, Value: value})
+}
+
+// AllPlacemarks 递归收集文档及其文件夹中的所有地标
+func (d *Document) AllPlacemarks() []Placemark {
+	result := append([]Placemark{}, d.Placemarks...)
+	var walk func(folders []Folder)
+	walk = func(folders []Folder) {
+		for _, f := range folders {
+			result = append(result, f.Placemarks...)
+			walk(f.Folders)
+		}
+	}
+	walk(d.Folders)
+	return result
+}
+
+// FormatCoordinates 将坐标格式化为 KML coordinates 文本
+func FormatCoordinates(coords []Coordinate) string {
+	parts := make([]string, 0, len(coords))
+	for _, c := range coords {
+		parts = append(parts, fmt.Sprintf("%.7f,%.7f,0", c.Longitude, c.Latitude))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseCoordinates 解析 KML coordinates 文本（lng,lat[,alt] 以空白分隔）
+func ParseCoordinates(s string) ([]Coordinate, error) {
+	var coords []Coordinate
+	for _, tuple := range strings.Fields(s) {
+		parts := strings.Split(tuple, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("无效的坐标: %s", tuple)
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("无效的经度: %s", parts[0])
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("无效的纬度: %s", parts[1])
+		}
+		coords = append(coords, Coordinate{Longitude: lng, Latitude: lat})
+	}
+	return coords, nil
+}
+
+// Color 将 #RRGGBB 颜色转换为 KML 的 aabbggrr 格式
+func Color(hex string) string {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return "ffffffff"
+	}
+	return strings.ToLower("ff" + hex[4:6] + hex[2:4] + hex[0:2])
+}
+
+// HexColor 将 KML 的 aabbggrr 颜色转换为 #RRGGBB 格式
+func HexColor(kmlColor string) string {
+	if len(kmlColor) != 8 {
+		return ""
+	}
+	return strings.ToUpper("#" + kmlColor[6:8] + kmlColor[4:6] + kmlColor[2:4])
+}
+
+// Encode 输出带 XML 声明的 KML 文档
+func Encode(w io.Writer, doc *KML) error {
+	if doc.Xmlns == "" {
+		doc.Xmlns = Namespace
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// Decode 解析 KML 文档
+func Decode(r io.Reader) (*KML, error) {
+	var doc KML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("解析KML失败: %v", err)
+	}
+	return &doc, nil
+}
+
+// ErrKMZTooLarge KMZ 解压后的总大小超过上限
+var ErrKMZTooLarge = errors.New("KMZ解压后超过大小上限")
+
+// ReadKMZ 解析 KMZ 压缩包，返回 KML 文档和包内其它文件（按包内路径索引）。
+// 解压后的总大小不能超过 maxSize，超过时返回 ErrKMZTooLarge
+func ReadKMZ(data []byte, maxSize int64) (*KML, map[string][]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析KMZ失败: %v", err)
+	}
+
+	var doc *KML
+	files := make(map[string][]byte)
+	remaining := maxSize
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		// 文件头中的大小可以伪造，读取时仍按剩余额度限制
+		if f.UncompressedSize64 > uint64(remaining) {
+			return nil, nil, ErrKMZTooLarge
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := io.ReadAll(io.LimitReader(rc, remaining+1))
+		rc.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if int64(len(content)) > remaining {
+			return nil, nil, ErrKMZTooLarge
+		}
+		remaining -= int64(len(content))
+		// 规范要求使用第一个 .kml 文件作为主文档
+		if doc == nil && strings.HasSuffix(strings.ToLower(f.Name), ".kml") {
+			if doc, err = Decode(bytes.NewReader(content)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		files[f.Name] = content
+	}
+	if doc == nil {
+		return nil, nil, fmt.Errorf("KMZ中没有KML文件")
+	}
+	return doc, files, nil
+}
+
+// IsKMZ 根据 zip 文件头判断数据是否为 KMZ
+func IsKMZ(data []byte) bool {
+	return len(data) >= 4 && bytes.Equal(data[:4], []byte("PK\x03\x04"))
+}
+
+var imgSrcPattern = regexp.MustCompile(`(?i)<img[^>]+src\s*=\s*["']([^"']+)["']`)
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// ImageSources 提取描述 HTML 中引用的图片地址
+func ImageSources(description string) []string {
+	var srcs []string
+	for _, m := range imgSrcPattern.FindAllStringSubmatch(description, -1) {
+		srcs = append(srcs, m[1])
+	}
+	return srcs
+}
+
+// PlainText 去除描述中的 HTML 标签
+func PlainText(description string) string {
+	return strings.TrimSpace(tagPattern.ReplaceAllString(description, ""))
+}
@@ -12,7 +12,14 @@ import (
 
 var Log *zap.Logger
 
-func InitLogger(logFile string, level string) error {
+// defaultMaxAge 轮转后的日志文件默认保留天数
+const defaultMaxAge = 7
+
+// file 当前的日志文件，供 Rotate 使用
+var file *lumberjack.Logger
+
+// InitLogger 初始化日志。轮转后的日志文件保留 maxAge 天，不大于 0 或超过 defaultMaxAge 时保留 defaultMaxAge 天
+func InitLogger(logFile string, level string, maxAge int) error {
 	// 创建日志目录
 	logDir := filepath.Dir(logFile)
 	if err := os.MkdirAll(logDir, 0755); err != nil {
@@ -49,18 +56,23 @@ func InitLogger(logFile string, level string) error {
 		EncodeCaller:   zapcore.ShortCallerEncoder,
 	}
 
+	if maxAge <= 0 || maxAge > defaultMaxAge {
+		maxAge = defaultMaxAge
+	}
+	file = &lumberjack.Logger{
+		Filename:   logFile,
+		MaxSize:    100, // MB
+		MaxBackups: 30,
+		MaxAge:     maxAge, // days
+		Compress:   true,
+	}
+
 	// 创建核心
 	core := zapcore.NewCore(
 		zapcore.NewJSONEncoder(encoderConfig),
 		zapcore.NewMultiWriteSyncer(
 			zapcore.AddSync(os.Stdout),
-			zapcore.AddSync(&lumberjack.Logger{
-				Filename:   logFile,
-				MaxSize:    100, // MB
-				MaxBackups: 30,
-				MaxAge:     7, // days
-				Compress:   true,
-			}),
+			zapcore.AddSync(file),
 		),
 		logLevel,
 	)
@@ -69,3 +81,11 @@ func InitLogger(logFile string, level string) error {
 	Log = zap.New(core, zap.AddCaller())
 	return nil
 }
+
+// Rotate 轮转当前的日志文件，并删除超过保留天数的旧文件
+func Rotate() error {
+	if file == nil {
+		return nil
+	}
+	return file.Rotate()
+}
@@ -0,0 +1,212 @@
+// Package mvt 实现 Mapbox Vector Tile 2.1 的编码（仅点和线）
+package mvt
+
+import (
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultExtent 瓦片内坐标的默认范围
+const DefaultExtent = 4096
+
+// GeomType 要素几何类型
+type GeomType int
+
+const (
+	Point      GeomType = 1
+	LineString GeomType = 2
+)
+
+// 几何指令
+const (
+	cmdMoveTo = 1
+	cmdLineTo = 2
+)
+
+// Feature 瓦片要素，坐标为瓦片内坐标。点要素的 Geometry 只有一组（可含多个点），
+// 线要素每组为一条线
+type Feature struct {
+	ID         uint64
+	Type       GeomType
+	Geometry   [][][2]int32
+	Properties map[string]interface{}
+}
+
+type Layer struct {
+	Name     string
+	Extent   uint32
+	Features []Feature
+}
+
+// Encode 将图层编码为 MVT 二进制数据，属性按名称排序以保证相同输入的输出一致
+func Encode(layers []Layer) []byte {
+	var tile []byte
+	for i := range layers {
+		tile = protowire.AppendTag(tile, 3, protowire.BytesType)
+		tile = protowire.AppendBytes(tile, encodeLayer(&layers[i]))
+	}
+	return tile
+}
+
+func encodeLayer(l *Layer) []byte {
+	extent := l.Extent
+	if extent == 0 {
+		extent = DefaultExtent
+	}
+
+	var keys []string
+	var values []interface{}
+	keyIndex := make(map[string]uint64)
+	valueIndex := make(map[interface{}]uint64)
+
+	var b []byte
+	b = protowire.AppendTag(b, 15, protowire.VarintType)
+	b = protowire.AppendVarint(b, 2)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, l.Name)
+
+	for _, f := range l.Features {
+		names := make([]string, 0, len(f.Properties))
+		for name, v := range f.Properties {
+			if normalizeValue(v) != nil {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		var tags []uint64
+		for _, name := range names {
+			k, ok := keyIndex[name]
+			if !ok {
+				k = uint64(len(keys))
+				keyIndex[name] = k
+				keys = append(keys, name)
+			}
+			v := normalizeValue(f.Properties[name])
+			vi, ok := valueIndex[v]
+			if !ok {
+				vi = uint64(len(values))
+				valueIndex[v] = vi
+				values = append(values, v)
+			}
+			tags = append(tags, k, vi)
+		}
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeFeature(&f, tags))
+	}
+
+	for _, k := range keys {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, k)
+	}
+	for _, v := range values {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeValue(v))
+	}
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(extent))
+	return b
+}
+
+func encodeFeature(f *Feature, tags []uint64) []byte {
+	var b []byte
+	if f.ID != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, f.ID)
+	}
+	if len(tags) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, packVarints(tags))
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(f.Type))
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, packVarints(encodeGeometry(f)))
+	return b
+}
+
+// encodeGeometry 生成几何指令序列，坐标为相对上一个点的 zigzag 增量
+func encodeGeometry(f *Feature) []uint64 {
+	var cmds []uint64
+	var cx, cy int32
+	appendPoints := func(points [][2]int32) {
+		for _, p := range points {
+			cmds = append(cmds, zigzag(p[0]-cx), zigzag(p[1]-cy))
+			cx, cy = p[0], p[1]
+		}
+	}
+
+	switch f.Type {
+	case Point:
+		var points [][2]int32
+		for _, g := range f.Geometry {
+			points = append(points, g...)
+		}
+		cmds = append(cmds, command(cmdMoveTo, len(points)))
+		appendPoints(points)
+	case LineString:
+		for _, line := range f.Geometry {
+			if len(line) < 2 {
+				continue
+			}
+			cmds = append(cmds, command(cmdMoveTo, 1))
+			appendPoints(line[:1])
+			cmds = append(cmds, command(cmdLineTo, len(line)-1))
+			appendPoints(line[1:])
+		}
+	}
+	return cmds
+}
+
+func command(id, count int) uint64 {
+	return uint64(id&0x7) | uint64(count)<<3
+}
+
+func zigzag(n int32) uint64 {
+	return protowire.EncodeZigZag(int64(n))
+}
+
+func packVarints(values []uint64) []byte {
+	var b []byte
+	for _, v := range values {
+		b = protowire.AppendVarint(b, v)
+	}
+	return b
+}
+
+// normalizeValue 将属性值统一为 string、float64、int64、bool 之一，不支持的类型返回 nil
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, float64, int64, bool:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	}
+	return nil
+}
+
+func encodeValue(v interface{}) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case float64:
+		b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case int64:
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+	case bool:
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	}
+	return b
+}
@@ -0,0 +1,216 @@
+package mvt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestZigzag(t *testing.T) {
+	tests := []struct {
+		n    int32
+		want uint64
+	}{
+		{0, 0},
+		{-1, 1},
+		{1, 2},
+		{-2, 3},
+		{2, 4},
+		{2147483647, 4294967294},
+		{-2147483648, 4294967295},
+	}
+	for _, tt := range tests {
+		if got := zigzag(tt.n); got != tt.want {
+			t.Errorf("zigzag(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		id, count int
+		want      uint64
+	}{
+		{cmdMoveTo, 1, 9},
+		{cmdLineTo, 1, 10},
+		{cmdLineTo, 3, 26},
+		{cmdMoveTo, 120, 961},
+	}
+	for _, tt := range tests {
+		if got := command(tt.id, tt.count); got != tt.want {
+			t.Errorf("command(%d, %d) = %d, want %d", tt.id, tt.count, got, tt.want)
+		}
+	}
+}
+
+// 期望值取自 MVT 2.1 规范 4.3.5 节的示例
+func TestEncodeGeometry(t *testing.T) {
+	tests := []struct {
+		name    string
+		feature Feature
+		want    []uint64
+	}{
+		{
+			name:    "point",
+			feature: Feature{Type: Point, Geometry: [][][2]int32{{{25, 17}}}},
+			want:    []uint64{9, 50, 34},
+		},
+		{
+			name:    "multi point",
+			feature: Feature{Type: Point, Geometry: [][][2]int32{{{5, 7}, {3, 2}}}},
+			want:    []uint64{17, 10, 14, 3, 9},
+		},
+		{
+			name:    "line",
+			feature: Feature{Type: LineString, Geometry: [][][2]int32{{{2, 2}, {2, 10}, {10, 10}}}},
+			want:    []uint64{9, 4, 4, 18, 0, 16, 16, 0},
+		},
+		{
+			name: "multi line",
+			feature: Feature{Type: LineString, Geometry: [][][2]int32{
+				{{2, 2}, {2, 10}, {10, 10}},
+				{{1, 1}, {3, 5}},
+			}},
+			want: []uint64{9, 4, 4, 18, 0, 16, 16, 0, 9, 17, 17, 10, 4, 8},
+		},
+		{
+			name: "degenerate line skipped",
+			feature: Feature{Type: LineString, Geometry: [][][2]int32{
+				{{7, 7}},
+				{{2, 2}, {2, 10}},
+			}},
+			want: []uint64{9, 4, 4, 10, 0, 16},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeGeometry(&tt.feature); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodeGeometry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want interface{}
+	}{
+		{"a", "a"},
+		{1.5, 1.5},
+		{float32(0.5), 0.5},
+		{3, int64(3)},
+		{int32(-4), int64(-4)},
+		{true, true},
+		{nil, nil},
+		{[]int{1}, nil},
+	}
+	for _, tt := range tests {
+		if got := normalizeValue(tt.in); got != tt.want {
+			t.Errorf("normalizeValue(%#v) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// decodedLayer 测试中解析出的图层
+type decodedLayer struct {
+	version  uint64
+	name     string
+	extent   uint64
+	keys     []string
+	values   int
+	features int
+}
+
+func decodeFields(t *testing.T, b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		n = fn(num, typ, b)
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+}
+
+func decodeTile(t *testing.T, data []byte) []decodedLayer {
+	t.Helper()
+	var layers []decodedLayer
+	decodeFields(t, data, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 3 || typ != protowire.BytesType {
+			t.Fatalf("unexpected tile field %d", num)
+		}
+		v, n := protowire.ConsumeBytes(b)
+		var l decodedLayer
+		decodeFields(t, v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+			switch num {
+			case 15:
+				x, n := protowire.ConsumeVarint(b)
+				l.version = x
+				return n
+			case 1:
+				s, n := protowire.ConsumeString(b)
+				l.name = s
+				return n
+			case 2:
+				l.features++
+			case 3:
+				s, n := protowire.ConsumeString(b)
+				l.keys = append(l.keys, s)
+				return n
+			case 4:
+				l.values++
+			case 5:
+				x, n := protowire.ConsumeVarint(b)
+				l.extent = x
+				return n
+			}
+			return protowire.ConsumeFieldValue(num, typ, b)
+		})
+		layers = append(layers, l)
+		return n
+	})
+	return layers
+}
+
+func TestEncode(t *testing.T) {
+	layers := []Layer{
+		{
+			Name: "markers",
+			Features: []Feature{
+				{ID: 1, Type: Point, Geometry: [][][2]int32{{{1, 2}}}, Properties: map[string]interface{}{"status": "ok", "value": 1.0}},
+				{ID: 2, Type: Point, Geometry: [][][2]int32{{{3, 4}}}, Properties: map[string]interface{}{"value": 1.0, "color": "#409EFF", "skip": nil}},
+			},
+		},
+		{
+			Name:     "trajectories",
+			Extent:   512,
+			Features: []Feature{{ID: 3, Type: LineString, Geometry: [][][2]int32{{{0, 0}, {5, 5}}}}},
+		},
+	}
+
+	data := Encode(layers)
+	got := decodeTile(t, data)
+	want := []decodedLayer{
+		// 相同的值只保存一次，属性名按首次出现的顺序（同一要素内按名称排序）
+		{version: 2, name: "markers", extent: DefaultExtent, keys: []string{"status", "value", "color"}, values: 3, features: 2},
+		{version: 2, name: "trajectories", extent: 512, features: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Encode() layers = %+v, want %+v", got, want)
+	}
+
+	// map 的遍历顺序随机，多次编码验证输出一致
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(Encode(layers), data) {
+			t.Fatal("Encode() output differs between calls")
+		}
+	}
+}
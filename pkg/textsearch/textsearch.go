@@ -0,0 +1,141 @@
+// Package textsearch 提供中文文本的拼音转换和搜索结果高亮
+package textsearch
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/mozillazg/go-pinyin"
+)
+
+var pinyinArgs = pinyin.NewArgs()
+
+// syllables 返回每个字符对应的检索单元：汉字为拼音（多音字取第一个读音），
+// 字母和数字为其小写形式，空白和标点为空串
+func syllables(runes []rune) []string {
+	result := make([]string, len(runes))
+	for i, r := range runes {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			if py := pinyin.SinglePinyin(r, pinyinArgs); len(py) > 0 {
+				result[i] = py[0]
+			}
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			result[i] = string(unicode.ToLower(r))
+		}
+	}
+	return result
+}
+
+func initials(syllables []string) []string {
+	result := make([]string, len(syllables))
+	for i, s := range syllables {
+		if s != "" {
+			result[i] = s[:1]
+		}
+	}
+	return result
+}
+
+// Pinyin 返回文本的全拼，音节之间不加分隔符，如 "图书馆" → "tushuguan"
+func Pinyin(s string) string {
+	return strings.Join(syllables([]rune(s)), "")
+}
+
+// Initials 返回文本的拼音首字母，如 "图书馆" → "tsg"
+func Initials(s string) string {
+	return strings.Join(initials(syllables([]rune(s))), "")
+}
+
+// NormalizeQuery 将查询转换为与 Pinyin、Initials 结果比较的形式：小写并去掉空白和标点
+func NormalizeQuery(q string) string {
+	return Pinyin(q)
+}
+
+// Highlight 在 text 中查找 query 并返回带 <mark> 标记的片段，依次尝试原文、全拼和拼音首字母匹配。
+// 片段前后各保留 context 个字符，文本已做 HTML 转义。未匹配时 ok 为 false
+func Highlight(text, query string, context int) (snippet string, ok bool) {
+	runes := []rune(text)
+	start, end, ok := matchText(runes, []rune(strings.ToLower(query)))
+	if !ok {
+		if q := NormalizeQuery(query); q != "" {
+			syl := syllables(runes)
+			start, end, ok = matchSyllables(syl, q)
+			if !ok {
+				start, end, ok = matchSyllables(initials(syl), q)
+			}
+		}
+	}
+	if !ok {
+		return "", false
+	}
+
+	from, to := start-context, end+context
+	var b strings.Builder
+	if from <= 0 {
+		from = 0
+	} else {
+		b.WriteString("…")
+	}
+	if to > len(runes) {
+		to = len(runes)
+	}
+	b.WriteString(html.EscapeString(string(runes[from:start])))
+	b.WriteString("<mark>")
+	b.WriteString(html.EscapeString(string(runes[start:end])))
+	b.WriteString("</mark>")
+	b.WriteString(html.EscapeString(string(runes[end:to])))
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// matchText 不区分大小写查找子串，返回字符下标范围
+func matchText(text, query []rune) (int, int, bool) {
+	if len(query) == 0 {
+		return 0, 0, false
+	}
+	for i := 0; i+len(query) <= len(text); i++ {
+		matched := true
+		for j, r := range query {
+			if unicode.ToLower(text[i+j]) != r {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i, i + len(query), true
+		}
+	}
+	return 0, 0, false
+}
+
+// matchSyllables 在检索单元拼接成的串中查找 query，匹配须从某个字符的检索单元开头开始，
+// 可以结束在检索单元中间（输入到一半的拼音），返回覆盖的字符下标范围
+func matchSyllables(syllables []string, query string) (int, int, bool) {
+	for i := range syllables {
+		if syllables[i] == "" {
+			continue
+		}
+		rest := query
+		for j := i; j < len(syllables); j++ {
+			s := syllables[j]
+			if s == "" {
+				continue
+			}
+			if len(rest) <= len(s) {
+				if strings.HasPrefix(s, rest) {
+					return i, j + 1, true
+				}
+				break
+			}
+			if !strings.HasPrefix(rest, s) {
+				break
+			}
+			rest = rest[len(s):]
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,119 @@
+// Package useragent 从 User-Agent 字符串粗略识别设备类型、浏览器和操作系统，用于访问统计
+package useragent
+
+import "strings"
+
+// 设备类型
+const (
+	Desktop = "desktop"
+	Mobile  = "mobile"
+	Tablet  = "tablet"
+	Bot     = "bot"
+	Unknown = "unknown"
+)
+
+// Info User-Agent 的识别结果，无法识别的字段为 Unknown
+type Info struct {
+	Device  string
+	Browser string
+	OS      string
+}
+
+// rule 在 User-Agent（小写）中包含 token 时识别为 name，按顺序匹配第一个
+type rule struct {
+	token string
+	name  string
+}
+
+// botTokens 爬虫、监控和命令行工具常见的 User-Agent 片段
+var botTokens = []string{
+	"bot", "crawler", "spider", "slurp", "crawl", "headless", "lighthouse",
+	"curl", "wget", "python-requests", "python-urllib", "go-http-client", "java/", "okhttp",
+	"httpclient", "postman", "insomnia", "apache-httpclient", "libwww-perl", "scrapy",
+	"prometheus", "uptimerobot", "pingdom", "kube-probe", "elb-healthchecker",
+}
+
+// notBotTokens 包含 bot 但不是程序的片段（如手机品牌 CUBOT），匹配 botTokens 前去掉
+var notBotTokens = []string{"cubot"}
+
+// browserRules 识别浏览器，基于 Chromium 的浏览器和内置浏览器需排在 Chrome 和 Safari 之前
+var browserRules = []rule{
+	{"micromessenger", "WeChat"},
+	{"dingtalk", "DingTalk"},
+	{" qq/", "QQ"},
+	{"mqqbrowser", "QQ Browser"},
+	{"ucbrowser", "UC Browser"},
+	{"edg", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"samsungbrowser", "Samsung Internet"},
+	{"miuibrowser", "MIUI Browser"},
+	{"huaweibrowser", "Huawei Browser"},
+	{"firefox", "Firefox"},
+	{"fxios", "Firefox"},
+	{"crios", "Chrome"},
+	{"chrome", "Chrome"},
+	{"safari", "Safari"},
+	{"msie", "Internet Explorer"},
+	{"trident/", "Internet Explorer"},
+}
+
+// osRules 识别操作系统，iOS 和 Android 需排在 macOS 和 Linux 之前
+var osRules = []rule{
+	{"harmonyos", "HarmonyOS"},
+	{"android", "Android"},
+	{"iphone", "iOS"},
+	{"ipad", "iOS"},
+	{"ipod", "iOS"},
+	{"windows", "Windows"},
+	{"mac os x", "macOS"},
+	{"macintosh", "macOS"},
+	{"cros", "ChromeOS"},
+	{"linux", "Linux"},
+}
+
+func match(ua string, rules []rule) string {
+	for _, r := range rules {
+		if strings.Contains(ua, r.token) {
+			return r.name
+		}
+	}
+	return Unknown
+}
+
+// IsBot 判断 User-Agent 是否来自爬虫或程序，空的 User-Agent 也视为程序
+func IsBot(userAgent string) bool {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if ua == "" {
+		return true
+	}
+	for _, token := range notBotTokens {
+		ua = strings.ReplaceAll(ua, token, "")
+	}
+	for _, token := range botTokens {
+		if strings.Contains(ua, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse 识别 User-Agent 的设备类型、浏览器和操作系统
+func Parse(userAgent string) Info {
+	ua := strings.ToLower(userAgent)
+	info := Info{Browser: match(ua, browserRules), OS: match(ua, osRules)}
+	switch {
+	case IsBot(userAgent):
+		info.Device = Bot
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		(strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		info.Device = Tablet
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "ipod"):
+		info.Device = Mobile
+	case info.OS == Unknown:
+		info.Device = Unknown
+	default:
+		info.Device = Desktop
+	}
+	return info
+}
@@ -0,0 +1,172 @@
+package useragent
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want Info
+	}{
+		{
+			name: "chrome windows",
+			ua:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			want: Info{Desktop, "Chrome", "Windows"},
+		},
+		{
+			name: "edge windows",
+			ua:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.51",
+			want: Info{Desktop, "Edge", "Windows"},
+		},
+		{
+			name: "firefox linux",
+			ua:   "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+			want: Info{Desktop, "Firefox", "Linux"},
+		},
+		{
+			name: "safari macos",
+			ua:   "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4.1 Safari/605.1.15",
+			want: Info{Desktop, "Safari", "macOS"},
+		},
+		{
+			name: "opera macos",
+			ua:   "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/123.0.0.0 Safari/537.36 OPR/109.0.0.0",
+			want: Info{Desktop, "Opera", "macOS"},
+		},
+		{
+			name: "internet explorer 11",
+			ua:   "Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko",
+			want: Info{Desktop, "Internet Explorer", "Windows"},
+		},
+		{
+			name: "chromebook",
+			ua:   "Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			want: Info{Desktop, "Chrome", "ChromeOS"},
+		},
+		{
+			name: "safari iphone",
+			ua:   "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			want: Info{Mobile, "Safari", "iOS"},
+		},
+		{
+			name: "chrome iphone",
+			ua:   "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/124.0.6367.88 Mobile/15E148 Safari/604.1",
+			want: Info{Mobile, "Chrome", "iOS"},
+		},
+		{
+			name: "wechat iphone",
+			ua:   "Mozilla/5.0 (iPhone; CPU iPhone OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 MicroMessenger/8.0.47(0x18002f2c) NetType/WIFI Language/zh_CN",
+			want: Info{Mobile, "WeChat", "iOS"},
+		},
+		{
+			name: "safari ipad",
+			ua:   "Mozilla/5.0 (iPad; CPU OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			want: Info{Tablet, "Safari", "iOS"},
+		},
+		{
+			name: "chrome android phone",
+			ua:   "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+			want: Info{Mobile, "Chrome", "Android"},
+		},
+		{
+			name: "android tablet",
+			ua:   "Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			want: Info{Tablet, "Chrome", "Android"},
+		},
+		{
+			name: "samsung internet",
+			ua:   "Mozilla/5.0 (Linux; Android 14; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/24.0 Chrome/117.0.0.0 Mobile Safari/537.36",
+			want: Info{Mobile, "Samsung Internet", "Android"},
+		},
+		{
+			name: "uc browser",
+			ua:   "Mozilla/5.0 (Linux; U; Android 10; zh-CN; V1990A) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/78.0.3904.108 UCBrowser/13.4.0.1306 Mobile Safari/537.36",
+			want: Info{Mobile, "UC Browser", "Android"},
+		},
+		{
+			name: "huawei harmonyos",
+			ua:   "Mozilla/5.0 (Linux; Android 12; HarmonyOS; NOH-AN00) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/99.0.4844.88 HuaweiBrowser/14.0.5.302 Mobile Safari/537.36",
+			want: Info{Mobile, "Huawei Browser", "HarmonyOS"},
+		},
+		{
+			name: "cubot phone is not a bot",
+			ua:   "Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+			want: Info{Mobile, "Chrome", "Android"},
+		},
+		{
+			name: "googlebot",
+			ua:   "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want: Info{Bot, Unknown, Unknown},
+		},
+		{
+			name: "baiduspider",
+			ua:   "Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)",
+			want: Info{Bot, Unknown, Unknown},
+		},
+		{
+			name: "googlebot smartphone",
+			ua:   "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want: Info{Bot, "Chrome", "Android"},
+		},
+		{
+			name: "curl",
+			ua:   "curl/8.4.0",
+			want: Info{Bot, Unknown, Unknown},
+		},
+		{
+			name: "empty",
+			ua:   "",
+			want: Info{Bot, Unknown, Unknown},
+		},
+		{
+			name: "unrecognised",
+			ua:   "SomeApp/1.0",
+			want: Info{Unknown, Unknown, Unknown},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.ua); got != tt.want {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsBot(t *testing.T) {
+	bots := []string{
+		"",
+		"   ",
+		"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)",
+		"Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)",
+		"Mozilla/5.0 (Linux; Android 5.0) AppleWebKit/537.36 (KHTML, like Gecko) Mobile Safari/537.36 (compatible; Bytespider; spider-feedback@bytedance.com)",
+		"Sogou web spider/4.0(+http://www.sogou.com/docs/help/webmasters.htm#07)",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.1 Safari/605.1.15 (Applebot/0.1; +http://www.apple.com/go/applebot)",
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/124.0.0.0 Safari/537.36",
+		"Wget/1.21.4",
+		"python-requests/2.31.0",
+		"Go-http-client/1.1",
+		"okhttp/4.12.0",
+		"Java/17.0.2",
+		"PostmanRuntime/7.37.3",
+		"Prometheus/2.51.0",
+		"kube-probe/1.29",
+		"ELB-HealthChecker/2.0",
+	}
+	for _, ua := range bots {
+		if !IsBot(ua) {
+			t.Errorf("IsBot(%q) = false, want true", ua)
+		}
+	}
+
+	browsers := []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+	}
+	for _, ua := range browsers {
+		if IsBot(ua) {
+			t.Errorf("IsBot(%q) = true, want false", ua)
+		}
+	}
+}
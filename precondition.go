@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// anyVersion 表示客户端使用 If-Match: * 跳过版本检查
+const anyVersion = 0
+
+var (
+	errMarkerNotFound   = apierror.New(apierror.MarkerNotFound)
+	errVersionConflict  = apierror.New(apierror.VersionConflict)
+	errExternalKeyTaken = apierror.New(apierror.ExternalKeyTaken)
+)
+
+// missingMarkerError 条件写入未命中时区分标记点已被删除还是版本不一致
+func missingMarkerError(db queryExecer, id string) error {
+	var exists bool
+	if err := db.QueryRow("SELECT COUNT(*) > 0 FROM markers WHERE id = ?", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return errVersionConflict
+	}
+	return errMarkerNotFound
+}
+
+// markerETag 标记点的 ETag，取自版本号
+func markerETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// versionCondition 返回限定版本号的 SQL 条件，expected 为 anyVersion 时不限定
+func versionCondition(expected int) (string, []interface{}) {
+	return "(? = 0 OR version = ?)", []interface{}{expected, expected}
+}
+
+// expectedVersion 读取客户端修改时所基于的版本：优先取 If-Match 请求头，其次取请求体或查询参数中的 version。
+// 都未提供时返回 428，格式错误时返回 400，ok 为 false 表示已写入响应
+func (app *App) expectedVersion(c *gin.Context, bodyVersion int) (version int, ok bool) {
+	if header := strings.TrimSpace(c.GetHeader("If-Match")); header != "" {
+		if header == "*" {
+			return anyVersion, true
+		}
+		v, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+		if err != nil || v <= 0 {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "If-Match"))
+			return 0, false
+		}
+		return v, true
+	}
+	if bodyVersion > 0 {
+		return bodyVersion, true
+	}
+	if v := c.Query("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "version"))
+			return 0, false
+		}
+		return n, true
+	}
+	app.respondError(c, http.StatusPreconditionRequired, apierror.New(apierror.PreconditionRequired))
+	return 0, false
+}
+
+// respondVersionConflict 条件更新未命中时调用：标记点已不存在返回 404，
+// 否则返回 412 和服务器当前数据，客户端可据此合并后重试
+func (app *App) respondVersionConflict(c *gin.Context, id string, crs geo.CRS) {
+	current, err := app.loadMarker(c.Request.Context(), id)
+	if err != nil {
+		app.internalError(c, "查询标记点失败", zap.Error(err), zap.String("id", id))
+		return
+	}
+	if current == nil {
+		app.respondError(c, http.StatusNotFound, errMarkerNotFound)
+		return
+	}
+	current.toCRS(crs)
+	c.Header("ETag", markerETag(current.Version))
+	app.respondError(c, http.StatusPreconditionFailed, errVersionConflict, gin.H{"current": current})
+}
+
+// respondMarker 返回标记点并附带 ETag
+func respondMarker(c *gin.Context, status int, m *Marker) {
+	c.Header("ETag", markerETag(m.Version))
+	c.JSON(status, m)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// IP 的保存方式
+const (
+	ipModeFull     = "full"
+	ipModeTruncate = "truncate"
+	ipModeHash     = "hash"
+)
+
+// retentionInterval 检查并清理过期访问数据的间隔
+const retentionInterval = time.Hour
+
+// truncateIP 把 IP 的主机部分置零，IPv4 保留前 v4Bits 位，IPv6 保留前 v6Bits 位。无法解析时原样返回
+func truncateIP(ip string, v4Bits, v6Bits int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(v4Bits, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(v6Bits, 128)).String()
+}
+
+// hashIP 以 key 为密钥对 salt 和 IP 计算 HMAC-SHA256，保存为 h: 前缀加前 16 个十六进制字符。
+// key 不保存在数据库中，只有数据库副本时无法穷举 IP 还原
+func hashIP(key, salt []byte, ip string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(ip))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// ipAnonymizer 按 privacy.ip_mode 处理写入 visits 和 user_actions 的 IP。
+// hash 模式的盐每 privacy.salt_rotation_days 天更换一次，保存在 ip_hash_salts 表中，
+// 用于按 IP 删除记录时重新计算哈希，随过期的访问数据一起删除。密钥 privacy.hash_key 只在配置中
+type ipAnonymizer struct {
+	app *App
+
+	mu     sync.Mutex
+	period int64
+	salt   []byte
+}
+
+// saltPeriod 返回 t 所在的盐周期编号
+func (a *ipAnonymizer) saltPeriod(t time.Time) int64 {
+	return t.Unix() / int64(a.app.Cfg.Privacy.SaltRotationDays*86400)
+}
+
+// saltFor 返回周期 period 的盐，不存在时生成并保存
+func (a *ipAnonymizer) saltFor(ctx context.Context, period int64) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.salt != nil && a.period == period {
+		return a.salt, nil
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("生成哈希盐失败: %w", err)
+	}
+	db := a.app.dbContext(ctx)
+	if _, err := db.Exec("INSERT OR IGNORE INTO ip_hash_salts (period, salt) VALUES (?, ?)", period, hex.EncodeToString(salt)); err != nil {
+		return nil, err
+	}
+	// 多个进程共用数据库时以先写入的盐为准
+	var stored string
+	if err := db.QueryRow("SELECT salt FROM ip_hash_salts WHERE period = ?", period).Scan(&stored); err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(stored)
+	if err != nil {
+		return nil, err
+	}
+	a.period, a.salt = period, salt
+	return salt, nil
+}
+
+// anonymize 返回时间 t 的访问应保存的 IP。hash 模式取盐失败时退回到截断，不保存完整 IP
+func (a *ipAnonymizer) anonymize(ctx context.Context, ip string, t time.Time) string {
+	cfg := a.app.Cfg.Privacy
+	switch cfg.IPMode {
+	case ipModeFull:
+		return ip
+	case ipModeHash:
+		salt, err := a.saltFor(ctx, a.saltPeriod(t))
+		if err == nil {
+			return hashIP([]byte(cfg.HashKey), salt, ip)
+		}
+		a.app.Logger.Error("获取 IP 哈希盐失败", zap.Error(err))
+	}
+	return truncateIP(ip, cfg.IPv4Prefix, cfg.IPv6Prefix)
+}
+
+// storedForms 返回 ip 在库中可能的保存形式：完整 IP、截断后的 IP 和用每个已保存的盐计算的哈希
+func (a *ipAnonymizer) storedForms(ctx context.Context, ip string) ([]string, error) {
+	cfg := a.app.Cfg.Privacy
+	forms := []string{ip}
+	if truncated := truncateIP(ip, cfg.IPv4Prefix, cfg.IPv6Prefix); truncated != ip {
+		forms = append(forms, truncated)
+	}
+	rows, err := a.app.dbContext(ctx).Query("SELECT salt FROM ip_hash_salts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			return nil, err
+		}
+		if salt, err := hex.DecodeString(stored); err == nil {
+			forms = append(forms, hashIP([]byte(cfg.HashKey), salt, ip))
+		}
+	}
+	return forms, rows.Err()
+}
+
+// scheduleRetention 定时把超过 privacy.retention_days 的访问记录和用户操作汇总为按天统计（privacy.rollup）后删除，
+// 并在启动时和每个 UTC 日期开始时轮转日志文件，使旧日志按保留天数删除。ctx 取消时退出。retention_days 为 0 时永久保留
+func (app *App) scheduleRetention(ctx context.Context) {
+	if app.Cfg.Privacy.RetentionDays <= 0 {
+		return
+	}
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	var rotatedDay string
+	for {
+		now := time.Now()
+		if err := app.applyRetention(ctx, now); err != nil {
+			app.Logger.Error("清理过期访问数据失败", zap.Error(err))
+		}
+		if day := now.UTC().Format("2006-01-02"); day != rotatedDay {
+			if err := logger.Rotate(); err != nil {
+				app.Logger.Error("轮转日志文件失败", zap.Error(err))
+			}
+			rotatedDay = day
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyRetention 在一个事务中汇总并删除 now 之前 retention_days 天（按 UTC 日期）以前的访问数据和哈希盐
+func (app *App) applyRetention(ctx context.Context, now time.Time) error {
+	cfg := app.Cfg.Privacy
+	day := now.UTC().AddDate(0, 0, -cfg.RetentionDays)
+	cutoff := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+
+	ctx, done := app.startQuery(ctx, "retention")
+	defer done()
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	db := tracedDB{ctx: ctx, db: tx}
+
+	cutoffArg := cutoff.Format(sqliteTimeLayout)
+	if cfg.Rollup {
+		// 按 UTC 日期汇总，同一天的数据在同一次清理中汇总，重复汇总时累加
+		rollups := []string{`
+			INSERT INTO visit_daily_stats (day, is_bot, page_views, unique_visitors, sessions)
+			SELECT date(visit_time), is_bot, COUNT(*), COUNT(DISTINCT ` + visitorKey + `), COUNT(DISTINCT session_id)
+			FROM visits WHERE visit_time < ?
+			GROUP BY 1, 2
+			ON CONFLICT(day, is_bot) DO UPDATE SET
+				page_views = page_views + excluded.page_views,
+				unique_visitors = unique_visitors + excluded.unique_visitors,
+				sessions = sessions + excluded.sessions`, `
+			INSERT INTO path_daily_stats (day, path, is_bot, page_views, unique_visitors)
+			SELECT date(visit_time), COALESCE(path, ''), is_bot, COUNT(*), COUNT(DISTINCT ` + visitorKey + `)
+			FROM visits WHERE visit_time < ?
+			GROUP BY 1, 2, 3
+			ON CONFLICT(day, path, is_bot) DO UPDATE SET
+				page_views = page_views + excluded.page_views,
+				unique_visitors = unique_visitors + excluded.unique_visitors`, `
+			INSERT INTO action_daily_stats (day, action_type, is_bot, actions, unique_visitors)
+			SELECT date(action_time), COALESCE(action_type, ''), is_bot, COUNT(*), COUNT(DISTINCT ` + visitorKey + `)
+			FROM user_actions WHERE action_time < ?
+			GROUP BY 1, 2, 3
+			ON CONFLICT(day, action_type, is_bot) DO UPDATE SET
+				actions = actions + excluded.actions,
+				unique_visitors = unique_visitors + excluded.unique_visitors`,
+		}
+		for _, query := range rollups {
+			if _, err := db.Exec(query, cutoffArg); err != nil {
+				return fmt.Errorf("汇总访问数据失败: %w", err)
+			}
+		}
+	}
+
+	visits, err := db.Exec("DELETE FROM visits WHERE visit_time < ?", cutoffArg)
+	if err != nil {
+		return err
+	}
+	actions, err := db.Exec("DELETE FROM user_actions WHERE action_time < ?", cutoffArg)
+	if err != nil {
+		return err
+	}
+	// 盐所在周期的结束时间早于 cutoff 时，用它计算哈希的记录都已删除
+	rotation := int64(cfg.SaltRotationDays * 86400)
+	if _, err := db.Exec("DELETE FROM ip_hash_salts WHERE (period + 1) * ? <= ?", rotation, cutoff.Unix()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	nv, _ := visits.RowsAffected()
+	na, _ := actions.RowsAffected()
+	if nv > 0 || na > 0 {
+		app.Logger.Info("清理过期访问数据", zap.Time("before", cutoff), zap.Int64("visits", nv), zap.Int64("user_actions", na))
+	}
+	return nil
+}
+
+// EraseVisitorData 删除某个 IP 的全部访问记录和用户操作，ip 为客户端的原始 IP。
+// 库中的 IP 经过截断时，同一网段其他访客的记录无法区分，也会一并删除
+func (app *App) EraseVisitorData(c *gin.Context) {
+	ip := strings.TrimSpace(c.Query("ip"))
+	if net.ParseIP(ip) == nil {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "ip"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	forms, err := app.privacy.storedForms(ctx, ip)
+	if err != nil {
+		app.internalError(c, "删除访问记录失败", zap.Error(err))
+		return
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(forms)), ", ")
+	args := make([]interface{}, len(forms))
+	for i, f := range forms {
+		args[i] = f
+	}
+
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		app.internalError(c, "删除访问记录失败", zap.Error(err))
+		return
+	}
+	defer tx.Rollback()
+	db := app.tx(c, tx)
+	visits, err := db.Exec("DELETE FROM visits WHERE ip IN ("+placeholders+")", args...)
+	if err != nil {
+		app.internalError(c, "删除访问记录失败", zap.Error(err))
+		return
+	}
+	actions, err := db.Exec("DELETE FROM user_actions WHERE ip IN ("+placeholders+")", args...)
+	if err != nil {
+		app.internalError(c, "删除访问记录失败", zap.Error(err))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		app.internalError(c, "删除访问记录失败", zap.Error(err))
+		return
+	}
+
+	nv, _ := visits.RowsAffected()
+	na, _ := actions.RowsAffected()
+	// 操作记录中不保存被删除的 IP
+	app.recordUserAction(c, "erase_visitor", fmt.Sprintf("删除访客数据 (%d 条访问记录, %d 条操作记录)", nv, na), "")
+	c.JSON(http.StatusOK, gin.H{"visits": nv, "user_actions": na})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength 客户端传入的请求 ID 的最大长度，超过或含有其他字符时重新生成
+	maxRequestIDLength = 128
+
+	// 请求上下文中的键
+	requestIDKey = "request_id"
+	loggerKey    = "logger"
+	userKey      = "user"
+	// redactQueryKey 为 true 时访问日志中不记录查询参数
+	redactQueryKey = "redact_query"
+)
+
+// newRequestID 生成随机的请求 ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID 客户端传入的请求 ID 只接受字母、数字和 -_.:，避免向日志中注入内容
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestContext 为每个请求确定请求 ID（沿用 X-Request-ID 请求头或新生成）并在响应头中返回，
+// 在上下文中保存带有该 ID 的日志记录器，请求结束后输出一条结构化的访问日志。
+// 日志中的 IP 与访问记录一样按 privacy.ip_mode 处理
+func (app *App) requestContext() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		fields := []zap.Field{zap.String("request_id", id)}
+		// 请求在链路中时，日志中同时记录 trace_id，便于与链路数据对照
+		if span := trace.SpanFromContext(c.Request.Context()); span.SpanContext().IsValid() {
+			span.SetAttributes(attribute.String("request_id", id))
+			fields = append(fields, zap.String("trace_id", span.SpanContext().TraceID().String()))
+		}
+		c.Set(requestIDKey, id)
+		c.Set(loggerKey, app.Logger.With(fields...))
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := zapcore.InfoLevel
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = zapcore.ErrorLevel
+		case status >= http.StatusBadRequest:
+			level = zapcore.WarnLevel
+		}
+		bytes := c.Writer.Size()
+		if bytes < 0 {
+			bytes = 0
+		}
+		user := c.GetString(userKey)
+		if user == "" {
+			user = "anonymous"
+		}
+		query := c.Request.URL.RawQuery
+		if query != "" && c.GetBool(redactQueryKey) {
+			query = "[redacted]"
+		}
+		if ce := app.log(c).Check(level, "请求完成"); ce != nil {
+			ce.Write(
+				zap.String("method", c.Request.Method),
+				zap.String("path", c.Request.URL.Path),
+				zap.String("query", query),
+				zap.String("route", c.FullPath()),
+				zap.Int("status", status),
+				zap.Int("bytes", bytes),
+				zap.Duration("latency", time.Since(start)),
+				zap.String("ip", app.privacy.anonymize(c.Request.Context(), c.ClientIP(), start)),
+				zap.String("user_agent", c.Request.UserAgent()),
+				zap.String("user", user))
+		}
+	}
+}
+
+// recovery 捕获处理过程中的 panic，记录调用栈并返回 500
+func (app *App) recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered interface{}) {
+		app.internalError(c, "请求处理异常", zap.Any("panic", recovered), zap.Stack("stack"))
+		c.Abort()
+	})
+}
+
+// log 返回当前请求的日志记录器，日志中带有请求 ID；不在请求中时返回 app.Logger
+func (app *App) log(c *gin.Context) *zap.Logger {
+	if l, ok := c.Get(loggerKey); ok {
+		if logger, ok := l.(*zap.Logger); ok {
+			return logger
+		}
+	}
+	return app.Logger
+}
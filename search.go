@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/logger"
+	"mapproject/pkg/textsearch"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultSearchLimit 搜索默认返回的结果数量
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// snippetContext 搜索片段中匹配内容前后保留的字符数
+	snippetContext = 20
+	// minTrigramLength trigram 分词器能够匹配的最短查询（字符数），更短的查询改用 LIKE 扫描
+	minTrigramLength = 3
+	// reindexBatchSize 每个事务重建的索引行数
+	reindexBatchSize = 500
+)
+
+// markSearchPending 将标记点加入待重建索引队列的语句，id 为 SQL 表达式。
+// 拼音列由服务在 Go 中计算，触发器只使用普通 SQL，sqlite3 命令行等其他客户端也能正常写入
+func markSearchPending(id string) string {
+	return fmt.Sprintf(`
+		    INSERT OR IGNORE INTO markers_fts_pending (id) VALUES (%s);`, id)
+}
+
+// searchTriggers 全文索引的同步触发器
+var searchTriggers = []string{
+	"markers_fts_insert", "markers_fts_update", "markers_fts_delete",
+	"images_fts_insert", "images_fts_update", "images_fts_delete",
+}
+
+// initSearchIndex 初始化全文索引。需要以 -tags sqlite_fts5 编译；
+// 不支持 FTS5 时删除已有的同步触发器，避免写入标记点失败
+func initSearchIndex(db *sql.DB) error {
+	err := createSearchIndex(db)
+	if err != nil {
+		for _, name := range searchTriggers {
+			db.Exec("DROP TRIGGER IF EXISTS " + name)
+		}
+	}
+	return err
+}
+
+// createSearchIndex 创建全文索引（FTS5 trigram 分词，支持中文子串匹配）及同步触发器，
+// 触发器此前不存在或索引行数与标记点不一致时重建
+func createSearchIndex(db *sql.DB) error {
+	var hadTriggers bool
+	if err := db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'trigger' AND name = ?",
+		searchTriggers[0]).Scan(&hadTriggers); err != nil {
+		return err
+	}
+
+	// 触发器每次启动重新创建，替换旧版本中调用拼音函数的触发器
+	schema := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS markers_fts USING fts5(
+		description, captions, pinyin, initials,
+		tokenize = 'trigram'
+	);
+
+	CREATE TABLE IF NOT EXISTS markers_fts_pending (
+		id INTEGER PRIMARY KEY
+	);
+
+	CREATE VIEW IF NOT EXISTS marker_search_source AS
+		SELECT m.id, COALESCE(m.description, '') AS description,
+		       COALESCE((SELECT group_concat(i.caption, ' ') FROM images i
+		                 WHERE i.marker_id = m.id AND i.caption != ''), '') AS captions
+		FROM markers m;
+
+	CREATE TRIGGER markers_fts_insert
+		AFTER INSERT ON markers
+		BEGIN` + markSearchPending("new.id") + `
+		END;
+
+	CREATE TRIGGER markers_fts_update
+		AFTER UPDATE OF description ON markers
+		BEGIN` + markSearchPending("new.id") + `
+		END;
+
+	CREATE TRIGGER markers_fts_delete
+		AFTER DELETE ON markers
+		BEGIN` + markSearchPending("old.id") + `
+		END;
+
+	CREATE TRIGGER images_fts_insert
+		AFTER INSERT ON images
+		BEGIN` + markSearchPending("new.marker_id") + `
+		END;
+
+	CREATE TRIGGER images_fts_update
+		AFTER UPDATE OF caption ON images
+		BEGIN` + markSearchPending("new.marker_id") + `
+		END;
+
+	CREATE TRIGGER images_fts_delete
+		AFTER DELETE ON images
+		BEGIN` + markSearchPending("old.marker_id") + `
+		END;
+	`
+	for _, name := range searchTriggers {
+		schema = "DROP TRIGGER IF EXISTS " + name + ";\n" + schema
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	if err := refreshSearchIndex(context.Background(), db); err != nil {
+		return err
+	}
+
+	var indexed, total int
+	if err := db.QueryRow("SELECT (SELECT COUNT(*) FROM markers_fts), (SELECT COUNT(*) FROM markers)").Scan(&indexed, &total); err != nil {
+		return err
+	}
+	if hadTriggers && indexed == total {
+		return nil
+	}
+	if _, err := db.Exec(`
+		DELETE FROM markers_fts;
+		INSERT OR IGNORE INTO markers_fts_pending (id) SELECT id FROM markers;
+	`); err != nil {
+		return err
+	}
+	if err := refreshSearchIndex(context.Background(), db); err != nil {
+		return err
+	}
+	logger.Log.Info("重建全文索引", zap.Int("markers", total))
+	return nil
+}
+
+// refreshSearchIndex 重建待更新队列中标记点的索引行，拼音和首字母在这里计算
+func refreshSearchIndex(ctx context.Context, db *sql.DB) error {
+	var pending bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM markers_fts_pending)").Scan(&pending); err != nil || !pending {
+		return err
+	}
+	for {
+		n, err := refreshSearchBatch(ctx, db)
+		if err != nil || n < reindexBatchSize {
+			return err
+		}
+	}
+}
+
+// refreshSearchBatch 在一个事务中重建一批索引行，返回处理的标记点数量。
+// 先从队列中删除再读取标记点，写锁保证读取期间标记点不会再被修改
+func refreshSearchBatch(ctx context.Context, db *sql.DB) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM markers_fts_pending
+		WHERE id IN (SELECT id FROM markers_fts_pending LIMIT ?)
+		RETURNING id`, reindexBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM markers_fts WHERE rowid = ?", id); err != nil {
+			return 0, err
+		}
+		var description, captions string
+		err := tx.QueryRowContext(ctx, "SELECT description, captions FROM marker_search_source WHERE id = ?", id).
+			Scan(&description, &captions)
+		if err == sql.ErrNoRows {
+			// 标记点已删除
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		text := description + " " + captions
+		if _, err := tx.ExecContext(ctx, "INSERT INTO markers_fts (rowid, description, captions, pinyin, initials) VALUES (?, ?, ?, ?, ?)",
+			id, description, captions, textsearch.Pinyin(text), textsearch.Initials(text)); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), tx.Commit()
+}
+
+// searchIndexReady 全文索引是否可用（未启用 FTS5 编译时不可用）
+func (app *App) searchIndexReady() bool {
+	var n int
+	err := app.DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?", searchTriggers[0]).Scan(&n)
+	return err == nil && n > 0
+}
+
+// SearchResult 搜索结果，snippet 为带 <mark> 高亮、已做 HTML 转义的片段
+type SearchResult struct {
+	Marker  Marker  `json:"marker"`
+	Field   string  `json:"field"`
+	Snippet string  `json:"snippet"`
+	Score   float64 `json:"score"`
+}
+
+// searchHit 全文索引中的一条候选记录
+type searchHit struct {
+	id          int
+	description string
+	captions    string
+	score       float64
+}
+
+// ftsPhrase 将文本转为 FTS5 短语，trigram 分词下短语即子串匹配
+func ftsPhrase(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func containsHan(s string) bool {
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchCandidates 查询候选记录。原文匹配描述和图片说明，不含汉字的查询同时按全拼和首字母匹配；
+// 查询足够长时用 MATCH 并按 bm25 排序（描述权重最高），否则用 LIKE 按 ID 排序
+func (app *App) searchCandidates(ctx context.Context, q string, limit int) ([]searchHit, error) {
+	ctx, done := app.startQuery(ctx, "search")
+	defer done()
+	db := app.dbContext(ctx)
+	var textQuery, pinyinQuery string
+	if utf8.RuneCountInString(q) >= minTrigramLength {
+		textQuery = q
+	}
+	if !containsHan(q) {
+		if p := textsearch.NormalizeQuery(q); len(p) >= minTrigramLength {
+			pinyinQuery = p
+		}
+	}
+
+	var rows *sql.Rows
+	var err error
+	if textQuery != "" || pinyinQuery != "" {
+		var clauses []string
+		if textQuery != "" {
+			clauses = append(clauses, "{description captions} : "+ftsPhrase(textQuery))
+		}
+		if pinyinQuery != "" {
+			clauses = append(clauses, "{pinyin initials} : "+ftsPhrase(pinyinQuery))
+		}
+		rows, err = db.Query(`
+			SELECT rowid, description, captions, -bm25(markers_fts, 10.0, 5.0, 2.0, 1.0)
+			FROM markers_fts WHERE markers_fts MATCH ?
+			ORDER BY bm25(markers_fts, 10.0, 5.0, 2.0, 1.0) LIMIT ?`,
+			strings.Join(clauses, " OR "), limit)
+	} else {
+		text := "%" + escapeLike(q) + "%"
+		py := "%" + escapeLike(textsearch.NormalizeQuery(q)) + "%"
+		rows, err = db.Query(`
+			SELECT rowid, description, captions, 0
+			FROM markers_fts
+			WHERE description LIKE ? ESCAPE '\' OR captions LIKE ? ESCAPE '\'
+			   OR pinyin LIKE ? ESCAPE '\' OR initials LIKE ? ESCAPE '\'
+			ORDER BY rowid LIMIT ?`,
+			text, text, py, py, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []searchHit
+	for rows.Next() {
+		var h searchHit
+		if err := rows.Scan(&h.id, &h.description, &h.captions, &h.score); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+func (app *App) Search(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.MissingParam, "q"))
+		return
+	}
+	limit := defaultSearchLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "limit"))
+			return
+		}
+		if n < maxSearchLimit {
+			limit = n
+		} else {
+			limit = maxSearchLimit
+		}
+	}
+	crs, err := resolveCRS(c, "", storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !app.searchIndexReady() {
+		app.respondError(c, http.StatusServiceUnavailable, apierror.New(apierror.SearchUnavailable))
+		return
+	}
+	if err := refreshSearchIndex(c.Request.Context(), app.DB); err != nil {
+		app.internalError(c, "更新全文索引失败", zap.Error(err))
+		return
+	}
+
+	// trigram 子串匹配可能跨越拼音音节边界，多取一些候选，过滤掉无法高亮的结果
+	hits, err := app.searchCandidates(c.Request.Context(), q, limit*3)
+	if err != nil {
+		app.internalError(c, "全文检索失败", zap.Error(err), zap.String("q", q))
+		return
+	}
+
+	results := make([]SearchResult, 0, len(hits))
+	ids := make([]interface{}, 0, len(hits))
+	for _, h := range hits {
+		if len(results) == limit {
+			break
+		}
+		r := SearchResult{Marker: Marker{ID: h.id}, Score: h.score}
+		if snippet, ok := textsearch.Highlight(h.description, q, snippetContext); ok {
+			r.Field, r.Snippet = "description", snippet
+		} else if snippet, ok := textsearch.Highlight(h.captions, q, snippetContext); ok {
+			r.Field, r.Snippet = "captions", snippet
+		} else {
+			continue
+		}
+		results = append(results, r)
+		ids = append(ids, h.id)
+	}
+
+	if len(ids) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+		markers, err := app.queryMarkers(c.Request.Context(), "WHERE m.id IN ("+placeholders+")", ids, "")
+		if err != nil {
+			app.internalError(c, "查询标记点失败", zap.Error(err))
+			return
+		}
+		byID := make(map[int]Marker, len(markers))
+		for _, m := range markers {
+			m.toCRS(crs)
+			byID[m.ID] = m
+		}
+		for i := range results {
+			results[i].Marker = byID[results[i].Marker.ID]
+		}
+	}
+
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 直接用 SQL 写入的数据（如 sqlite3 命令行）也能按拼音搜索到
+func TestSearchIndexesDirectWrites(t *testing.T) {
+	app := newTestApp(t)
+	if !app.searchIndexReady() {
+		t.Skip("全文索引需要 -tags sqlite_fts5")
+	}
+	r := gin.New()
+	r.GET("/search", app.Search)
+	search := func(q string) []int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/search?q="+url.QueryEscape(q), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("search %q: status = %d %s", q, w.Code, w.Body)
+		}
+		var results []SearchResult
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, len(results))
+		for i, res := range results {
+			ids[i] = res.Marker.ID
+		}
+		return ids
+	}
+
+	if _, err := app.DB.Exec("INSERT INTO markers (id, latitude, longitude, description) VALUES (1, 39.9, 116.4, '图书馆')"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("tushuguan"); len(got) != 1 || got[0] != 1 {
+		t.Errorf("after insert: tushuguan -> %v, want [1]", got)
+	}
+
+	if _, err := app.DB.Exec("INSERT INTO images (marker_id, filename, caption) VALUES (1, 'a.jpg', '正门')"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("zhengmen"); len(got) != 1 {
+		t.Errorf("after caption: zhengmen -> %v, want [1]", got)
+	}
+
+	if _, err := app.DB.Exec("UPDATE markers SET description = '体育馆' WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("tsg"); len(got) != 0 {
+		t.Errorf("after update: tsg -> %v, want none", got)
+	}
+	if got := search("tiyuguan"); len(got) != 1 {
+		t.Errorf("after update: tiyuguan -> %v, want [1]", got)
+	}
+
+	if _, err := app.DB.Exec("DELETE FROM markers WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("tiyuguan"); len(got) != 0 {
+		t.Errorf("after delete: tiyuguan -> %v, want none", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// sessionCookie 保存会话 ID 的 Cookie 名称
+const sessionCookie = "mp_session"
+
+// session 一个访问会话。bot 为 true 表示该会话已被识别为爬虫或程序
+type session struct {
+	id          string
+	lastSeen    time.Time
+	windowStart time.Time
+	hits        int
+	bot         bool
+}
+
+// sessionTracker 识别访问会话：带有会话 Cookie 时按 Cookie 区分，否则按 IP 和 User-Agent 区分，
+// 超过 timeout 没有访问时开始新会话。同时统计每个会话每分钟的请求数，超过 maxPerMinute 时标记为爬虫
+type sessionTracker struct {
+	mu           sync.Mutex
+	byID         map[string]*session
+	byClient     map[string]*session
+	timeout      time.Duration
+	maxPerMinute int
+}
+
+func newSessionTracker(timeout time.Duration, maxPerMinute int) *sessionTracker {
+	return &sessionTracker{
+		byID:         make(map[string]*session),
+		byClient:     make(map[string]*session),
+		timeout:      timeout,
+		maxPerMinute: maxPerMinute,
+	}
+}
+
+// newSessionID 生成随机的会话 ID
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validSessionID Cookie 中的会话 ID 须为 newSessionID 生成的格式
+func validSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// touch 记录一次访问，返回所属会话的 ID 和是否为爬虫。botHint 为 true 表示本次访问本身已可判定为爬虫
+// （如 User-Agent 或访问 robots.txt）。flagged 为 true 表示该会话刚被识别为爬虫，此前写入的访问记录也需要标记
+func (st *sessionTracker) touch(cookieID, client string, now time.Time, botHint bool) (id string, bot, flagged bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var s *session
+	if cookieID != "" {
+		// Cookie 的有效期随每次访问延长，浏览器仍携带说明会话未超时，进程重启后也能继续
+		s = st.byID[cookieID]
+		if s == nil {
+			s = &session{id: cookieID, windowStart: now}
+			st.byID[cookieID] = s
+		}
+	} else {
+		s = st.byClient[client]
+		if s == nil || now.Sub(s.lastSeen) > st.timeout {
+			s = &session{id: newSessionID(), windowStart: now}
+			st.byClient[client] = s
+			st.byID[s.id] = s
+		}
+	}
+	s.lastSeen = now
+
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.hits = 0
+	}
+	s.hits++
+	if !s.bot && (botHint || (st.maxPerMinute > 0 && s.hits > st.maxPerMinute)) {
+		s.bot = true
+		flagged = true
+	}
+	return s.id, s.bot, flagged
+}
+
+// prune 删除超时的会话
+func (st *sessionTracker) prune(now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for key, s := range st.byClient {
+		if now.Sub(s.lastSeen) > st.timeout {
+			delete(st.byClient, key)
+		}
+	}
+	for id, s := range st.byID {
+		if now.Sub(s.lastSeen) > st.timeout {
+			delete(st.byID, id)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+)
+
+const (
+	// defaultNearestK 未指定半径和数量时最近邻查询返回的数量
+	defaultNearestK = 10
+	// initialSearchRadius 最近邻查询的初始搜索半径（米），找不到足够的点时逐步扩大
+	initialSearchRadius = 500.0
+	// maxSearchRadius 超过半个地球周长后即覆盖全部标记点
+	maxSearchRadius = math.Pi * geo.EarthRadius
+)
+
+// nearQuery 以某点为中心的半径或最近邻查询，中心点为存储坐标系
+type nearQuery struct {
+	center geo.Point
+	radius float64
+	k      int
+}
+
+// parseFloatList 解析逗号分隔的 n 个数字
+func parseFloatList(s string, n int) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("需要 %d 个数字", n)
+	}
+	values := make([]float64, n)
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("无效的数字: %s", p)
+		}
+		values[i] = f
+	}
+	return values, nil
+}
+
+// addBBox 添加矩形范围条件：先用 R*Tree 粗筛，再按精确坐标过滤（R*Tree 以 32 位浮点存储边界）
+func (q *markerQuery) addBBox(sw, ne geo.Point) {
+	q.add("m.id IN (SELECT id FROM markers_rtree WHERE max_lng >= ? AND min_lng <= ? AND max_lat >= ? AND min_lat <= ?)",
+		sw.Lng, ne.Lng, sw.Lat, ne.Lat)
+	q.add("m.longitude BETWEEN ? AND ? AND m.latitude BETWEEN ? AND ?", sw.Lng, ne.Lng, sw.Lat, ne.Lat)
+}
+
+// parseSpatialQuery 解析 bbox=minLng,minLat,maxLng,maxLat 和 near=lat,lng&radius=米&k=数量，
+// 参数坐标按 crs 解释
+func (q *markerQuery) parseSpatialQuery(params url.Values, crs geo.CRS) error {
+	if v := params.Get("bbox"); v != "" {
+		b, err := parseFloatList(v, 4)
+		if err != nil || b[0] > b[2] || b[1] > b[3] {
+			return apierror.New(apierror.InvalidParam, "bbox")
+		}
+		sw := geo.Convert(geo.Point{Lng: b[0], Lat: b[1]}, crs, storageCRS)
+		ne := geo.Convert(geo.Point{Lng: b[2], Lat: b[3]}, crs, storageCRS)
+		q.addBBox(sw, ne)
+	}
+
+	v := params.Get("near")
+	if v == "" {
+		return nil
+	}
+	p, err := parseFloatList(v, 2)
+	if err != nil || p[0] < -90 || p[0] > 90 || p[1] < -180 || p[1] > 180 {
+		return apierror.New(apierror.InvalidParam, "near")
+	}
+	near := &nearQuery{center: geo.Convert(geo.Point{Lat: p[0], Lng: p[1]}, crs, storageCRS)}
+
+	if r := params.Get("radius"); r != "" {
+		near.radius, err = strconv.ParseFloat(r, 64)
+		if err != nil || near.radius <= 0 {
+			return apierror.New(apierror.InvalidParam, "radius")
+		}
+	}
+	if k := params.Get("k"); k != "" {
+		near.k, err = strconv.Atoi(k)
+		if err != nil || near.k <= 0 {
+			return apierror.New(apierror.InvalidParam, "k")
+		}
+	} else {
+		near.k = q.limit
+	}
+	if near.k > maxPageSize {
+		near.k = maxPageSize
+	}
+	if near.radius == 0 && near.k == 0 {
+		near.k = defaultNearestK
+	}
+	if q.cursor != nil {
+		// near 查询按距离排序，不支持游标分页
+		return apierror.New(apierror.UnsupportedParam, "cursor")
+	}
+	q.near = near
+	return nil
+}
+
+// nearMarkers 执行半径或最近邻查询，按距离升序返回，total 为半径内（或搜索范围内）的总数。
+// 未指定半径时从 initialSearchRadius 开始逐步扩大，直到找到 k 个点
+func (app *App) nearMarkers(ctx context.Context, q *markerQuery) ([]Marker, int, error) {
+	radius := q.near.radius
+	if radius == 0 {
+		radius = initialSearchRadius
+	}
+
+	var found []Marker
+	for {
+		sw, ne := geo.BoundingBox(q.near.center, radius)
+		sub := *q
+		sub.where = append([]string(nil), q.where...)
+		sub.args = append([]interface{}(nil), q.args...)
+		sub.addBBox(sw, ne)
+		where, args := sub.whereClause(false)
+
+		candidates, err := app.selectMarkers(ctx, where, args, "")
+		if err != nil {
+			return nil, 0, err
+		}
+		found = found[:0]
+		for _, m := range candidates {
+			d := geo.Distance(q.near.center, geo.Point{Lat: m.Latitude, Lng: m.Longitude})
+			if d <= radius {
+				m.Distance = &d
+				found = append(found, m)
+			}
+		}
+
+		if q.near.radius > 0 || len(found) >= q.near.k || radius >= maxSearchRadius {
+			break
+		}
+		radius *= 4
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if *found[i].Distance != *found[j].Distance {
+			return *found[i].Distance < *found[j].Distance
+		}
+		return found[i].ID < found[j].ID
+	})
+	total := len(found)
+	if q.near.k > 0 && len(found) > q.near.k {
+		found = found[:q.near.k]
+	}
+	if err := app.attachImages(ctx, found); err != nil {
+		return nil, 0, err
+	}
+	return found, total, nil
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/zap"
+)
+
+// spreadsheetColumns 表格导出的列，同时作为导入时的默认表头
+var spreadsheetColumns = []string{
+	"id", "external_key", "latitude", "longitude", "value", "required_value",
+	"status", "image_count", "description", "sufficient_color", "insufficient_color",
+	"created_at", "updated_at",
+}
+
+// importableFields 导入时可写入的字段，与数据库列同名
+var importableFields = map[string]bool{
+	"id":                 true,
+	"external_key":       true,
+	"latitude":           true,
+	"longitude":          true,
+	"value":              true,
+	"required_value":     true,
+	"description":        true,
+	"sufficient_color":   true,
+	"insufficient_color": true,
+}
+
+var hexColorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// utf8BOM 让 Excel 以 UTF-8 打开 CSV 中的中文
+const utf8BOM = "\ufeff"
+
+// rowError 导入时某行的错误，Error 在返回前按请求语言填写
+type rowError struct {
+	Row   int           `json:"row"`
+	Field string        `json:"field,omitempty"`
+	Code  apierror.Code `json:"code"`
+	Error string        `json:"error"`
+
+	err *apierror.Error
+}
+
+func newRowError(field string, err *apierror.Error) rowError {
+	return rowError{Field: field, Code: err.Code, err: err}
+}
+
+// localizeRowErrors 按语言填写各行错误的提示
+func localizeRowErrors(errs []rowError, lang apierror.Lang) []rowError {
+	for i := range errs {
+		errs[i].Error = errs[i].err.Localize(lang)
+	}
+	return errs
+}
+
+// loadSpreadsheetRows 按 spreadsheetColumns 的顺序查询标记点，状态和图片数量取自 marker_summary 视图，
+// 坐标转换到 crs
+func (app *App) loadSpreadsheetRows(ctx context.Context, crs geo.CRS) ([][]interface{}, error) {
+	ctx, done := app.startQuery(ctx, "spreadsheet_rows")
+	defer done()
+	rows, err := app.dbContext(ctx).Query(`
+		SELECT
+			m.id,
+			COALESCE(m.external_key, ''),
+			m.latitude,
+			m.longitude,
+			m.value,
+			m.required_value,
+			s.status,
+			s.image_count,
+			m.description,
+			m.sufficient_color,
+			m.insufficient_color,
+			COALESCE(m.created_at, ''),
+			COALESCE(m.updated_at, '')
+		FROM markers m
+		JOIN marker_summary s ON s.id = m.id
+		ORDER BY m.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result [][]interface{}
+	for rows.Next() {
+		var id, imageCount int
+		var lat, lng, value, requiredValue float64
+		var externalKey, status, description, sufficientColor, insufficientColor, createdAt, updatedAt string
+		if err := rows.Scan(&id, &externalKey, &lat, &lng, &value, &requiredValue, &status, &imageCount,
+			&description, &sufficientColor, &insufficientColor, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		lat, lng = convertLatLng(lat, lng, storageCRS, crs)
+		result = append(result, []interface{}{
+			id, externalKey, lat, lng, value, requiredValue, status, imageCount,
+			description, sufficientColor, insufficientColor, createdAt, updatedAt,
+		})
+	}
+	return result, rows.Err()
+}
+
+// formulaPrefixes 表格软件打开 CSV 时会把以这些字符开头的单元格当作公式
+const formulaPrefixes = "=+-@\t\r"
+
+// needsFormulaEscape 判断 CSV 单元格是否需要加 ' 前缀：以公式字符开头，或本身以 ' 开头（否则导入时无法区分）
+func needsFormulaEscape(s string) bool {
+	return s != "" && (s[0] == '\'' || strings.ContainsRune(formulaPrefixes, rune(s[0])))
+}
+
+// escapeFormula 为 CSV 中的文本加上 ' 前缀，避免导出的表格被打开时执行公式（CSV 注入）。
+// XLSX 的文本单元格不会被当作公式，不需要转义
+func escapeFormula(s string) string {
+	if needsFormulaEscape(s) {
+		return "'" + s
+	}
+	return s
+}
+
+// unescapeFormula 去掉 escapeFormula 加上的前缀，导入导出的 CSV 时得到原来的文本
+func unescapeFormula(s string) string {
+	if len(s) > 1 && s[0] == '\'' && needsFormulaEscape(s[1:]) {
+		return s[1:]
+	}
+	return s
+}
+
+func formatCell(v interface{}) string {
+	switch x := v.(type) {
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(x)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+func (app *App) ExportCSV(c *gin.Context) {
+	crs, err := resolveCRS(c, "", storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	rows, err := app.loadSpreadsheetRows(c.Request.Context(), crs)
+	if err != nil {
+		app.internalError(c, "查询导出数据失败", zap.Error(err))
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(utf8BOM)
+	w := csv.NewWriter(&buf)
+	w.Write(spreadsheetColumns)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			// 只有文本可能以公式字符开头，负数不转义
+			if s, ok := v.(string); ok {
+				record[i] = escapeFormula(s)
+			} else {
+				record[i] = formatCell(v)
+			}
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		app.internalError(c, "生成CSV失败", zap.Error(err))
+		return
+	}
+
+	app.recordUserAction(c, "export_csv", fmt.Sprintf("导出CSV (%d 个标记点)", len(rows)), "")
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename("csv")))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+func (app *App) ExportXLSX(c *gin.Context) {
+	crs, err := resolveCRS(c, "", storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	rows, err := app.loadSpreadsheetRows(c.Request.Context(), crs)
+	if err != nil {
+		app.internalError(c, "查询导出数据失败", zap.Error(err))
+		return
+	}
+
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := "标记点"
+	f.SetSheetName(f.GetSheetName(0), sheet)
+
+	sw, err := f.NewStreamWriter(sheet)
+	if err == nil {
+		header := make([]interface{}, len(spreadsheetColumns))
+		for i, col := range spreadsheetColumns {
+			header[i] = col
+		}
+		err = sw.SetRow("A1", header)
+	}
+	for i := 0; err == nil && i < len(rows); i++ {
+		var cell string
+		if cell, err = excelize.CoordinatesToCellName(1, i+2); err == nil {
+			err = sw.SetRow(cell, rows[i])
+		}
+	}
+	if err == nil {
+		err = sw.Flush()
+	}
+	var buf bytes.Buffer
+	if err == nil {
+		err = f.Write(&buf)
+	}
+	if err != nil {
+		app.internalError(c, "生成XLSX失败", zap.Error(err))
+		return
+	}
+
+	app.recordUserAction(c, "export_xlsx", fmt.Sprintf("导出XLSX (%d 个标记点)", len(rows)), "")
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename("xlsx")))
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
+}
+
+// readSpreadsheet 将 CSV 或 XLSX（第一个工作表）解析为字符串表格
+func readSpreadsheet(data []byte, filename string) ([][]string, error) {
+	isXLSX := strings.EqualFold(filepath.Ext(filename), ".xlsx") || bytes.HasPrefix(data, []byte("PK\x03\x04"))
+	if isXLSX {
+		f, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, apierror.New(apierror.InvalidSpreadsheet, "XLSX", err)
+		}
+		defer f.Close()
+		return f.GetRows(f.GetSheetName(0))
+	}
+
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte(utf8BOM))))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, apierror.New(apierror.InvalidSpreadsheet, "CSV", err)
+	}
+	for _, record := range records {
+		for i, cell := range record {
+			record[i] = unescapeFormula(cell)
+		}
+	}
+	return records, nil
+}
+
+// columnIndexes 根据表头和列映射（字段名 -> 表头名）确定每个字段所在的列
+func columnIndexes(header []string, mapping map[string]string) (map[string]int, error) {
+	headerIndex := make(map[string]int)
+	for i, h := range header {
+		headerIndex[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+
+	indexes := make(map[string]int)
+	for field := range importableFields {
+		if i, ok := headerIndex[field]; ok {
+			indexes[field] = i
+		}
+	}
+	for field, column := range mapping {
+		if !importableFields[field] {
+			return nil, apierror.New(apierror.UnknownField, field)
+		}
+		i, ok := headerIndex[strings.ToLower(strings.TrimSpace(column))]
+		if !ok {
+			return nil, apierror.New(apierror.MissingColumn, column)
+		}
+		indexes[field] = i
+	}
+	return indexes, nil
+}
+
+// parseImportRow 解析并校验一行数据，返回非空单元格对应的字段值。
+// 数字格式错误在解析时报告，其余按 Marker 的 binding 标签校验
+func parseImportRow(record []string, indexes map[string]int) (map[string]interface{}, []rowError) {
+	values := make(map[string]interface{})
+	var errs []rowError
+	for _, field := range spreadsheetColumns {
+		i, ok := indexes[field]
+		if !ok || i >= len(record) {
+			continue
+		}
+		raw := strings.TrimSpace(record[i])
+		if raw == "" {
+			continue
+		}
+
+		switch field {
+		case "id":
+			id, err := strconv.Atoi(raw)
+			if err != nil || id <= 0 {
+				errs = append(errs, newRowError(field, apierror.New(apierror.InvalidID)))
+				continue
+			}
+			values[field] = id
+		case "latitude", "longitude", "value", "required_value":
+			f, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				errs = append(errs, newRowError(field, apierror.New(apierror.InvalidNumber)))
+				continue
+			}
+			values[field] = f
+		default:
+			values[field] = raw
+		}
+	}
+	if len(errs) > 0 {
+		return values, errs
+	}
+
+	var m Marker
+	fields := make([]string, 0, len(values))
+	for field, v := range values {
+		switch field {
+		case "id":
+			continue
+		case "latitude":
+			m.Latitude = v.(float64)
+		case "longitude":
+			m.Longitude = v.(float64)
+		case "value":
+			m.Value = v.(float64)
+		case "required_value":
+			m.RequiredValue = v.(float64)
+		case "description":
+			m.Description = v.(string)
+		case "external_key":
+			m.ExternalKey = v.(string)
+		case "sufficient_color":
+			m.SufficientColor = v.(string)
+		case "insufficient_color":
+			m.InsufficientColor = v.(string)
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return values, nil
+	}
+	return values, validateImportedMarker(&m, fields...)
+}
+
+// upsertImportRow 按 key 字段查找已有标记点，存在则只更新提供的字段，否则插入。
+// 坐标按 crs 解释并转换为存储坐标系
+func upsertImportRow(tx queryExecer, key string, values map[string]interface{}, crs geo.CRS) (inserted bool, err error) {
+	lat, hasLat := values["latitude"]
+	lng, hasLng := values["longitude"]
+	if hasLat != hasLng {
+		return false, apierror.New(apierror.LatLngIncomplete)
+	}
+	if hasLat {
+		values["latitude"], values["longitude"] = convertLatLng(lat.(float64), lng.(float64), crs, storageCRS)
+		values["source_crs"] = string(crs)
+	}
+
+	var existingID int
+	if keyValue, ok := values[key]; ok {
+		err = tx.QueryRow(fmt.Sprintf("SELECT id FROM markers WHERE %s = ?", key), keyValue).Scan(&existingID)
+		if err != nil && err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+
+	fields := make([]string, 0, len(values))
+	for _, field := range append(spreadsheetColumns, "source_crs") {
+		if _, ok := values[field]; ok && field != "id" {
+			fields = append(fields, field)
+		}
+	}
+
+	if existingID != 0 {
+		if len(fields) == 0 {
+			return false, nil
+		}
+		sets := make([]string, len(fields))
+		args := make([]interface{}, 0, len(fields)+1)
+		for i, field := range fields {
+			sets[i] = field + " = ?"
+			args = append(args, values[field])
+		}
+		args = append(args, existingID)
+		_, err = tx.Exec("UPDATE markers SET "+strings.Join(sets, ", ")+", version = version + 1 WHERE id = ?", args...)
+		return false, err
+	}
+
+	if !hasLat {
+		return false, apierror.New(apierror.LatLngRequired)
+	}
+	// 按 ID 导入且库中不存在时保留表格中的 ID
+	if _, ok := values["id"]; ok && key == "id" {
+		fields = append(fields, "id")
+	}
+	args := make([]interface{}, len(fields))
+	for i, field := range fields {
+		args[i] = values[field]
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(fields)), ", ")
+	_, err = tx.Exec("INSERT INTO markers ("+strings.Join(fields, ", ")+") VALUES ("+placeholders+")", args...)
+	return true, err
+}
+
+func (app *App) ImportMarkers(c *gin.Context) {
+	key := c.DefaultPostForm("key", "id")
+	if key != "id" && key != "external_key" {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "key"))
+		return
+	}
+	atomic := c.PostForm("atomic") == "true"
+
+	crs, err := resolveCRS(c, "", storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var mapping map[string]string
+	if m := c.PostForm("mapping"); m != "" {
+		if err := json.Unmarshal([]byte(m), &mapping); err != nil {
+			app.respondError(c, http.StatusBadRequest, apierror.New(apierror.InvalidParam, "mapping"))
+			return
+		}
+	}
+
+	data, filename, err := app.readImportFile(c)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	records, err := readSpreadsheet(data, filename)
+	if err != nil {
+		app.log(c).Info("解析导入文件失败", zap.Error(err), zap.String("filename", filename))
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(records) == 0 {
+		app.respondError(c, http.StatusBadRequest, apierror.New(apierror.EmptyFile))
+		return
+	}
+
+	indexes, err := columnIndexes(records[0], mapping)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := app.DB.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		app.internalError(c, "开始事务失败", zap.Error(err))
+		return
+	}
+	defer tx.Rollback()
+	db := app.tx(c, tx)
+
+	var inserted, updated int
+	errs := []rowError{}
+	for i, record := range records[1:] {
+		// 行号与表格软件中显示的一致（表头为第 1 行）
+		rowNum := i + 2
+		values, rowErrs := parseImportRow(record, indexes)
+		if len(rowErrs) > 0 {
+			for _, e := range rowErrs {
+				e.Row = rowNum
+				errs = append(errs, e)
+			}
+			continue
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		isInsert, err := upsertImportRow(db, key, values, crs)
+		if err != nil {
+			var apiErr *apierror.Error
+			switch {
+			case errors.As(err, &apiErr):
+			case isUniqueViolation(err):
+				apiErr = errExternalKeyTaken
+			default:
+				// 数据库错误不返回给客户端，只在日志中记录
+				app.log(c).Error("导入标记点失败", zap.Error(err), zap.Int("row", rowNum),
+					zap.String("code", string(apierror.Internal)))
+				apiErr = apierror.New(apierror.Internal, requestID(c))
+			}
+			e := newRowError("", apiErr)
+			e.Row = rowNum
+			errs = append(errs, e)
+			continue
+		}
+		if isInsert {
+			inserted++
+		} else {
+			updated++
+		}
+	}
+
+	localizeRowErrors(errs, requestLang(c))
+	if atomic && len(errs) > 0 {
+		app.respondError(c, http.StatusUnprocessableEntity, apierror.New(apierror.ImportFailed), gin.H{"errors": errs})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		app.internalError(c, "提交事务失败", zap.Error(err))
+		return
+	}
+	app.tiles.invalidateAll()
+
+	app.recordUserAction(c, "import_markers",
+		fmt.Sprintf("从 %s 导入标记点: 新增 %d, 更新 %d, 错误 %d", filename, inserted, updated, len(errs)),
+		"")
+
+	app.log(c).Info("导入标记点表格",
+		zap.String("filename", filename),
+		zap.Int("inserted", inserted),
+		zap.Int("updated", updated),
+		zap.Int("errors", len(errs)))
+
+	c.JSON(http.StatusOK, gin.H{
+		"inserted": inserted,
+		"updated":  updated,
+		"errors":   errs,
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+// 导出的 CSV 不含可执行的公式，导入后得到原来的文本
+func TestFormulaEscapeRoundTrip(t *testing.T) {
+	texts := []string{"", "plain", "=1+1", "+86 10", "-5 cm", "@SUM(A1)", "\tindented", "'-5 cm", "'abc", "''", "'", "中文"}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, s := range texts {
+		escaped := escapeFormula(s)
+		if escaped != "" && needsFormulaEscape(escaped) && escaped[0] != '\'' {
+			t.Errorf("escapeFormula(%q) = %q starts with a formula character", s, escaped)
+		}
+		w.Write([]string{"x", escaped})
+	}
+	w.Flush()
+
+	records, err := readSpreadsheet(buf.Bytes(), "markers.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range texts {
+		if got := records[i][1]; got != s {
+			t.Errorf("round trip of %q = %q", s, got)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mapproject/pkg/apierror"
+	"mapproject/pkg/geo"
+	"mapproject/pkg/mvt"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// tileBuffer 瓦片四周额外包含的范围（瓦片内坐标），避免边缘的点和线被截断
+	tileBuffer = 64
+	// maxTileCacheEntries 瓦片缓存的最大条目数，超过后整体清空
+	maxTileCacheEntries = 4096
+	mvtContentType      = "application/vnd.mapbox-vector-tile"
+)
+
+// tileKey 瓦片坐标及其使用的坐标系
+type tileKey struct {
+	z, x, y int
+	crs     geo.CRS
+}
+
+// project 将经纬度（tileKey 的坐标系）投影为瓦片内坐标
+func (k tileKey) project(p geo.Point) (float64, float64) {
+	gx, gy := geo.MercatorPixel(p, k.z)
+	scale := float64(mvt.DefaultExtent) / geo.TileSize
+	return (gx - float64(k.x*geo.TileSize)) * scale, (gy - float64(k.y*geo.TileSize)) * scale
+}
+
+// contains 判断瓦片内坐标是否落在含缓冲区的瓦片范围内
+func (k tileKey) contains(x, y float64) bool {
+	return x >= -tileBuffer && x <= mvt.DefaultExtent+tileBuffer &&
+		y >= -tileBuffer && y <= mvt.DefaultExtent+tileBuffer
+}
+
+// bounds 返回含缓冲区的瓦片经纬度范围（tileKey 的坐标系）
+func (k tileKey) bounds() (sw, ne geo.Point) {
+	buffer := float64(tileBuffer) * geo.TileSize / mvt.DefaultExtent
+	minX := float64(k.x*geo.TileSize) - buffer
+	minY := float64(k.y*geo.TileSize) - buffer
+	maxX := float64((k.x+1)*geo.TileSize) + buffer
+	maxY := float64((k.y+1)*geo.TileSize) + buffer
+	nw := geo.MercatorPoint(minX, minY, k.z)
+	se := geo.MercatorPoint(maxX, maxY, k.z)
+	return geo.Point{Lat: se.Lat, Lng: nw.Lng}, geo.Point{Lat: nw.Lat, Lng: se.Lng}
+}
+
+type cachedTile struct {
+	data []byte
+	etag string
+}
+
+// tileCache 缓存已编码的瓦片。标记点变化时只清除包含该点的瓦片，
+// 轨迹变化和批量导入时整体清空。generation 在每次清除时递增，
+// 渲染期间发生过清除的瓦片不写入缓存，避免缓存旧数据
+type tileCache struct {
+	mu         sync.Mutex
+	generation uint64
+	entries    map[tileKey]*cachedTile
+}
+
+func (tc *tileCache) get(key tileKey) (*cachedTile, uint64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.entries[key], tc.generation
+}
+
+func (tc *tileCache) put(key tileKey, tile *cachedTile, generation uint64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if generation != tc.generation {
+		return
+	}
+	if tc.entries == nil || len(tc.entries) >= maxTileCacheEntries {
+		tc.entries = make(map[tileKey]*cachedTile)
+	}
+	tc.entries[key] = tile
+}
+
+// invalidatePoints 清除包含任一点（存储坐标系）的瓦片
+func (tc *tileCache) invalidatePoints(points ...geo.Point) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.generation++
+	for key := range tc.entries {
+		for _, p := range points {
+			if key.contains(key.project(geo.Convert(p, storageCRS, key.crs))) {
+				delete(tc.entries, key)
+				break
+			}
+		}
+	}
+}
+
+func (tc *tileCache) invalidateAll() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.generation++
+	tc.entries = nil
+}
+
+// etagMatches 判断 If-None-Match / If-Match 请求头是否包含 etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// clipSegment 用 Liang–Barsky 算法将线段裁剪到 [min, max] 正方形内
+func clipSegment(a, b [2]float64, min, max float64) ([2]float64, [2]float64, bool) {
+	t0, t1 := 0.0, 1.0
+	d := [2]float64{b[0] - a[0], b[1] - a[1]}
+	for i := 0; i < 2; i++ {
+		for _, e := range [2][2]float64{{-d[i], a[i] - min}, {d[i], max - a[i]}} {
+			p, q := e[0], e[1]
+			if p == 0 {
+				if q < 0 {
+					return a, b, false
+				}
+				continue
+			}
+			r := q / p
+			if p < 0 {
+				if r > t1 {
+					return a, b, false
+				}
+				t0 = math.Max(t0, r)
+			} else {
+				if r < t0 {
+					return a, b, false
+				}
+				t1 = math.Min(t1, r)
+			}
+		}
+	}
+	ca, cb := a, b
+	if t0 > 0 {
+		ca = [2]float64{a[0] + t0*d[0], a[1] + t0*d[1]}
+	}
+	if t1 < 1 {
+		cb = [2]float64{a[0] + t1*d[0], a[1] + t1*d[1]}
+	}
+	return ca, cb, true
+}
+
+// clipLine 将折线裁剪到含缓冲区的瓦片范围内，折线多次进出瓦片时拆分为多段，
+// 坐标取整后去掉重复点，少于两个点的段丢弃
+func clipLine(points [][2]float64) [][][2]int32 {
+	const min, max = -tileBuffer, mvt.DefaultExtent + tileBuffer
+
+	var parts [][][2]float64
+	var cur [][2]float64
+	for i := 1; i < len(points); i++ {
+		a, b, ok := clipSegment(points[i-1], points[i], min, max)
+		if !ok {
+			if len(cur) > 0 {
+				parts = append(parts, cur)
+				cur = nil
+			}
+			continue
+		}
+		if len(cur) == 0 {
+			cur = append(cur, a)
+		}
+		cur = append(cur, b)
+		if b != points[i] {
+			parts = append(parts, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		parts = append(parts, cur)
+	}
+
+	var lines [][][2]int32
+	for _, part := range parts {
+		var line [][2]int32
+		for _, p := range part {
+			q := [2]int32{int32(math.Round(p[0])), int32(math.Round(p[1]))}
+			if len(line) == 0 || line[len(line)-1] != q {
+				line = append(line, q)
+			}
+		}
+		if len(line) >= 2 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// renderTile 生成包含 markers 和 trajectories 两个图层的瓦片
+func (app *App) renderTile(ctx context.Context, key tileKey) ([]byte, error) {
+	sw, ne := key.bounds()
+	q := &markerQuery{}
+	q.addBBox(geo.Convert(sw, key.crs, storageCRS), geo.Convert(ne, key.crs, storageCRS))
+	where, args := q.whereClause(false)
+	markers, err := app.selectMarkers(ctx, where, args, "ORDER BY m.id")
+	if err != nil {
+		return nil, err
+	}
+
+	markerLayer := mvt.Layer{Name: "markers"}
+	for _, m := range markers {
+		m.toCRS(key.crs)
+		x, y := key.project(geo.Point{Lat: m.Latitude, Lng: m.Longitude})
+		if !key.contains(x, y) {
+			continue
+		}
+		status, color := "insufficient", m.InsufficientColor
+		if m.Sufficient() {
+			status, color = "sufficient", m.SufficientColor
+		}
+		markerLayer.Features = append(markerLayer.Features, mvt.Feature{
+			ID:       uint64(m.ID),
+			Type:     mvt.Point,
+			Geometry: [][][2]int32{{{int32(math.Round(x)), int32(math.Round(y))}}},
+			Properties: map[string]interface{}{
+				"status":         status,
+				"value":          m.Value,
+				"required_value": m.RequiredValue,
+				"color":          color,
+				"description":    m.Description,
+			},
+		})
+	}
+
+	trajectories, err := app.loadTrajectories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lineLayer := mvt.Layer{Name: "trajectories"}
+	for _, t := range trajectories {
+		t.toCRS(key.crs)
+		points := make([][2]float64, len(t.Points))
+		for i, p := range t.Points {
+			x, y := key.project(geo.Point{Lat: p.Latitude, Lng: p.Longitude})
+			points[i] = [2]float64{x, y}
+		}
+		lines := clipLine(points)
+		if len(lines) == 0 {
+			continue
+		}
+		lineLayer.Features = append(lineLayer.Features, mvt.Feature{
+			ID:       uint64(t.ID),
+			Type:     mvt.LineString,
+			Geometry: lines,
+			Properties: map[string]interface{}{
+				"name":  t.Name,
+				"color": t.Color,
+			},
+		})
+	}
+
+	var layers []mvt.Layer
+	for _, l := range []mvt.Layer{markerLayer, lineLayer} {
+		if len(l.Features) > 0 {
+			layers = append(layers, l)
+		}
+	}
+	return mvt.Encode(layers), nil
+}
+
+// parseTileKey 解析 /tiles/markers/:z/:x/:y.mvt 路径参数
+func parseTileKey(c *gin.Context) (tileKey, bool) {
+	var key tileKey
+	yParam, ok := strings.CutSuffix(c.Param("y"), ".mvt")
+	if !ok {
+		return key, false
+	}
+	var err error
+	if key.z, err = strconv.Atoi(c.Param("z")); err != nil || key.z < 0 || key.z > maxZoom {
+		return key, false
+	}
+	n := 1 << key.z
+	if key.x, err = strconv.Atoi(c.Param("x")); err != nil || key.x < 0 || key.x >= n {
+		return key, false
+	}
+	if key.y, err = strconv.Atoi(yParam); err != nil || key.y < 0 || key.y >= n {
+		return key, false
+	}
+	return key, true
+}
+
+// GetMarkerTile 返回标记点和轨迹的矢量瓦片，默认使用 WGS-84 以便其他地图客户端直接叠加，
+// 高德地图可传 crs=gcj02
+func (app *App) GetMarkerTile(c *gin.Context) {
+	key, ok := parseTileKey(c)
+	if !ok {
+		app.respondError(c, http.StatusNotFound, apierror.New(apierror.TileNotFound))
+		return
+	}
+	crs, err := resolveCRS(c, "", geo.WGS84)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	key.crs = crs
+
+	tile, generation := app.tiles.get(key)
+	if tile == nil {
+		data, err := app.renderTile(c.Request.Context(), key)
+		if err != nil {
+			app.internalError(c, "生成瓦片失败", zap.Error(err),
+				zap.Int("z", key.z), zap.Int("x", key.x), zap.Int("y", key.y))
+			return
+		}
+		sum := sha256.Sum256(data)
+		tile = &cachedTile{data: data, etag: fmt.Sprintf(`"%x"`, sum[:8])}
+		app.tiles.put(key, tile, generation)
+	}
+
+	c.Header("ETag", tile.etag)
+	c.Header("Cache-Control", "no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), tile.etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, mvtContentType, tile.data)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"mapproject/pkg/config"
+	"mapproject/pkg/geo"
+	"mapproject/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// newTestApp 使用临时目录中的数据库创建 App
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	logger.Log = zap.NewNop()
+	db := initDB(filepath.Join(t.TempDir(), "markers.db"))
+	t.Cleanup(func() { db.Close() })
+	app := &App{DB: db, Cfg: &config.Config{}, Logger: logger.Log}
+	app.metrics = newAppMetrics(db, app.Logger)
+	return app
+}
+
+func TestClipLine(t *testing.T) {
+	const max = 4096 + tileBuffer
+	tests := []struct {
+		name   string
+		points [][2]float64
+		want   [][][2]int32
+	}{
+		{
+			name:   "inside",
+			points: [][2]float64{{10, 10}, {100, 200}, {300, 50}},
+			want:   [][][2]int32{{{10, 10}, {100, 200}, {300, 50}}},
+		},
+		{
+			name:   "leaves right edge",
+			points: [][2]float64{{4000, 100}, {5000, 100}},
+			want:   [][][2]int32{{{4000, 100}, {max, 100}}},
+		},
+		{
+			name:   "enters top edge",
+			points: [][2]float64{{100, -500}, {100, 100}},
+			want:   [][][2]int32{{{100, -tileBuffer}, {100, 100}}},
+		},
+		{
+			name:   "crosses whole tile",
+			points: [][2]float64{{-1000, 2048}, {6000, 2048}},
+			want:   [][][2]int32{{{-tileBuffer, 2048}, {max, 2048}}},
+		},
+		{
+			name:   "diagonal through corner",
+			points: [][2]float64{{-164, -164}, {100, 100}},
+			want:   [][][2]int32{{{-tileBuffer, -tileBuffer}, {100, 100}}},
+		},
+		{
+			name:   "leaves and re-enters",
+			points: [][2]float64{{100, 100}, {100, 6000}, {200, 6000}, {200, 100}},
+			want: [][][2]int32{
+				{{100, 100}, {100, max}},
+				{{200, max}, {200, 100}},
+			},
+		},
+		{
+			name:   "outside",
+			points: [][2]float64{{-1000, -1000}, {-500, -1000}, {-500, 5000}},
+			want:   nil,
+		},
+		{
+			name:   "duplicate points after rounding",
+			points: [][2]float64{{10, 10}, {10.2, 10.1}, {20, 20}},
+			want:   [][][2]int32{{{10, 10}, {20, 20}}},
+		},
+		{
+			name:   "shorter than one pixel",
+			points: [][2]float64{{10, 10}, {10.3, 10.3}},
+			want:   nil,
+		},
+		{
+			name:   "single point",
+			points: [][2]float64{{10, 10}},
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clipLine(tt.points); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clipLine() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{``, false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"x", "abc"`, true},
+		{`"x","y"`, false},
+		{`*`, true},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGetMarkerTileETag(t *testing.T) {
+	app := newTestApp(t)
+	r := gin.New()
+	r.GET("/tiles/markers/:z/:x/:y", app.GetMarkerTile)
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	marker := Marker{Latitude: 39.9, Longitude: 116.4}
+	if err := insertMarker(app.DB, &marker); err != nil {
+		t.Fatal(err)
+	}
+
+	w := get("/tiles/markers/0/0/0.mvt", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != mvtContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, mvtContentType)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Body.Len() == 0 {
+		t.Fatalf("ETag = %q, body %d bytes", etag, w.Body.Len())
+	}
+
+	w = get("/tiles/markers/0/0/0.mvt", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("conditional request: status = %d, body %d bytes, want 304 and no body", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("304 ETag = %q, want %q", got, etag)
+	}
+
+	// 按坐标系分别缓存：缩放级别足够大时 WGS-84 和 GCJ-02 的偏移使瓦片内容不同
+	const z = 12
+	gx, gy := geo.MercatorPixel(geo.Point{Lat: marker.Latitude, Lng: marker.Longitude}, z)
+	path := fmt.Sprintf("/tiles/markers/%d/%d/%d.mvt", z, int(gx)/geo.TileSize, int(gy)/geo.TileSize)
+	wgs := get(path, "")
+	gcj := get(path+"?crs=gcj02", wgs.Header().Get("ETag"))
+	if wgs.Code != http.StatusOK || gcj.Code != http.StatusOK {
+		t.Errorf("z%d tile: status = %d (wgs84), %d (gcj02), want 200", z, wgs.Code, gcj.Code)
+	}
+
+	other := Marker{Latitude: 31.2, Longitude: 121.5}
+	if err := insertMarker(app.DB, &other); err != nil {
+		t.Fatal(err)
+	}
+	// 未指定坐标系时按存储坐标系保存
+	app.tiles.invalidatePoints(geo.Point{Lat: other.Latitude, Lng: other.Longitude})
+	w = get("/tiles/markers/0/0/0.mvt", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("after change: status = %d, want 200", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("ETag unchanged after adding a marker")
+	}
+
+	if w = get("/tiles/markers/1/2/0.mvt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("out of range tile: status = %d, want 404", w.Code)
+	}
+}
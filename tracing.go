@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"mapproject/pkg/config"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName 本服务创建的 span 使用的 tracer 名称
+const tracerName = "mapproject"
+
+// maxTracedStatementLength span 中记录的 SQL 语句最大长度
+const maxTracedStatementLength = 1000
+
+var tracer = otel.Tracer(tracerName)
+
+// initTracing 设置 W3C trace-context 传播，并在 tracing.enabled 时通过 OTLP 导出链路数据。
+// 返回的函数在退出前调用，导出剩余的数据
+func initTracing(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !cfg.Tracing.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var client otlptrace.Client
+	if cfg.Tracing.Protocol == "grpc" {
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Tracing.Endpoint)}
+		if cfg.Tracing.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	} else {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Tracing.Endpoint)}
+		if cfg.Tracing.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
+	}
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.Tracing.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// endSpan 结束 span，err 不为 nil 时记录错误
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startQuery 开始一次命名查询：创建 span 并记录耗时指标，调用返回的函数结束。
+// 用于包含逐行读取结果的查询函数，读取结果的时间也计入其中
+func (app *App) startQuery(ctx context.Context, name string) (context.Context, func()) {
+	ctx, span := tracer.Start(ctx, "query "+name, trace.WithAttributes(semconv.DBSystemSqlite))
+	done := app.metrics.timeQuery(name)
+	return ctx, func() {
+		done()
+		span.End()
+	}
+}
+
+// sqlContextExecer *sql.DB 和 *sql.Tx 共有的带 context 的方法
+type sqlContextExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// tracedDB 为每条 SQL 语句创建 span 的 queryExecer，语句在 ctx 中执行，请求取消时随之中止
+type tracedDB struct {
+	ctx context.Context
+	db  sqlContextExecer
+}
+
+// db 返回在当前请求的链路中执行语句的 queryExecer
+func (app *App) db(c *gin.Context) queryExecer {
+	return app.dbContext(c.Request.Context())
+}
+
+// dbContext 返回在 ctx 的链路中执行语句的 queryExecer
+func (app *App) dbContext(ctx context.Context) queryExecer {
+	return tracedDB{ctx: ctx, db: app.DB}
+}
+
+// tx 返回在当前请求的链路中执行事务语句的 queryExecer
+func (app *App) tx(c *gin.Context, tx *sql.Tx) queryExecer {
+	return tracedDB{ctx: c.Request.Context(), db: tx}
+}
+
+func (t tracedDB) start(query string) trace.Span {
+	statement := strings.TrimSpace(query)
+	var operation string
+	if fields := strings.Fields(statement); len(fields) > 0 {
+		operation = strings.ToUpper(fields[0])
+	}
+	if len(statement) > maxTracedStatementLength {
+		statement = statement[:maxTracedStatementLength]
+	}
+	_, span := tracer.Start(t.ctx, "sqlite "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemSqlite,
+			semconv.DBOperation(operation),
+			semconv.DBStatement(statement),
+		))
+	return span
+}
+
+func (t tracedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	span := t.start(query)
+	result, err := t.db.ExecContext(t.ctx, query, args...)
+	if err == nil {
+		if n, nerr := result.RowsAffected(); nerr == nil {
+			span.SetAttributes(attribute.Int64("db.rows_affected", n))
+		}
+	}
+	endSpan(span, err)
+	return result, err
+}
+
+// Query 的 span 在语句开始执行后结束，不包含逐行读取结果的时间，需要时用 startQuery 覆盖整个读取过程
+func (t tracedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	span := t.start(query)
+	rows, err := t.db.QueryContext(t.ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (t tracedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	span := t.start(query)
+	row := t.db.QueryRowContext(t.ctx, query, args...)
+	endSpan(span, row.Err())
+	return row
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// minTrajectoryPoints 轨迹至少需要的点数
+const minTrajectoryPoints = 2
+
+type LatLng struct {
+	Latitude  float64 `json:"latitude" binding:"min=-90,max=90"`
+	Longitude float64 `json:"longitude" binding:"min=-180,max=180"`
+}
+
+type Trajectory struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name" binding:"max=100"`
+	Description string   `json:"description" binding:"max=500"`
+	Color       string   `json:"color" binding:"omitempty,color"`
+	Points      []LatLng `json:"points" binding:"dive"`
+	CRS         string   `json:"crs,omitempty"`
+}
+
+// execer 同时适用于 *sql.DB 和 *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// encodePoints 将轨迹点编码为 [[lng,lat],...] 形式的 JSON 存储
+func encodePoints(points []LatLng) (string, error) {
+	coords := make([][2]float64, 0, len(points))
+	for _, p := range points {
+		coords = append(coords, [2]float64{p.Longitude, p.Latitude})
+	}
+	data, err := json.Marshal(coords)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func decodePoints(data string) ([]LatLng, error) {
+	var coords [][2]float64
+	if err := json.Unmarshal([]byte(data), &coords); err != nil {
+		return nil, err
+	}
+	points := make([]LatLng, 0, len(coords))
+	for _, c := range coords {
+		points = append(points, LatLng{Longitude: c[0], Latitude: c[1]})
+	}
+	return points, nil
+}
+
+// insertTrajectory 插入轨迹并回填 ID，坐标按 t.CRS 解释并转换为存储坐标系
+func insertTrajectory(db execer, t *Trajectory) error {
+	if t.Color == "" {
+		t.Color = "#409EFF"
+	}
+	crs := crsOrStorage(t.CRS)
+	stored := Trajectory{CRS: string(crs), Points: append([]LatLng(nil), t.Points...)}
+	stored.toCRS(storageCRS)
+	coords, err := encodePoints(stored.Points)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec("INSERT INTO trajectories (name, description, color, coordinates, source_crs) VALUES (?, ?, ?, ?, ?)",
+		t.Name, t.Description, t.Color, coords, crs)
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+	t.ID = int(id)
+	t.CRS = string(crs)
+	return nil
+}
+
+func (app *App) loadTrajectories(ctx context.Context) ([]Trajectory, error) {
+	ctx, done := app.startQuery(ctx, "trajectories")
+	defer done()
+	rows, err := app.dbContext(ctx).Query("SELECT id, name, description, color, coordinates FROM trajectories ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Trajectory
+	for rows.Next() {
+		var t Trajectory
+		var coords string
+		if err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.Color, &coords); err != nil {
+			return nil, err
+		}
+		if t.Points, err = decodePoints(coords); err != nil {
+			return nil, fmt.Errorf("轨迹 #%d 坐标数据损坏: %v", t.ID, err)
+		}
+		t.CRS = string(storageCRS)
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (app *App) GetTrajectories(c *gin.Context) {
+	crs, err := resolveCRS(c, "", storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	trajectories, err := app.loadTrajectories(c.Request.Context())
+	if err != nil {
+		app.internalError(c, "查询轨迹失败", zap.Error(err))
+		return
+	}
+	for i := range trajectories {
+		trajectories[i].toCRS(crs)
+	}
+	c.JSON(http.StatusOK, trajectories)
+}
+
+func (app *App) CreateTrajectory(c *gin.Context) {
+	var t Trajectory
+	if !app.bindJSON(c, &t) {
+		return
+	}
+	if len(t.Points) < minTrajectoryPoints {
+		app.respondError(c, http.StatusUnprocessableEntity, newFieldError("points", "too_short", apierror.New(apierror.TrajectoryTooShort)))
+		return
+	}
+
+	crs, err := resolveCRS(c, t.CRS, storageCRS)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	t.CRS = string(crs)
+
+	if err := insertTrajectory(app.db(c), &t); err != nil {
+		app.internalError(c, "插入轨迹失败", zap.Error(err))
+		return
+	}
+	app.tiles.invalidateAll()
+
+	app.recordUserAction(c, "create_trajectory",
+		fmt.Sprintf("创建轨迹 %s (%d 个点)", t.Name, len(t.Points)),
+		fmt.Sprintf("%d", t.ID))
+
+	app.log(c).Info("新增轨迹", zap.Int("id", t.ID), zap.Int("points", len(t.Points)))
+
+	c.JSON(http.StatusOK, t)
+}
+
+func (app *App) DeleteTrajectory(c *gin.Context) {
+	id := c.Param("id")
+
+	result, err := app.db(c).Exec("DELETE FROM trajectories WHERE id = ?", id)
+	if err != nil {
+		app.internalError(c, "删除轨迹失败", zap.Error(err), zap.String("id", id))
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		app.respondError(c, http.StatusNotFound, apierror.New(apierror.TrajectoryNotFound))
+		return
+	}
+	app.tiles.invalidateAll()
+
+	app.recordUserAction(c, "delete_trajectory", fmt.Sprintf("删除轨迹 #%s", id), id)
+
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	// maxCaptionLength 图片说明的最大长度（字符数）
+	maxCaptionLength = 200
+	// maxImagesPerMarker 每个标记点最多的图片数量
+	maxImagesPerMarker = 20
+	// maxImageSize 单张图片的最大字节数
+	maxImageSize = 5 << 20
+	// sniffLength http.DetectContentType 判断类型需要的字节数
+	sniffLength = 512
+)
+
+// allowedImageTypes 允许保存的图片类型
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// checkImage 检查图片大小，并按文件开头的内容判断类型，返回 MIME 类型。
+// 上传和 KMZ 导入共用，不信任文件扩展名和客户端声明的 Content-Type
+func checkImage(head []byte, size int64) (string, *apierror.Error) {
+	if size > maxImageSize {
+		return "", apierror.New(apierror.FileTooLarge)
+	}
+	if len(head) > sniffLength {
+		head = head[:sniffLength]
+	}
+	mimeType := http.DetectContentType(head)
+	if !allowedImageTypes[mimeType] {
+		return "", apierror.New(apierror.UnsupportedFileType)
+	}
+	return mimeType, nil
+}
+
+// fieldError 单个字段的校验错误，code 供程序判断，message 为按请求语言本地化的提示
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	msg *apierror.Error
+}
+
+// validationError 请求内容未通过校验，以 422 返回各字段的错误
+type validationError struct {
+	Fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	return e.localize(apierror.DefaultLang)
+}
+
+func (e *validationError) localize(lang apierror.Lang) string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.localizeFields(lang) {
+		messages[i] = f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// localizeFields 返回指定语言提示的字段错误
+func (e *validationError) localizeFields(lang apierror.Lang) []fieldError {
+	fields := make([]fieldError, len(e.Fields))
+	for i, f := range e.Fields {
+		fields[i] = f
+		fields[i].Message = f.msg.Localize(lang)
+	}
+	return fields
+}
+
+func newFieldError(field, code string, msg *apierror.Error) *validationError {
+	return &validationError{Fields: []fieldError{{Field: field, Code: code, msg: msg}}}
+}
+
+func init() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	// 错误中的字段名使用 JSON 字段名
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	v.RegisterValidation("color", func(fl validator.FieldLevel) bool {
+		return hexColorPattern.MatchString(fl.Field().String())
+	})
+}
+
+// validateCaption 校验图片说明的长度
+func validateCaption(caption string) *validationError {
+	if utf8.RuneCountInString(caption) > maxCaptionLength {
+		return newFieldError("caption", "too_long", apierror.New(apierror.FieldTooLong, "caption", strconv.Itoa(maxCaptionLength)))
+	}
+	return nil
+}
+
+// fieldPath 返回字段在请求中的路径，如 latitude、points[3].latitude
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[i+1:]
+	}
+	return fe.Field()
+}
+
+// describeFieldError 将校验规则转换为错误码和提示
+func describeFieldError(fe validator.FieldError) fieldError {
+	field, param := fieldPath(fe), fe.Param()
+	isString := fe.Kind() == reflect.String
+	switch fe.Tag() {
+	case "required":
+		return fieldError{Field: field, Code: "required", msg: apierror.New(apierror.FieldRequired, field)}
+	case "min":
+		if isString {
+			return fieldError{Field: field, Code: "too_short", msg: apierror.New(apierror.FieldTooShort, field, param)}
+		}
+		return fieldError{Field: field, Code: "out_of_range", msg: apierror.New(apierror.FieldTooSmall, field, param)}
+	case "max":
+		if isString {
+			return fieldError{Field: field, Code: "too_long", msg: apierror.New(apierror.FieldTooLong, field, param)}
+		}
+		return fieldError{Field: field, Code: "out_of_range", msg: apierror.New(apierror.FieldTooLarge, field, param)}
+	case "color":
+		return fieldError{Field: field, Code: "invalid_color", msg: apierror.New(apierror.FieldInvalidColor, field)}
+	}
+	return fieldError{Field: field, Code: "invalid", msg: apierror.New(apierror.FieldInvalid, field)}
+}
+
+// newValidationError 转换校验结果，fields 非空时只保留这些字段（JSON 字段名）的错误，没有错误时返回 nil
+func newValidationError(errs validator.ValidationErrors, fields ...string) *validationError {
+	only := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		only[f] = true
+	}
+	result := &validationError{}
+	for _, fe := range errs {
+		if len(only) == 0 || only[fe.Field()] {
+			result.Fields = append(result.Fields, describeFieldError(fe))
+		}
+	}
+	if len(result.Fields) == 0 {
+		return nil
+	}
+	return result
+}
+
+// validateStruct 按 binding 标签校验 obj，fields 非空时只校验这些字段，失败时返回 *validationError
+func validateStruct(obj interface{}, fields ...string) error {
+	err := binding.Validator.ValidateStruct(obj)
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return err
+	}
+	if verr := newValidationError(errs, fields...); verr != nil {
+		return verr
+	}
+	return nil
+}
+
+// validateImportedMarker 按 Marker 的 binding 标签校验导入的标记点，fields 非空时只校验文件中提供的这些字段，
+// 返回各字段的行错误（错误码与 JSON 接口相同），行号由调用方填写
+func validateImportedMarker(m *Marker, fields ...string) []rowError {
+	return importRowErrors(validateStruct(m, fields...))
+}
+
+// validateImportedTrajectory 按 Trajectory 的 binding 标签校验导入的轨迹，返回各字段的行错误
+func validateImportedTrajectory(t *Trajectory) []rowError {
+	return importRowErrors(validateStruct(t))
+}
+
+// importRowErrors 将 validateStruct 的结果转换为行错误
+func importRowErrors(err error) []rowError {
+	if err == nil {
+		return nil
+	}
+	var verr *validationError
+	if !errors.As(err, &verr) {
+		return []rowError{newRowError("", apierror.New(apierror.InvalidRequest, err))}
+	}
+	errs := make([]rowError, len(verr.Fields))
+	for i, f := range verr.Fields {
+		errs[i] = newRowError(f.Field, f.msg)
+	}
+	return errs
+}
+
+// bindJSON 解析并校验 JSON 请求体：格式错误返回 400，校验失败返回 422，ok 为 false 表示已写入响应
+func (app *App) bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	var errs validator.ValidationErrors
+	if errors.As(err, &errs) {
+		app.respondError(c, http.StatusUnprocessableEntity, newValidationError(errs))
+		return false
+	}
+	app.respondError(c, http.StatusBadRequest, err)
+	return false
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"mapproject/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// defaultVisitPageSize 访问记录接口未指定 limit 时每页返回的数量
+const defaultVisitPageSize = 100
+
+// VisitRecord 一次页面访问
+type VisitRecord struct {
+	ID        int    `json:"id"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Path      string `json:"path"`
+	Referer   string `json:"referer"`
+	VisitTime string `json:"visit_time"`
+	SessionID string `json:"session_id"`
+	IsBot     bool   `json:"is_bot"`
+}
+
+// UserAction 一次用户操作
+type UserAction struct {
+	ID           int    `json:"id"`
+	IP           string `json:"ip"`
+	UserAgent    string `json:"user_agent"`
+	ActionType   string `json:"action_type"`
+	ActionDetail string `json:"action_detail"`
+	TargetID     string `json:"target_id"`
+	ActionTime   string `json:"action_time"`
+	IsBot        bool   `json:"is_bot"`
+}
+
+// Visitor 按 IP 和 User-Agent 汇总的访客
+type Visitor struct {
+	IP           string   `json:"ip"`
+	UserAgent    string   `json:"user_agent"`
+	VisitCount   int      `json:"visit_count"`
+	FirstVisit   string   `json:"first_visit"`
+	LastVisit    string   `json:"last_visit"`
+	Paths        []string `json:"paths"`
+	Referers     []string `json:"referers"`
+	SessionCount int      `json:"session_count"`
+	IsBot        bool     `json:"is_bot"`
+	ActionCount  int      `json:"action_count"`
+}
+
+// timeCursor 按时间倒序分页的游标：上一页最后一条记录的时间和 ID
+type timeCursor struct {
+	Time string `json:"t"`
+	ID   int    `json:"id"`
+}
+
+// visitorCursor 访客列表的游标：上一页最后一个访客的最后访问时间、IP 和 User-Agent
+type visitorCursor struct {
+	LastVisit string `json:"t"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"ua"`
+}
+
+// visitFilter 访问记录和用户操作共用的筛选条件
+type visitFilter struct {
+	where []string
+	args  []interface{}
+}
+
+func (f *visitFilter) add(cond string, args ...interface{}) {
+	f.where = append(f.where, cond)
+	f.args = append(f.args, args...)
+}
+
+// whereClause 返回筛选条件和参数，extra 为附加的条件（如游标）
+func (f *visitFilter) whereClause(extra string, extraArgs ...interface{}) (string, []interface{}) {
+	conds := append([]string(nil), f.where...)
+	args := append([]interface{}(nil), f.args...)
+	if extra != "" {
+		conds = append(conds, extra)
+		args = append(args, extraArgs...)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// parseVisitFilter 解析 ip、bot、after、before 参数，时间条件作用于 timeColumn
+func parseVisitFilter(params url.Values, timeColumn string) (*visitFilter, error) {
+	f := &visitFilter{}
+	if ip := params.Get("ip"); ip != "" {
+		f.add("ip = ?", ip)
+	}
+	if v := params.Get("bot"); v != "" {
+		bot, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, apierror.New(apierror.InvalidParam, "bot")
+		}
+		f.add("is_bot = ?", bot)
+	}
+	dates := []struct{ param, op string }{
+		{"after", ">="},
+		{"before", "<"},
+	}
+	for _, d := range dates {
+		if v := params.Get(d.param); v != "" {
+			t, err := parseTimeParam(v)
+			if err != nil {
+				return nil, apierror.New(apierror.InvalidParam, d.param)
+			}
+			f.add(timeColumn+" "+d.op+" ?", t)
+		}
+	}
+	return f, nil
+}
+
+// parsePageLimit 解析 limit 参数，默认 defaultVisitPageSize，最大 maxPageSize
+func parsePageLimit(params url.Values) (int, error) {
+	v := params.Get("limit")
+	if v == "" {
+		return defaultVisitPageSize, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, apierror.New(apierror.InvalidParam, "limit")
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// parseTimeCursor 解析 cursor 参数，返回附加到筛选条件的游标条件
+func parseTimeCursor(params url.Values, timeColumn string) (string, []interface{}, error) {
+	v := params.Get("cursor")
+	if v == "" {
+		return "", nil, nil
+	}
+	var cur timeCursor
+	if err := decodeCursor(v, &cur); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("(%s < ? OR (%s = ? AND id < ?))", timeColumn, timeColumn), []interface{}{cur.Time, cur.Time, cur.ID}, nil
+}
+
+// countRows 执行 COUNT 查询
+func (app *App) countRows(ctx context.Context, query string, args []interface{}) (int, error) {
+	var total int
+	err := app.dbContext(ctx).QueryRow(query, args...).Scan(&total)
+	return total, err
+}
+
+// GetVisits 分页返回访问记录，按访问时间倒序。
+// 支持 ip、path（前缀）、session、bot、after、before 筛选，limit 和 cursor 分页
+func (app *App) GetVisits(c *gin.Context) {
+	params := c.Request.URL.Query()
+	f, err := parseVisitFilter(params, "visit_time")
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if path := params.Get("path"); path != "" {
+		f.add(`path LIKE ? ESCAPE '\'`, escapeLike(path)+"%")
+	}
+	if session := params.Get("session"); session != "" {
+		f.add("session_id = ?", session)
+	}
+	limit, err := parsePageLimit(params)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	cursorCond, cursorArgs, err := parseTimeCursor(params, "visit_time")
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), "visits")
+	defer done()
+	where, args := f.whereClause("")
+	total, err := app.countRows(ctx, "SELECT COUNT(*) FROM visits "+where, args)
+	if err != nil {
+		app.internalError(c, "查询访问记录失败", zap.Error(err))
+		return
+	}
+
+	where, args = f.whereClause(cursorCond, cursorArgs...)
+	rows, err := app.dbContext(ctx).Query(fmt.Sprintf(`
+		SELECT id, COALESCE(ip, ''), COALESCE(user_agent, ''), COALESCE(path, ''), COALESCE(referer, ''), COALESCE(visit_time, ''),
+			COALESCE(session_id, ''), is_bot
+		FROM visits
+		%s
+		ORDER BY visit_time DESC, id DESC
+		LIMIT %d
+	`, where, limit), args...)
+	if err != nil {
+		app.internalError(c, "查询访问记录失败", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	visits := []VisitRecord{}
+	for rows.Next() {
+		var v VisitRecord
+		if err := rows.Scan(&v.ID, &v.IP, &v.UserAgent, &v.Path, &v.Referer, &v.VisitTime, &v.SessionID, &v.IsBot); err != nil {
+			app.internalError(c, "读取访问记录失败", zap.Error(err))
+			return
+		}
+		visits = append(visits, v)
+	}
+	if err := rows.Err(); err != nil {
+		app.internalError(c, "读取访问记录失败", zap.Error(err))
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if len(visits) == limit {
+		last := visits[len(visits)-1]
+		c.Header("X-Next-Cursor", encodeCursor(timeCursor{Time: last.VisitTime, ID: last.ID}))
+	}
+	c.JSON(http.StatusOK, visits)
+}
+
+// GetUserActions 分页返回用户操作记录，按操作时间倒序。
+// 支持 ip、type（可用逗号分隔多个）、target、bot、after、before 筛选，limit 和 cursor 分页
+func (app *App) GetUserActions(c *gin.Context) {
+	params := c.Request.URL.Query()
+	f, err := parseVisitFilter(params, "action_time")
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if v := params.Get("type"); v != "" {
+		types := strings.Split(v, ",")
+		placeholders := make([]string, len(types))
+		args := make([]interface{}, len(types))
+		for i, t := range types {
+			placeholders[i] = "?"
+			args[i] = strings.TrimSpace(t)
+		}
+		f.add("action_type IN ("+strings.Join(placeholders, ", ")+")", args...)
+	}
+	if target := params.Get("target"); target != "" {
+		f.add("target_id = ?", target)
+	}
+	limit, err := parsePageLimit(params)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	cursorCond, cursorArgs, err := parseTimeCursor(params, "action_time")
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), "user_actions")
+	defer done()
+	where, args := f.whereClause("")
+	total, err := app.countRows(ctx, "SELECT COUNT(*) FROM user_actions "+where, args)
+	if err != nil {
+		app.internalError(c, "查询用户操作失败", zap.Error(err))
+		return
+	}
+
+	where, args = f.whereClause(cursorCond, cursorArgs...)
+	rows, err := app.dbContext(ctx).Query(fmt.Sprintf(`
+		SELECT id, COALESCE(ip, ''), COALESCE(user_agent, ''), COALESCE(action_type, ''),
+			COALESCE(action_detail, ''), COALESCE(target_id, ''), COALESCE(action_time, ''), is_bot
+		FROM user_actions
+		%s
+		ORDER BY action_time DESC, id DESC
+		LIMIT %d
+	`, where, limit), args...)
+	if err != nil {
+		app.internalError(c, "查询用户操作失败", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	actions := []UserAction{}
+	for rows.Next() {
+		var a UserAction
+		if err := rows.Scan(&a.ID, &a.IP, &a.UserAgent, &a.ActionType, &a.ActionDetail, &a.TargetID, &a.ActionTime, &a.IsBot); err != nil {
+			app.internalError(c, "读取用户操作失败", zap.Error(err))
+			return
+		}
+		actions = append(actions, a)
+	}
+	if err := rows.Err(); err != nil {
+		app.internalError(c, "读取用户操作失败", zap.Error(err))
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if len(actions) == limit {
+		last := actions[len(actions)-1]
+		c.Header("X-Next-Cursor", encodeCursor(timeCursor{Time: last.ActionTime, ID: last.ID}))
+	}
+	c.JSON(http.StatusOK, actions)
+}
+
+// GetVisitors 分页返回按 IP 和 User-Agent 汇总的访客，按最后访问时间倒序。
+// ip、bot、after、before 同时作用于访问记录和操作次数的统计范围
+func (app *App) GetVisitors(c *gin.Context) {
+	params := c.Request.URL.Query()
+	visitFilter, err := parseVisitFilter(params, "visit_time")
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	actionFilter, err := parseVisitFilter(params, "action_time")
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := parsePageLimit(params)
+	if err != nil {
+		app.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	var cursorCond string
+	var cursorArgs []interface{}
+	if v := params.Get("cursor"); v != "" {
+		var cur visitorCursor
+		if err := decodeCursor(v, &cur); err != nil {
+			app.respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		cursorCond = "WHERE (v.last_visit, v.ip, v.user_agent) < (?, ?, ?)"
+		cursorArgs = []interface{}{cur.LastVisit, cur.IP, cur.UserAgent}
+	}
+
+	ctx, done := app.startQuery(c.Request.Context(), "visitors")
+	defer done()
+	visitWhere, visitArgs := visitFilter.whereClause("")
+	total, err := app.countRows(ctx, `
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM visits `+visitWhere+` GROUP BY COALESCE(ip, ''), COALESCE(user_agent, '')
+		)`, visitArgs)
+	if err != nil {
+		app.internalError(c, "查询访客失败", zap.Error(err))
+		return
+	}
+
+	// 访问和操作分别按访客汇总后再关联，避免两张表逐行交叉连接
+	actionWhere, actionArgs := actionFilter.whereClause("")
+	args := append(append(visitArgs, actionArgs...), cursorArgs...)
+	rows, err := app.dbContext(ctx).Query(fmt.Sprintf(`
+		SELECT v.ip, v.user_agent, v.visit_count, v.first_visit, v.last_visit, v.paths, v.referers,
+			v.session_count, v.is_bot, COALESCE(a.action_count, 0)
+		FROM (
+			SELECT
+				COALESCE(ip, '') AS ip,
+				COALESCE(user_agent, '') AS user_agent,
+				COUNT(*) AS visit_count,
+				MIN(visit_time) AS first_visit,
+				MAX(visit_time) AS last_visit,
+				json_group_array(DISTINCT path) FILTER (WHERE path IS NOT NULL) AS paths,
+				json_group_array(DISTINCT referer) FILTER (WHERE referer <> '') AS referers,
+				COUNT(DISTINCT session_id) AS session_count,
+				MAX(is_bot) AS is_bot
+			FROM visits
+			%s
+			GROUP BY 1, 2
+		) v
+		LEFT JOIN (
+			SELECT COALESCE(ip, '') AS ip, COALESCE(user_agent, '') AS user_agent, COUNT(*) AS action_count
+			FROM user_actions
+			%s
+			GROUP BY 1, 2
+		) a ON a.ip = v.ip AND a.user_agent = v.user_agent
+		%s
+		ORDER BY v.last_visit DESC, v.ip DESC, v.user_agent DESC
+		LIMIT %d
+	`, visitWhere, actionWhere, cursorCond, limit), args...)
+	if err != nil {
+		app.internalError(c, "查询访客失败", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	visitors := []Visitor{}
+	for rows.Next() {
+		var v Visitor
+		var paths, referers string
+		if err := rows.Scan(&v.IP, &v.UserAgent, &v.VisitCount, &v.FirstVisit, &v.LastVisit, &paths, &referers, &v.SessionCount, &v.IsBot, &v.ActionCount); err != nil {
+			app.internalError(c, "读取访客失败", zap.Error(err))
+			return
+		}
+		if err := json.Unmarshal([]byte(paths), &v.Paths); err != nil {
+			app.internalError(c, "读取访客失败", zap.Error(err))
+			return
+		}
+		if err := json.Unmarshal([]byte(referers), &v.Referers); err != nil {
+			app.internalError(c, "读取访客失败", zap.Error(err))
+			return
+		}
+		visitors = append(visitors, v)
+	}
+	if err := rows.Err(); err != nil {
+		app.internalError(c, "读取访客失败", zap.Error(err))
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if len(visitors) == limit {
+		last := visitors[len(visitors)-1]
+		c.Header("X-Next-Cursor", encodeCursor(visitorCursor{LastVisit: last.LastVisit, IP: last.IP, UserAgent: last.UserAgent}))
+	}
+	c.JSON(http.StatusOK, visitors)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"mapproject/pkg/useragent"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// visit 一条待写入的访问记录
+type visit struct {
+	ip        string
+	userAgent string
+	path      string
+	referer   string
+	time      time.Time
+	sessionID string
+	bot       bool
+	// flagSession 该会话刚被识别为爬虫，写入时同时标记会话此前的访问记录
+	flagSession bool
+}
+
+// visitRecorder 在后台批量写入访问记录，请求处理只把记录放入队列，不等待数据库写入。
+// 队列超过 3/4 时按 visits.pressure_sample_ratio 抽样，队列满时丢弃，丢弃的数量计入指标
+type visitRecorder struct {
+	app       *App
+	sessions  *sessionTracker
+	queue     chan visit
+	highWater int
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+// newVisitRecorder 创建访问记录器并启动后台写入
+func newVisitRecorder(app *App) *visitRecorder {
+	cfg := app.Cfg.Visits
+	size := cfg.QueueSize
+	vr := &visitRecorder{
+		app:       app,
+		sessions:  newSessionTracker(time.Duration(cfg.SessionTimeout)*time.Minute, cfg.BotRequestsPerMinute),
+		queue:     make(chan visit, size),
+		highWater: size * 3 / 4,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go vr.run()
+	return vr
+}
+
+// shouldRecord 按配置的路径前缀判断是否记录该路径，exclude_paths 优先
+func (vr *visitRecorder) shouldRecord(path string) bool {
+	cfg := vr.app.Cfg.Visits
+	for _, prefix := range cfg.ExcludePaths {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	if len(cfg.IncludePaths) == 0 {
+		return true
+	}
+	for _, prefix := range cfg.IncludePaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// record 识别当前请求所属的会话和是否为爬虫，把访问记录加入写入队列，不阻塞请求
+func (vr *visitRecorder) record(c *gin.Context) {
+	cfg := vr.app.Cfg.Visits
+	path := c.Request.URL.Path
+	if !vr.shouldRecord(path) {
+		return
+	}
+
+	v := visit{
+		ip:        c.ClientIP(),
+		userAgent: c.Request.UserAgent(),
+		path:      path,
+		referer:   c.Request.Referer(),
+		time:      time.Now(),
+	}
+	var cookieID string
+	if cfg.SessionCookie {
+		if id, err := c.Cookie(sessionCookie); err == nil && validSessionID(id) {
+			cookieID = id
+		}
+	}
+	botHint := useragent.IsBot(v.userAgent) || path == "/robots.txt"
+	v.sessionID, v.bot, v.flagSession = vr.sessions.touch(cookieID, v.ip+"|"+v.userAgent, v.time, botHint)
+	if cfg.SessionCookie {
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(sessionCookie, v.sessionID, cfg.SessionTimeout*60, "/", "", false, true)
+	}
+
+	if !v.flagSession && len(vr.queue) >= vr.highWater && rand.Float64() >= cfg.PressureSampleRatio {
+		vr.app.metrics.observeVisits("sampled", 1)
+		return
+	}
+	select {
+	case vr.queue <- v:
+	default:
+		vr.app.metrics.observeVisits("queue_full", 1)
+	}
+}
+
+// run 攒够 batch_size 条或每隔 flush_interval 写入一次，收到退出信号时写完队列中剩余的记录
+func (vr *visitRecorder) run() {
+	defer close(vr.done)
+	batchSize := vr.app.Cfg.Visits.BatchSize
+	ticker := time.NewTicker(time.Duration(vr.app.Cfg.Visits.FlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]visit, 0, batchSize)
+	add := func(v visit) {
+		batch = append(batch, v)
+		if len(batch) >= batchSize {
+			vr.flush(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case v := <-vr.queue:
+			add(v)
+		case now := <-ticker.C:
+			vr.flush(batch)
+			batch = batch[:0]
+			vr.sessions.prune(now)
+		case <-vr.quit:
+			for {
+				select {
+				case v := <-vr.queue:
+					add(v)
+				default:
+					vr.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush 在一个事务中写入一批访问记录
+func (vr *visitRecorder) flush(batch []visit) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, done := vr.app.startQuery(context.Background(), "record_visits")
+	defer done()
+	if err := vr.insert(ctx, batch); err != nil {
+		vr.app.metrics.observeVisits("write_error", len(batch))
+		vr.app.Logger.Error("写入访问记录失败", zap.Error(err), zap.Int("count", len(batch)))
+		return
+	}
+	vr.app.metrics.observeVisits("", len(batch))
+}
+
+func (vr *visitRecorder) insert(ctx context.Context, batch []visit) error {
+	// 在开始事务前处理 IP，哈希模式取盐时可能需要写库
+	ips := make([]string, len(batch))
+	for i, v := range batch {
+		ips[i] = vr.app.privacy.anonymize(ctx, v.ip, v.time)
+	}
+
+	tx, err := vr.app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO visits (ip, user_agent, path, referer, visit_time, session_id, is_bot)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, v := range batch {
+		// 使用请求时间而不是写入时间
+		if _, err := stmt.ExecContext(ctx, ips[i], v.userAgent, v.path, v.referer, v.time.UTC().Format(sqliteTimeLayout),
+			v.sessionID, v.bot); err != nil {
+			return err
+		}
+		if v.flagSession {
+			if _, err := tx.ExecContext(ctx, "UPDATE visits SET is_bot = 1 WHERE session_id = ? AND is_bot = 0", v.sessionID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// close 通知后台写入退出并等待队列中的记录写完，ctx 到期时放弃等待。
+// 应在 HTTP 服务关闭、不再有请求调用 record 之后调用
+func (vr *visitRecorder) close(ctx context.Context) error {
+	close(vr.quit)
+	select {
+	case <-vr.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}